@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/maesoser/wan-controller/pkg/pihole"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "pihole-standin"
+)
+
+// pihole-standin serves a fake Pi-hole API to run wan-agent and wan-metrics
+// against when there is no Pi-hole around.
+func main() {
+
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: false,
+		FullTimestamp: true,
+	})
+
+	ListenAddr := flag.String("listen", pihole.DefaultAddr, "Server Addr")
+	Token := flag.String("token", "standin", "API Token")
+	flag.Parse()
+
+	standIn := pihole.NewStandIn(*Token)
+	standIn.Summary = pihole.Summary{
+		TotalQueriesToday:   1200,
+		BlockedQueriesToday: 180,
+		BlockedPcntToday:    15,
+		ForwardedQueries:    700,
+		CachedQueries:       320,
+		UniqueClients:       4,
+	}
+	standIn.Queries["example.com"] = 300
+	standIn.Ads["ads.example.net"] = 120
+	standIn.Sources["laptop|192.168.2.10"] = 800
+	standIn.Types["A (IPv4)"] = 70
+	standIn.Types["AAAA (IPv6)"] = 30
+
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Listening at %s", *ListenAddr)
+	log.Panic(http.ListenAndServe(*ListenAddr, standIn))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/vppmgr"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxConfigSize = 1 << 20
+
+type Status struct {
+	Configured bool      `json:"configured"`
+	Applied    time.Time `json:"applied,omitempty"`
+	Checksum   string    `json:"checksum,omitempty"`
+	Revision   uint64    `json:"revision,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+/*
+Agent applies the router configuration and serves it, locally, to
+wan-connect, which forwards the requests of the controller:
+
+	GET /status
+	GET/PUT /config
+	POST /commands/{command}
+	POST /diagnostics/{diagnostic}
+*/
+type Agent struct {
+	ConfigPath string
+	VPP        vppmgr.VPPManager
+	// DHCPAddr is the API of wan-dhcp, for the leases diagnostic.
+	DHCPAddr string
+	// ConnectPID is the PID file of wan-connect, signaled to reconnect when
+	// the certificate changes. Connector is its socket and ConnectStatus
+	// its status endpoint.
+	ConnectPID    string
+	Connector     string
+	ConnectStatus string
+	// ConfigKey, when set, is the key of the controllers. Configurations
+	// are then only loaded and applied if they are signed with it for this
+	// router, and newer than the last one accepted, see Load.
+	ConfigKey ed25519.PublicKey
+	// KeyStore, when set, is the file router keys are sealed with, see
+	// config.SealKey.
+	KeyStore string
+
+	mtx      sync.Mutex
+	renewMtx sync.Mutex
+	config   config.Config
+	revision uint64
+	status   Status
+	commands map[string]func() error
+}
+
+func NewAgent(configPath string, vpp vppmgr.VPPManager) *Agent {
+	a := &Agent{
+		ConfigPath:    configPath,
+		VPP:           vpp,
+		DHCPAddr:      "127.0.0.1:9610",
+		ConnectPID:    "/etc/wan-data/wan-connect.pid",
+		Connector:     "/etc/wan-data/wan-connector.sock",
+		ConnectStatus: "127.0.0.1:9640",
+		KeyStore:      "/etc/wan-data/keystore",
+	}
+	a.commands = map[string]func() error{
+		"apply": a.reapply,
+		"renew": a.renewNow,
+	}
+	return a
+}
+
+/*
+Load reads the configuration file, it is not applied. With ConfigKey set, a
+signed configuration is only loaded if it is for this router and not older
+than the last one accepted. Of an unsigned one, of a router enrolled or
+configured before configurations were signed, only what the router needs to
+reach the controllers is kept, until the controller pushes a signed one.
+*/
+func (a *Agent) Load() error {
+	var c config.Config
+	if err := c.Load(a.ConfigPath); err != nil {
+		return err
+	}
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	a.config = c
+	if a.ConfigKey != nil {
+		revision, err := a.loadRevision()
+		if err != nil {
+			a.status.Configured = false
+			return err
+		}
+		a.revision = revision
+		if c.Signed != nil {
+			signed, err := c.Signed.Open(a.ConfigKey, a.identity(), revision)
+			if err != nil {
+				a.status.Configured = false
+				return err
+			}
+			signed.Encryption = c.Encryption
+			c = signed
+		} else {
+			log.WithFields(log.Fields{"module": moduleName}).Warnln("Configuration is not signed, only reaching the controllers until one is pushed")
+			c = config.Config{
+				Name:            c.Name,
+				UUID:            c.UUID,
+				DNSs:            c.DNSs,
+				Network:         c.Network,
+				Encryption:      c.Encryption,
+				Controllers:     c.Controllers,
+				ControllerOrder: c.ControllerOrder,
+			}
+		}
+		a.config = c
+	}
+	a.status.Configured = true
+	a.status.Revision = c.Revision
+	return nil
+}
+
+// revisionPath is the file the revision of the last signed configuration
+// accepted is kept in, next to the configuration.
+func (a *Agent) revisionPath() string {
+	return filepath.Join(filepath.Dir(a.ConfigPath), "config-revision")
+}
+
+func (a *Agent) loadRevision() (uint64, error) {
+	data, err := ioutil.ReadFile(a.revisionPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (a *Agent) saveRevision(revision uint64) error {
+	if revision <= a.revision {
+		return nil
+	}
+	if err := ioutil.WriteFile(a.revisionPath(), []byte(strconv.FormatUint(revision, 10)), 0600); err != nil {
+		return err
+	}
+	a.revision = revision
+	return nil
+}
+
+// Identity returns the uuid of the router, the one its certificate was
+// issued for once enrolled. It is empty for a router never enrolled nor
+// configured.
+func (a *Agent) Identity() string {
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	return a.identity()
+}
+
+func (a *Agent) identity() string {
+	if cert, err := routerCertificate(a.config.Encryption); err == nil {
+		return cert.Subject.CommonName
+	}
+	return a.config.UUID
+}
+
+// Apply applies the loaded configuration.
+func (a *Agent) Apply() error {
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	return a.apply(a.config)
+}
+
+func (a *Agent) apply(c config.Config) error {
+	err := ApplyConfig(a.VPP, c)
+	a.status.Applied = time.Now()
+	a.status.Checksum = fmt.Sprintf("%x", c.Checksum())
+	a.status.Revision = c.Revision
+	a.status.LastError = ""
+	if err != nil {
+		a.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (a *Agent) reapply() error {
+	if err := a.Load(); err != nil {
+		return err
+	}
+	return a.Apply()
+}
+
+// Update saves and applies a new configuration. The previous one is kept as
+// a backup and restored if the new one can not be applied.
+func (a *Agent) Update(c config.Config) error {
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	if a.ConfigKey != nil {
+		uuid := a.identity()
+		if uuid == "" {
+			uuid = c.UUID
+		}
+		if c.Signed == nil {
+			log.WithFields(log.Fields{"module": moduleName}).Warnln("Rejected configuration that is not signed")
+			return errors.New("configuration is not signed")
+		}
+		// A configuration replayed, or an older one, is not applied again.
+		signed, err := c.Signed.Open(a.ConfigKey, uuid, a.revision+1)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Rejected configuration")
+			return err
+		}
+		// The encryption section is not signed, it is always the one of
+		// the router.
+		c = signed
+		c.Encryption = a.config.Encryption
+	} else {
+		if a.status.Configured && c.UUID != a.config.UUID {
+			return fmt.Errorf("configuration is for router %q", c.UUID)
+		}
+		// The router key never leaves the router, configurations pushed
+		// without a certificate keep the one there is.
+		if c.Encryption.Certificate == "" {
+			c.Encryption = a.config.Encryption
+		}
+	}
+	if a.status.Configured && c.Checksum() == a.config.Checksum() {
+		log.WithFields(log.Fields{"module": moduleName}).Infoln("Configuration is the same, skipping")
+		return nil
+	}
+	if a.status.Configured {
+		if _, err := a.config.Backup(a.ConfigPath); err != nil {
+			return fmt.Errorf("saving backup: %v", err)
+		}
+	}
+	if _, err := c.Save(a.ConfigPath); err != nil {
+		return fmt.Errorf("saving configuration: %v", err)
+	}
+	log.WithFields(log.Fields{"module": moduleName}).Infoln("New configuration received, applying it")
+	err := a.apply(c)
+	if err == nil || !a.status.Configured {
+		a.config = c
+		a.status.Configured = true
+		// Older configurations are rejected from now on, even from the
+		// file.
+		if rerr := a.saveRevision(c.Revision); rerr != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": rerr.Error()}).Errorln("Error saving the configuration revision")
+		}
+		return err
+	}
+	log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to apply the new configuration, rolling back")
+	if _, err := a.config.Save(a.ConfigPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error restoring the configuration")
+	}
+	if err := a.apply(a.config); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error applying the previous configuration")
+	}
+	return fmt.Errorf("rolled back: %v", err)
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && path[0] == "status":
+		a.mtx.Lock()
+		writeJSON(w, a.status)
+		a.mtx.Unlock()
+	case r.Method == "GET" && path[0] == "config":
+		a.mtx.Lock()
+		configured, c := a.status.Configured, a.config
+		a.mtx.Unlock()
+		if !configured {
+			http.Error(w, "router is not configured", http.StatusNotFound)
+			return
+		}
+		// The key never leaves the router.
+		c.Encryption.Key = ""
+		c.Encryption.KeyStore = ""
+		writeJSON(w, c)
+	case r.Method == "PUT" && path[0] == "config":
+		var c config.Config
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigSize)).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.Update(c); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && path[0] == "commands" && len(path) == 2:
+		command, ok := a.commands[path[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		log.WithFields(log.Fields{"module": moduleName, "command": path[1]}).Infoln("Running command")
+		if err := command(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && path[0] == "diagnostics" && len(path) == 2:
+		a.serveDiagnostic(w, r, path[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error encoding response")
+	}
+}
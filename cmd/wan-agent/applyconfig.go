@@ -1,22 +1,19 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"os"
 
+	"github.com/maesoser/wan-controller/binapi/nat"
 	"github.com/maesoser/wan-controller/pkg/config"
 	"github.com/maesoser/wan-controller/pkg/route"
 	"github.com/maesoser/wan-controller/pkg/vppmgr"
 	log "github.com/sirupsen/logrus"
-	"time"
 )
 
 func ApplyConfig(r vppmgr.VPPManager, c config.Config) error {
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[1/7] Configuring WAN port")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[1/10] Configuring WAN port")
 	/* Configure WAN Port
 	set interface state port1 up
 	set interface ip address port1 192.168.2.1/24
@@ -37,7 +34,7 @@ func ApplyConfig(r vppmgr.VPPManager, c config.Config) error {
 		r.AddDHCP(index, c.Name)
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[2/7] Creating network Bridge")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[2/10] Creating network Bridge")
 	/* Configure Loopback Port and Bridge
 	loopback create
 	set interface l2 bridge loop0 1 bvi
@@ -62,7 +59,7 @@ func ApplyConfig(r vppmgr.VPPManager, c config.Config) error {
 	set interface l2 bridge port2 1
 	set interface state port2 up
 	*/
-	log.WithFields(log.Fields{"module": moduleName}).Info("[3/7] Adding ports to the network bridge")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[3/10] Adding ports to the network bridge")
 	for _, port := range c.Network.Ports {
 		index, err := r.GetIfIndexByName(port)
 		if err != nil {
@@ -76,15 +73,20 @@ func ApplyConfig(r vppmgr.VPPManager, c config.Config) error {
 		}
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[4/7] Configuring TAP Port")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[4/10] Configuring TAP Port")
 	/* Configure TAP Port
 	create tap host-if-name lstack host-ip4-addr 192.168.2.2/24
 	set int l2 bridge tap0 1
 	set int state tap0 up
 	*/
-	gwaddr := net.ParseIP(c.Network.Gateway)
-	ifaddr := gwaddr
-	ifaddr[3] + 1
+	gwaddr := net.ParseIP(c.Network.Gateway).To4()
+	if gwaddr == nil {
+		return fmt.Errorf("invalid gateway %q", c.Network.Gateway)
+	}
+	// The host side of the TAP takes the address next to the gateway.
+	ifaddr := make(net.IP, len(gwaddr))
+	copy(ifaddr, gwaddr)
+	ifaddr[3]++
 	index, err = r.AddTAPIface("lstack", ifaddr, gwaddr)
 	if err != nil {
 		return err
@@ -96,37 +98,64 @@ func ApplyConfig(r vppmgr.VPPManager, c config.Config) error {
 		return err
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[5/7] Configuring NAT44")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[5/10] Configuring NAT44")
 	/* Configure NAT44
 	nat44 add interface address port1
 	set interface nat44 in loop0 out port1
 	*/
-	index, err := r.GetIfIndexByName(c.Network.Uplink.Name)
+	index, err = r.GetIfIndexByName(c.Network.Uplink.Name)
 	if err != nil {
 		return err
 	}
-	if err := r.AddNAT(index); err != nil {
+	if err := r.AddNAT(nat.InterfaceIndex(index)); err != nil {
 		return err
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[6/7] Adding NAT rules")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[6/10] Adding NAT rules")
 	/* Add NAT entries
 	nat44 add static mapping local 192.168.2.2 22 external port1 22 tcp
 	*/
-	gwaddr := net.ParseIP(c.Network.Gateway)
-	gwaddr[3] + 1
-	err := r.AddNATRule(index, gwaddr, 22, nil, 22, 0x06)
-	if err != nil {
+	if err := r.AddNATRule(nat.InterfaceIndex(index), ifaddr, 22, nil, 22, 0x06); err != nil {
 		return err
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Info("[7/7] Configuring Linux network")
+	log.WithFields(log.Fields{"module": moduleName}).Info("[7/10] Configuring Linux network")
 	c.WriteDNS()
 	c.WriteHostname()
-	if err := route.CheckDefaultGatewayRoute(net.ParseIP(c.Network.Gateway)); err != nil {
-		if err := route.AddDefaultRoute(net.ParseIP(c.Network.Gateway)); err != nil {
+	if err := route.CheckDefaultGatewayRoute(gwaddr); err != nil {
+		if err := route.AddDefaultRoute(gwaddr); err != nil {
 			return err
 		}
 	}
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("[8/10] Configuring DNS resolver")
+	/* Resolve through VPP, in vpp mode
+	dns name-server 8.8.8.8
+	bin dns_enable_disable
+	*/
+	if err := ApplyResolver(r, c); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("[9/10] Configuring flow export")
+	/* Export IPFIX flows
+	set ipfix exporter collector 192.168.0.76 port 4739 src 80.58.61.250 template-interval 20
+	flowprobe params record l3 l4 active 15 passive 120
+	flowprobe feature add-del port1 ip4
+	*/
+	if c.FlowExport != nil {
+		if err := ApplyFlowExport(r, c); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("[10/10] Configuring DNS filter")
+	if c.DNSFilter != nil {
+		// The Pi-hole may be down or still starting, the router works
+		// without filtering meanwhile.
+		if err := ApplyDNSFilter(*c.DNSFilter); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error configuring DNS filter")
+		}
+	}
 	return nil
 }
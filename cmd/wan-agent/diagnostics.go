@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/route"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxPingCount   = 20
+	commandTimeout = 2 * time.Minute
+)
+
+// vppShowCommands are the VPP CLI commands diagnostics may run, with any
+// argument after them.
+var vppShowCommands = []string{
+	"show version",
+	"show interface",
+	"show hardware-interfaces",
+	"show errors",
+	"show runtime",
+	"show threads",
+	"show buffers",
+	"show memory",
+	"show ip fib",
+	"show ip6 fib",
+	"show ip neighbors",
+	"show ip arp",
+	"show l2fib",
+	"show bridge-domain",
+	"show nat44",
+	"show dhcp",
+	"show dns",
+	"show flowprobe",
+	"show ipfix",
+	"show tap",
+	"show log",
+}
+
+var (
+	vppArgPattern = regexp.MustCompile(`^[A-Za-z0-9 ._:/-]+$`)
+	targetPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.:-]*$`)
+)
+
+// badRequest is a diagnostic refused because of its arguments.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+type DiagnosticRequest struct {
+	Command string `json:"command,omitempty"` // vpp
+	Target  string `json:"target,omitempty"`  // ping, traceroute
+	Count   int    `json:"count,omitempty"`   // ping
+}
+
+/*
+diagnostics are the read only troubleshooting commands the controller can
+run on the router. Their output is streamed back as it is produced:
+
+	POST /diagnostics/vpp         {"command": "show interface"}
+	POST /diagnostics/ping        {"target": "1.1.1.1", "count": 4}
+	POST /diagnostics/traceroute  {"target": "1.1.1.1"}
+	POST /diagnostics/routes
+	POST /diagnostics/leases
+*/
+func (a *Agent) diagnostics() map[string]func(context.Context, io.Writer, DiagnosticRequest) error {
+	return map[string]func(context.Context, io.Writer, DiagnosticRequest) error{
+		"vpp":        a.diagnoseVPP,
+		"ping":       diagnosePing,
+		"traceroute": diagnoseTraceroute,
+		"routes":     a.diagnoseRoutes,
+		"leases":     a.diagnoseLeases,
+	}
+}
+
+func (a *Agent) serveDiagnostic(w http.ResponseWriter, r *http.Request, name string) {
+	diagnostic, ok := a.diagnostics()[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var req DiagnosticRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	log.WithFields(log.Fields{"module": moduleName, "diagnostic": name, "command": req.Command, "target": req.Target}).Infoln("Running diagnostic")
+	ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	out := &flushWriter{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		out.f = f
+	}
+	if err := diagnostic(ctx, out, req); err != nil {
+		if !out.written {
+			status := http.StatusInternalServerError
+			if _, ok := err.(badRequest); ok {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		// The status is gone already, the error ends the output.
+		fmt.Fprintf(out, "\nerror: %v\n", err)
+	}
+}
+
+// flushWriter sends every write to the client right away.
+type flushWriter struct {
+	w       io.Writer
+	f       http.Flusher
+	written bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.written = true
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+func (a *Agent) diagnoseVPP(ctx context.Context, w io.Writer, req DiagnosticRequest) error {
+	command := strings.Join(strings.Fields(req.Command), " ")
+	if !vppArgPattern.MatchString(command) {
+		return badRequest("invalid command")
+	}
+	allowed := false
+	for _, prefix := range vppShowCommands {
+		if command == prefix || strings.HasPrefix(command, prefix+" ") {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return badRequest(fmt.Sprintf("command not allowed: %q", command))
+	}
+	output, err := a.VPP.CLI(command)
+	if output != "" {
+		io.WriteString(w, output)
+	}
+	return err
+}
+
+func validTarget(target string) error {
+	if len(target) > 253 || !targetPattern.MatchString(target) {
+		return badRequest("invalid target")
+	}
+	return nil
+}
+
+func diagnosePing(ctx context.Context, w io.Writer, req DiagnosticRequest) error {
+	if err := validTarget(req.Target); err != nil {
+		return err
+	}
+	count := req.Count
+	if count <= 0 {
+		count = 4
+	}
+	if count > maxPingCount {
+		count = maxPingCount
+	}
+	return run(ctx, w, "ping", "-n", "-c", fmt.Sprint(count), "-W", "2", "--", req.Target)
+}
+
+func diagnoseTraceroute(ctx context.Context, w io.Writer, req DiagnosticRequest) error {
+	if err := validTarget(req.Target); err != nil {
+		return err
+	}
+	return run(ctx, w, "traceroute", "-n", "-q", "1", "-w", "2", "-m", "30", "--", req.Target)
+}
+
+// run streams the output of a command, it is killed when ctx is done.
+func run(ctx context.Context, w io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd.Run()
+}
+
+func (a *Agent) diagnoseRoutes(ctx context.Context, w io.Writer, req DiagnosticRequest) error {
+	io.WriteString(w, "# linux\n")
+	if err := route.WriteRoutes(w); err != nil {
+		return err
+	}
+	io.WriteString(w, "\n# vpp\n")
+	return a.diagnoseVPP(ctx, w, DiagnosticRequest{Command: "show ip fib"})
+}
+
+// diagnoseLeases dumps the leases of every wan-dhcp scope.
+func (a *Agent) diagnoseLeases(ctx context.Context, w io.Writer, req DiagnosticRequest) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	get := func(path string) (*http.Response, error) {
+		request, err := http.NewRequest("GET", "http://"+a.DHCPAddr+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := client.Do(request.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, fmt.Errorf("wan-dhcp: %s", response.Status)
+		}
+		return response, nil
+	}
+	response, err := get("/scopes")
+	if err != nil {
+		return err
+	}
+	var scopes []string
+	err = json.NewDecoder(response.Body).Decode(&scopes)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		fmt.Fprintf(w, "# %s\n", scope)
+		response, err := get("/scopes/" + url.PathEscape(scope) + "/export?format=dnsmasq-leases")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
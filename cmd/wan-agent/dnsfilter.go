@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/pihole"
+	log "github.com/sirupsen/logrus"
+)
+
+// ApplyDNSFilter brings the blocking state and the lists of the Pi-hole in
+// line with the dns_filter section.
+func ApplyDNSFilter(f config.DNSFilter) error {
+	client := pihole.NewClient(f.Address, f.Token)
+	lists := []struct {
+		name    string
+		entries []string
+	}{
+		{pihole.Allow, f.Allow},
+		{pihole.Deny, f.Deny},
+		{pihole.RegexAllow, f.RegexAllow},
+		{pihole.RegexDeny, f.RegexDeny},
+		{pihole.Adlist, f.Adlists},
+	}
+	for _, list := range lists {
+		if list.entries == nil {
+			continue
+		}
+		if err := client.SyncList(list.name, list.entries); err != nil {
+			return fmt.Errorf("%s list: %v", list.name, err)
+		}
+	}
+	if f.Blocking == nil || *f.Blocking {
+		return client.Enable()
+	}
+	disableFor := time.Duration(f.DisableFor) * time.Second
+	log.WithFields(log.Fields{"module": moduleName, "for": disableFor}).Warnln("Disabling DNS blocking")
+	return client.Disable(disableFor)
+}
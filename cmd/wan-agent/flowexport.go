@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/maesoser/wan-controller/binapi/flowprobe"
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/vppmgr"
+	log "github.com/sirupsen/logrus"
+)
+
+const lanIface = "loop0"
+
+// ApplyFlowExport enables the flowprobe plugin on the configured
+// interfaces, the LAN by default, exporting to the collector. By default
+// that is wan-connect, on the host end of the TAP, which relays the records
+// to the controller.
+func ApplyFlowExport(r vppmgr.VPPManager, c config.Config) error {
+	f := c.FlowExport
+	collector, err := c.FlowCollector()
+	if err != nil {
+		return err
+	}
+	collectorAddr, err := net.ResolveUDPAddr("udp4", collector)
+	if err != nil {
+		return err
+	}
+	sourceIP, err := c.FlowSource()
+	if err != nil {
+		return err
+	}
+
+	record := flowprobe.FLOWPROBE_RECORD_FLAG_L3 | flowprobe.FLOWPROBE_RECORD_FLAG_L4
+	if len(f.Record) > 0 {
+		record = 0
+		for _, layer := range f.Record {
+			switch layer {
+			case "l2":
+				record |= flowprobe.FLOWPROBE_RECORD_FLAG_L2
+			case "l3":
+				record |= flowprobe.FLOWPROBE_RECORD_FLAG_L3
+			case "l4":
+				record |= flowprobe.FLOWPROBE_RECORD_FLAG_L4
+			default:
+				return fmt.Errorf("unknown flow record layer %q", layer)
+			}
+		}
+	}
+	active, passive, templateInterval := f.ActiveTimeout, f.InactiveTimeout, f.TemplateInterval
+	if active <= 0 {
+		active = 15
+	}
+	if passive <= 0 {
+		passive = 120
+	}
+	if templateInterval <= 0 {
+		templateInterval = 20
+	}
+
+	if err := r.SetFlowprobeParams(record, uint32(active), uint32(passive)); err != nil {
+		return err
+	}
+	if err := r.SetIPFIXExporter(collectorAddr.IP, uint16(collectorAddr.Port), sourceIP, uint32(templateInterval)); err != nil {
+		return err
+	}
+	ifaces := f.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []string{lanIface}
+	}
+	for _, name := range ifaces {
+		index, err := r.GetIfIndexByName(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := r.AddFlowprobe(index, f.Template, f.Direction); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	log.WithFields(log.Fields{"module": moduleName, "collector": collectorAddr.String()}).Infof("Exporting the flows of %v", ifaces)
+	return nil
+}
@@ -8,14 +8,12 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net"
+	"net/http"
 	"os"
 
-	"github.com/maesoser/wan-controller/pkg/config"
-	"github.com/maesoser/wan-controller/pkg/route"
 	"github.com/maesoser/wan-controller/pkg/vppmgr"
+	"github.com/maesoser/wan-controller/pkg/ztp"
 	log "github.com/sirupsen/logrus"
-	"time"
 )
 
 const (
@@ -31,6 +29,15 @@ func main() {
 
 	ConfigPath := flag.String("config", "/etc/wan-data/routerconfig.json", "Configuration Path")
 	PidPath := flag.String("pid", "/etc/wan-data/wan-agent.pid", "PID File")
+	ListenAddr := flag.String("listen", "127.0.0.1:9620", "Server Addr")
+	DHCPAddr := flag.String("dhcp", "127.0.0.1:9610", "wan-dhcp API Addr")
+	BootstrapKey := flag.String("bootstrap-key", "/etc/wan-data/bootstrap.pub", "Public key bootstraps are signed with")
+	BootstrapPath := flag.String("bootstrap", "/etc/wan-data/bootstrap.json", "Bootstrap Path")
+	ConnectPID := flag.String("connect-pid", "/etc/wan-data/wan-connect.pid", "PID File of wan-connect")
+	ConnectorPath := flag.String("connector", "/etc/wan-data/wan-connector.sock", "wan-connect Socket")
+	ConnectStatus := flag.String("connect-status", "127.0.0.1:9640", "wan-connect Status Addr")
+	ConfigKey := flag.String("config-key", "/etc/wan-data/config.pub", "Public key configurations are signed with")
+	KeyStore := flag.String("keystore", "/etc/wan-data/keystore", "Secret router keys are sealed with, empty to keep them in clear")
 	flag.Parse()
 
 	err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
@@ -40,19 +47,37 @@ func main() {
 
 	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-agent")
 
-	var routerConfig config.Config
 	var vppManager vppmgr.VPPManager
 	if err := vppManager.Init(); err != nil {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Error("Unable to open a channel with VPP daemon")
 	}
 
-	if err := routerConfig.Load(*ConfigPath); err != nil {
+	agent := NewAgent(*ConfigPath, vppManager)
+	agent.DHCPAddr = *DHCPAddr
+	agent.ConnectPID = *ConnectPID
+	agent.Connector = *ConnectorPath
+	agent.ConnectStatus = *ConnectStatus
+	agent.KeyStore = *KeyStore
+	if key, err := ztp.LoadPublicKey(*ConfigKey); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Configuration signatures are not checked")
+	} else {
+		agent.ConfigKey = key
+	}
+	if err := agent.Load(); err != nil {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to load config, router is not active.")
-		time.Sleep(30 * time.Second)
+		// An enrolled router waits for the controller instead.
+		if agent.Identity() == "" {
+			go agent.Provision(*BootstrapKey, *BootstrapPath)
+		}
+	} else {
+		log.WithFields(log.Fields{"module": moduleName}).Infof("Configuration file loaded, applying it")
+		if err := agent.Apply(); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to apply VPP Config")
+		}
 	}
 
-	log.WithFields(log.Fields{"module": moduleName}).Infof("Configuration file loaded, applying it, applying it")
-	if err := ApplyConfig(vppManager, routerConfig); err != nil {
-		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to apply VPP Config")
-	}
+	go agent.RenewCertificate(nil)
+
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Serving the agent API at %s", *ListenAddr)
+	log.Panic(http.ListenAndServe(*ListenAddr, agent))
 }
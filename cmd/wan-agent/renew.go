@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/enroll"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	renewInterval  = time.Hour
+	confirmTimeout = time.Minute
+)
+
+// RenewCertificate renews the router certificate once two thirds of its
+// validity are gone, checking every hour until stop is closed.
+func (a *Agent) RenewCertificate(stop <-chan struct{}) {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.renew(false); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error renewing the router certificate")
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// renewNow renews the router certificate at once. It runs in the
+// background: the request asking for it likely comes through the session of
+// wan-connect, which the rotation restarts.
+func (a *Agent) renewNow() error {
+	go func() {
+		if err := a.renew(true); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error renewing the router certificate")
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) renew(force bool) error {
+	defer a.renewMtx.Unlock()
+	a.renewMtx.Lock()
+	a.mtx.Lock()
+	c := a.config
+	a.mtx.Unlock()
+	if c.Encryption.Certificate == "" {
+		return nil
+	}
+	cert, err := routerCertificate(c.Encryption)
+	if err != nil {
+		return err
+	}
+	if !force && time.Until(cert.NotAfter) > cert.NotAfter.Sub(cert.NotBefore)/3 {
+		return nil
+	}
+	log.WithFields(log.Fields{"module": moduleName, "expires": cert.NotAfter}).Infoln("Renewing the router certificate")
+	keyPEM, csrPEM, err := enroll.NewKey(cert.Subject.CommonName)
+	if err != nil {
+		return err
+	}
+	reply, err := enroll.Renew(a.connectorClient(), csrPEM)
+	if err != nil {
+		return err
+	}
+	return a.rotate(keyPEM, reply)
+}
+
+func routerCertificate(e config.EncryptConfig) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(e.Certificate))
+	if block == nil {
+		return nil, errors.New("no router certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+/*
+rotate installs a new certificate and key, sealed with the key store of the
+agent if the previous key was not sealed yet. The previous ones are kept, in
+the backup of the configuration, until wan-connect has connected with the
+new ones, and restored if it does not.
+*/
+func (a *Agent) rotate(keyPEM string, reply *enroll.Reply) error {
+	a.mtx.Lock()
+	previous := a.config
+	next := previous
+	next.Encryption.Certificate = reply.Certificate
+	next.Encryption.CA = reply.CA
+	next.Encryption.Key = keyPEM
+	if next.Encryption.KeyStore == "" {
+		next.Encryption.KeyStore = a.KeyStore
+	}
+	if next.Encryption.KeyStore != "" {
+		sealed, err := config.SealKey(keyPEM, next.Encryption.KeyStore)
+		if err != nil {
+			a.mtx.Unlock()
+			return err
+		}
+		next.Encryption.Key = sealed
+	}
+	if _, err := previous.Backup(a.ConfigPath); err != nil {
+		a.mtx.Unlock()
+		return fmt.Errorf("saving backup: %v", err)
+	}
+	if _, err := next.Save(a.ConfigPath); err != nil {
+		a.mtx.Unlock()
+		return err
+	}
+	a.config = next
+	a.mtx.Unlock()
+
+	since := time.Now()
+	if err := signalDaemon(a.ConnectPID, syscall.SIGHUP); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to restart wan-connect")
+	}
+	err := a.waitSession(since)
+	if err == nil {
+		log.WithFields(log.Fields{"module": moduleName}).Infoln("Router certificate rotated")
+		return nil
+	}
+
+	a.mtx.Lock()
+	if _, err := previous.Save(a.ConfigPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error restoring the configuration")
+	}
+	a.config = previous
+	a.mtx.Unlock()
+	signalDaemon(a.ConnectPID, syscall.SIGHUP)
+	return fmt.Errorf("new certificate not working, previous one restored: %v", err)
+}
+
+// waitSession waits for wan-connect to have a session newer than since.
+func (a *Agent) waitSession(since time.Time) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(confirmTimeout)
+	err := errors.New("no session")
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		var status struct {
+			Session tunnel.Status `json:"session"`
+		}
+		response, rerr := client.Get("http://" + a.ConnectStatus + "/status")
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		rerr = json.NewDecoder(response.Body).Decode(&status)
+		response.Body.Close()
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		if status.Session.Connected && status.Session.Since.After(since) {
+			return nil
+		}
+		if status.Session.LastError != "" {
+			err = errors.New(status.Session.LastError)
+		}
+	}
+	return err
+}
+
+// connectorClient reaches the controller through wan-connect.
+func (a *Agent) connectorClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", a.Connector)
+			},
+		},
+	}
+}
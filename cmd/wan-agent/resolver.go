@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/vppmgr"
+	log "github.com/sirupsen/logrus"
+)
+
+// ApplyResolver enables the VPP dns plugin in vpp mode. The forwarder mode
+// is served by wan-dns and the pihole one by the Pi-hole, both on their own.
+func ApplyResolver(r vppmgr.VPPManager, c config.Config) error {
+	switch mode := c.ResolverMode(); mode {
+	case config.ResolverSystem, config.ResolverPiHole, config.ResolverForwarder:
+		return nil
+	case config.ResolverVPP:
+	default:
+		return fmt.Errorf("unknown resolver mode %q", mode)
+	}
+	if len(c.Resolver.Records) > 0 {
+		log.WithFields(log.Fields{"module": moduleName}).Warnln("Local DNS records need the forwarder mode, ignoring them")
+	}
+	added := 0
+	for _, upstream := range c.ResolverUpstreams() {
+		server := net.ParseIP(upstream)
+		if server == nil {
+			if strings.HasPrefix(upstream, "tls://") {
+				log.WithFields(log.Fields{"module": moduleName, "upstream": upstream}).Warnln("VPP does not support DNS over TLS, skipping upstream")
+				continue
+			}
+			return fmt.Errorf("invalid upstream %q, VPP only takes addresses", upstream)
+		}
+		if err := r.AddDNSServer(server); err != nil {
+			return err
+		}
+		added++
+	}
+	if added == 0 {
+		return fmt.Errorf("no upstream VPP can resolve through")
+	}
+	return r.EnableDNS(true)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalDaemon sends sig to the daemon whose PID is in pidPath.
+func signalDaemon(pidPath string, sig syscall.Signal) error {
+	data, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid PID file %s", pidPath)
+	}
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/enroll"
+	"github.com/maesoser/wan-controller/pkg/ztp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mediaDir       = "/run/wan-media"
+	minEnrollRetry = 10 * time.Second
+	maxEnrollRetry = 10 * time.Minute
+)
+
+/*
+Provision brings up a router with no configuration: it waits for
+removable media with a bootstrap signed with the key at keyPath, copies it
+to bootstrapPath and enrolls with the controllers it names. A bootstrap
+already copied, by a provisioning that did not finish, is used first.
+*/
+func (a *Agent) Provision(keyPath, bootstrapPath string) {
+	key, err := ztp.LoadPublicKey(keyPath)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Zero touch provisioning is disabled")
+		return
+	}
+	b, _, err := ztp.ReadBootstrap(bootstrapPath, key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Invalid bootstrap, ignoring it")
+		}
+		log.WithFields(log.Fields{"module": moduleName}).Infoln("Waiting for removable media with a bootstrap")
+		if b, err = waitBootstrap(key, bootstrapPath); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error watching removable media")
+			return
+		}
+	}
+	log.WithFields(log.Fields{"module": moduleName, "uuid": b.UUID}).Infoln("Bootstrap found, enrolling")
+	if err := a.Enroll(b); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error enrolling")
+		return
+	}
+	if err := os.Remove(bootstrapPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error removing bootstrap")
+	}
+}
+
+func waitBootstrap(key ed25519.PublicKey, bootstrapPath string) (*ztp.Bootstrap, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	devices, err := ztp.WatchMedia(stop)
+	if err != nil {
+		return nil, err
+	}
+	for dev := range devices {
+		b, data, err := readBootstrap(dev, key)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "device": dev, "error": err.Error()}).Warnln("No valid bootstrap on media")
+			continue
+		}
+		if err := ioutil.WriteFile(bootstrapPath, data, 0600); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return nil, errors.New("stopped watching media")
+}
+
+func readBootstrap(dev string, key ed25519.PublicKey) (*ztp.Bootstrap, []byte, error) {
+	unmount, err := ztp.Mount(dev, mediaDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unmount()
+	return ztp.ReadBootstrap(filepath.Join(mediaDir, ztp.BootstrapFile), key)
+}
+
+// enrollKey is the key of an enrollment in progress, kept next to the
+// configuration.
+func (a *Agent) enrollKey() string {
+	return filepath.Join(filepath.Dir(a.ConfigPath), "enrollment.json")
+}
+
+// pendingKey returns the key of an enrollment that did not finish, or a new
+// one. The key is written, sealed, before the controller is asked for its
+// certificate: a router that dies in between asks again with the same key.
+func (a *Agent) pendingKey(uuid string) (keyPEM, csrPEM string, err error) {
+	var pending config.EncryptConfig
+	if data, err := ioutil.ReadFile(a.enrollKey()); err == nil && json.Unmarshal(data, &pending) == nil {
+		if keyPEM, err = pending.PrivateKey(); err == nil {
+			if csrPEM, err = enroll.NewRequest(uuid, keyPEM); err == nil {
+				return keyPEM, csrPEM, nil
+			}
+		}
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to reuse the enrollment key, creating another")
+	}
+	if keyPEM, csrPEM, err = enroll.NewKey(uuid); err != nil {
+		return "", "", err
+	}
+	pending = config.EncryptConfig{Key: keyPEM, KeyStore: a.KeyStore}
+	if a.KeyStore != "" {
+		if pending.Key, err = config.SealKey(keyPEM, a.KeyStore); err != nil {
+			return "", "", err
+		}
+	}
+	if _, err := pending.SaveToFile(a.enrollKey()); err != nil {
+		return "", "", err
+	}
+	return keyPEM, csrPEM, nil
+}
+
+// Enroll brings up the network of the bootstrap, then sends its hello until
+// a controller answers and makes the certificate it issued part of the
+// configuration. The rest of the configuration is pushed by the controller
+// once connected.
+func (a *Agent) Enroll(b *ztp.Bootstrap) error {
+	c := config.Config{
+		Name:        b.Name,
+		UUID:        b.UUID,
+		DNSs:        b.DNSs,
+		Network:     b.Network,
+		Controllers: b.Controllers,
+	}
+	a.mtx.Lock()
+	err := a.apply(c)
+	a.mtx.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error applying the bootstrap network, enrolling anyway")
+	}
+
+	keyPEM, csrPEM, err := a.pendingKey(b.UUID)
+	if err != nil {
+		return fmt.Errorf("creating router key: %v", err)
+	}
+	hello := enroll.Hello{UUID: b.UUID, Token: b.Token, CSR: csrPEM}
+	retry := minEnrollRetry
+	var reply *enroll.Reply
+	for {
+		if reply, err = enroll.Send(b.Controllers, b.CA, hello); err == nil {
+			break
+		}
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnf("Error enrolling, retrying in %v", retry)
+		time.Sleep(retry)
+		if retry *= 2; retry > maxEnrollRetry {
+			retry = maxEnrollRetry
+		}
+	}
+	c.Encryption = config.EncryptConfig{
+		Certificate: reply.Certificate,
+		Key:         keyPEM,
+		CA:          reply.CA,
+		KeyStore:    a.KeyStore,
+	}
+	if a.KeyStore != "" {
+		if c.Encryption.Key, err = config.SealKey(keyPEM, a.KeyStore); err != nil {
+			return fmt.Errorf("sealing router key: %v", err)
+		}
+	}
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	if _, err := c.Save(a.ConfigPath); err != nil {
+		return fmt.Errorf("saving configuration: %v", err)
+	}
+	if err := os.Remove(a.enrollKey()); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error removing the enrollment key")
+	}
+	a.config = c
+	// It is not signed, it is used until the controller pushes one.
+	a.status.Configured = true
+	log.WithFields(log.Fields{"module": moduleName, "uuid": b.UUID}).Infoln("Router enrolled")
+	// wan-connect reads the new certificate when it dials again.
+	if err := signalDaemon(a.ConnectPID, syscall.SIGHUP); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to restart wan-connect")
+	}
+	return nil
+}
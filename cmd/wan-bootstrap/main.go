@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/ztp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "wan-bootstrap"
+)
+
+// wan-bootstrap writes the signed bootstrap a router is provisioned with,
+// or, with -genkey, the key pair bootstraps are signed with.
+func main() {
+
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: false,
+		FullTimestamp: true,
+	})
+
+	KeyPath := flag.String("key", "bootstrap.key", "Signing Key")
+	GenKey := flag.Bool("genkey", false, "Create the signing key, and its public half with a .pub extension")
+	UUID := flag.String("uuid", "", "Router UUID")
+	Name := flag.String("name", "", "Router Name")
+	Token := flag.String("token", "", "Enrollment Token")
+	Controllers := flag.String("controllers", "", "Comma separated controllers")
+	CAPath := flag.String("ca", "", "CA of the controllers")
+	NetworkPath := flag.String("network", "", "Network section of the router, in JSON, to reach the controllers through")
+	DNSs := flag.String("dns", "", "Comma separated DNS servers")
+	Expires := flag.Duration("expires", 7*24*time.Hour, "Validity")
+	OutPath := flag.String("o", ztp.BootstrapFile, "Output")
+	flag.Parse()
+
+	if *GenKey {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error creating key")
+		}
+		der, _ := x509.MarshalPKCS8PrivateKey(private)
+		pub, _ := x509.MarshalPKIXPublicKey(public)
+		if err := ioutil.WriteFile(*KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writing key")
+		}
+		pubPath := strings.TrimSuffix(*KeyPath, ".key") + ".pub"
+		if err := ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writing public key")
+		}
+		log.WithFields(log.Fields{"module": moduleName}).Infof("Key written to %s, install %s on the routers", *KeyPath, pubPath)
+		return
+	}
+
+	key, err := ztp.LoadPrivateKey(*KeyPath)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading key")
+	}
+	ca, err := ioutil.ReadFile(*CAPath)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading CA")
+	}
+	network, err := ioutil.ReadFile(*NetworkPath)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading network")
+	}
+	b := ztp.Bootstrap{
+		UUID:        *UUID,
+		Name:        *Name,
+		Token:       *Token,
+		Controllers: strings.Split(*Controllers, ","),
+		CA:          string(ca),
+		Expires:     time.Now().Add(*Expires).UTC().Truncate(time.Second),
+	}
+	if err := json.Unmarshal(network, &b.Network); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading network")
+	}
+	if *DNSs != "" {
+		b.DNSs = strings.Split(*DNSs, ",")
+	}
+	signed, err := ztp.Sign(b, key)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error signing bootstrap")
+	}
+	data, _ := json.MarshalIndent(signed, "", "\t")
+	if err := ioutil.WriteFile(*OutPath, data, 0600); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writing bootstrap")
+	}
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Bootstrap for %s written to %s", b.UUID, *OutPath)
+}
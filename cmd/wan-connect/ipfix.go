@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+// flowRetry is how long relayFlows waits to try again when the flows can
+// not be received, the TAP may not be up yet.
+const flowRetry = 30 * time.Second
+
+// relayFlows receives the IPFIX messages VPP exports and relays them to the
+// controller over a stream of the session, so the controller knows which
+// router they come from. They are received at addr or, when it is auto, at
+// the collector of the configuration, the host end of the TAP.
+func relayFlows(addr, configPath string, session *tunnel.Client) {
+	for {
+		if err := serveFlows(addr, configPath, session); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to relay flows, trying again later")
+		}
+		time.Sleep(flowRetry)
+	}
+}
+
+// serveFlows relays the messages coming from the exporter of the
+// configuration, anything else could pass for flows of this router.
+// Messages are dropped while there is no session.
+func serveFlows(addr, configPath string, session *tunnel.Client) error {
+	var c config.Config
+	if err := c.Load(configPath); err != nil {
+		return err
+	}
+	if addr == "auto" {
+		collector, err := c.FlowCollector()
+		if err != nil {
+			return err
+		}
+		addr = collector
+	}
+	exporter, err := c.FlowSource()
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Relaying flows received at %s from %s", addr, exporter)
+
+	var stream net.Conn
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(exporter) {
+			log.WithFields(log.Fields{"module": moduleName, "remote": from.String()}).Debugln("Dropping flows, not from the exporter")
+			continue
+		}
+		if stream == nil {
+			if stream, err = session.Open(tunnel.ServiceIPFIX); err != nil {
+				log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Debugln("Dropping flows, no stream to the controller")
+				stream = nil
+				continue
+			}
+		}
+		if err := tunnel.WriteDatagram(stream, buf[:n]); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Debugln("Flow stream closed, opening another")
+			stream.Close()
+			stream = nil
+		}
+	}
+}
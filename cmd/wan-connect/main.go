@@ -1,12 +1,21 @@
 package main
 
 import (
-	"github.com/maesoser/wan-agent/pkg/config"
-	log "github.com/sirupsen/logrus"
-	"io"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
 )
 
 /*
@@ -14,70 +23,170 @@ import (
                           |
             +---------|---+
 <-- [SSL] --|  proxy  |---------[wan-controller]
-            +---------|
+            +---------|---+
+                          |
+                          +-----[wan-agent/wan-dhcp]
 
+A single session to a controller, over TLS 1.3 and authenticated with the
+router certificate, is kept open and every connection accepted on the
+socket becomes a stream of it. There is no plaintext fallback: while the
+session is down local connections are held for a while, then closed.
+
+Controllers are tried in priority or latency order, the healthy ones first,
+and the session fails over to the next one when it drops. In priority order
+it moves back to a controller listed first once probes find it healthy
+again. The local status
+endpoint tells which one is active.
+
+The controller opens streams the other way on the same session, so it can
+reach a router behind NAT: they are forwarded to the local APIs of
+wan-agent, wan-metrics and wan-dhcp.
+
+The IPFIX messages VPP exports are relayed over the session too, so the
+controller tells routers apart by their certificate and not by an address
+that NAT may share. They are only received on the host end of the TAP, and
+only from the VPP exporter.
 */
 
 // SockAddr is the Unix socket created as a ggateway for the rest of güan processes
 const (
 	SocketAddr = "/etc/wan-data/wan-connector.sock"
-	ConfigPath = "/etc/wan-data"
-)
+	ConfigPath = "/etc/wan-data/routerconfig.json"
 
-func proxyConn(conn net.Conn) {
+	moduleName  = "wan-connect"
+	dialTimeout = 10 * time.Second
+)
 
+// dialController connects to the best controller of the pool, the
+// configuration is read again every time so it can change underneath.
+func dialController(configPath string, pool *tunnel.Pool) (net.Conn, error) {
 	var routerConfig config.Config
-	err := routerConfig.Load(ConfigPath)
-	if err != nil {
-		log.WithFields(log.Fields{"module": "wan-connect", "error": err.Error()}).Fatalln("Error reading config")
+	if err := routerConfig.Load(configPath); err != nil {
+		return nil, fmt.Errorf("reading config: %v", err)
 	}
-	remoteAddr := routerConfig.GetController()
-
-	rAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	pool.Set(routerConfig.Controllers, routerConfig.ControllerOrder)
+	tlsConfig, err := routerConfig.Encryption.ClientTLSConfig()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	tlsConfig.NextProtos = []string{tunnel.Protocol}
+	return pool.Dial(func(remoteAddr string) (net.Conn, error) {
+		remote, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}, "tcp", remoteAddr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", remoteAddr, err)
+		}
+		if protocol := remote.ConnectionState().NegotiatedProtocol; protocol != tunnel.Protocol {
+			remote.Close()
+			return nil, fmt.Errorf("%s does not support sessions", remoteAddr)
+		}
+		return remote, nil
+	})
+}
 
-	remote, err := net.DialTCP("tcp", nil, rAddr)
-	if err != nil {
-		panic(err)
+// reloadOnHangup makes the session dial again, with the configuration as
+// it is then, on SIGHUP. wan-agent sends it when the router certificate
+// changes.
+func reloadOnHangup(session *tunnel.Client) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		log.WithFields(log.Fields{"module": moduleName}).Infoln("Reloading, connecting again")
+		session.Reconnect()
 	}
-	defer remote.Close()
+}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	go copy(remote, conn, wg)
-	go copy(conn, remote, wg)
-	wg.Wait()
+// serveStatus reports the session and which controller it is on.
+func serveStatus(addr string, session *tunnel.Client, pool *tunnel.Pool) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Session     tunnel.Status             `json:"session"`
+			Controllers []tunnel.ControllerStatus `json:"controllers"`
+		}{session.Status(), pool.Status()})
+	})
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Serving status at %s", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error serving status")
+	}
 }
 
-func copy(from, to net.Conn, wg *sync.WaitGroup) {
-	defer wg.Done()
-	_, err := io.Copy(to, from)
+func proxyConn(conn net.Conn, session *tunnel.Client) {
+	defer conn.Close()
+	remote, err := session.Open(tunnel.ServiceAPI)
 	if err != nil {
-		log.WithFields(log.Fields{"module": "wan-connect", "error": err.Error()}).Errorln("Error from copy")
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error opening a stream to the controller")
 		return
 	}
+	defer remote.Close()
+	tunnel.Pipe(conn, remote)
 }
 
 func main() {
 
-	if err := os.RemoveAll(SocketAddr); err != nil {
-		log.WithFields(log.Fields{"module": "wan-connect", "error": err.Error()}).Errorln("Error removing old socket")
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: false,
+		FullTimestamp: true,
+	})
+
+	SocketPath := flag.String("socket", SocketAddr, "Local Socket")
+	ConfigFile := flag.String("config", ConfigPath, "Configuration Path")
+	PidPath := flag.String("pid", "/etc/wan-data/wan-connect.pid", "PID File")
+	AgentAddr := flag.String("agent", "127.0.0.1:9620", "wan-agent API Addr")
+	MetricsAddr := flag.String("metrics", "127.0.0.1:9600", "wan-metrics API Addr")
+	DHCPAddr := flag.String("dhcp", "127.0.0.1:9610", "wan-dhcp API Addr")
+	StatusAddr := flag.String("status", "127.0.0.1:9640", "Status Addr")
+	IPFIXAddr := flag.String("ipfix", "auto", "Addr the flows are relayed from, auto for the collector of the configuration, empty to disable it")
+	ProbeInterval := flag.Duration("probe", time.Minute, "Controller Probe Interval")
+	flag.Parse()
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-connect")
+
+	err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writting PID file")
+	}
+
+	if err := os.RemoveAll(*SocketPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error removing old socket")
 	}
 
-	listener, err := net.Listen("unix", SocketAddr)
+	listener, err := net.Listen("unix", *SocketPath)
 	if err != nil {
-		log.WithFields(log.Fields{"module": "wan-connect", "error": err.Error()}).Fatalln("Error connecting to UNIX Socket")
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error connecting to UNIX Socket")
 	}
 	defer listener.Close()
 
+	pool := tunnel.NewPool()
+	var routerConfig config.Config
+	if err := routerConfig.Load(*ConfigFile); err == nil {
+		pool.Set(routerConfig.Controllers, routerConfig.ControllerOrder)
+	}
+
+	session := tunnel.NewClient(func() (net.Conn, error) {
+		return dialController(*ConfigFile, pool)
+	})
+	pool.FailBack = session.Reconnect
+	go pool.Probe(*ProbeInterval, dialTimeout, nil)
+	session.Mux.Handle(tunnel.ServiceAgent, tunnel.Forward(*AgentAddr))
+	session.Mux.Handle(tunnel.ServiceMetrics, tunnel.Forward(*MetricsAddr))
+	session.Mux.Handle(tunnel.ServiceDHCP, tunnel.Forward(*DHCPAddr))
+	go session.Run(nil)
+	go reloadOnHangup(session)
+	go serveStatus(*StatusAddr, session, pool)
+	if *IPFIXAddr != "" {
+		go relayFlows(*IPFIXAddr, *ConfigFile, session)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.WithFields(log.Fields{"module": "wan-connect", "error": err.Error()}).Fatalln("Error accepting incoming conn")
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error accepting incoming conn")
 		}
-		go proxyConn(conn)
+		go proxyConn(conn, session)
 	}
 
 }
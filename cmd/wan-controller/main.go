@@ -1,14 +1,102 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/controller"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	"github.com/maesoser/wan-controller/pkg/ztp"
 	log "github.com/sirupsen/logrus"
+)
 
-	"github.com/maesoser/wan-agent/pkg/metrics"
+const (
+	moduleName = "wan-controller"
 )
 
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 
-	log.WithFields(log.Fields{"module": "wan-agent"}).Info("Starting wan-controller")
+	ListenAddr := flag.String("listen", "0.0.0.0:6633", "Server Addr")
+	Flows := flag.Bool("flows", true, "Collect the flows relayed by the routers")
+	CertPath := flag.String("tls-cert", "", "TLS Certificate, empty to serve plaintext")
+	KeyPath := flag.String("tls-key", "", "TLS Key")
+	ClientCAPath := flag.String("client-ca", "", "CA of the router certificates")
+	OperatorsPath := flag.String("operators", "", "Operators allowed to reach the routers, one \"name token\" per line")
+	AuditPath := flag.String("audit", "", "Audit log of the requests to the routers, empty to only log them")
+	CACertPath := flag.String("ca-cert", "", "CA the router certificates are issued by, empty to disable enrollment")
+	CAKeyPath := flag.String("ca-key", "", "CA Key")
+	ServerCAPath := flag.String("server-ca", "", "CA of the controller certificates given to the routers, the -ca-cert one if empty")
+	EnrollmentsPath := flag.String("enrollments", "/var/lib/wan-controller/enrollments.json", "Enrollment tokens and revocations, shared by the controllers that use the same file")
+	CertValidity := flag.Duration("cert-validity", 90*24*time.Hour, "Validity of the router certificates")
+	ConfigKeyPath := flag.String("config-key", "", "Ed25519 key the router configurations are signed with, empty to push them unsigned")
+	flag.Parse()
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-controller")
 
+	ctrl := controller.NewController()
+	if *OperatorsPath != "" {
+		operators, err := controller.LoadOperators(*OperatorsPath)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading operators")
+		}
+		ctrl.Operators = operators
+	}
+	if len(ctrl.Operators) == 0 {
+		log.WithFields(log.Fields{"module": moduleName}).Warnln("No operators, the routers can not be reached through the controller")
+	}
+	if *AuditPath != "" {
+		audit, err := controller.OpenAuditLog(*AuditPath)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error opening audit log")
+		}
+		ctrl.Audit = audit
+	}
+	if *CACertPath != "" || *ConfigKeyPath != "" {
+		// Revisions of the signed configurations are kept with the tokens.
+		enrollments, err := controller.LoadEnrollments(*EnrollmentsPath)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading enrollment tokens")
+		}
+		ctrl.Enrollments = enrollments
+	}
+	if *CACertPath != "" {
+		ca, err := controller.LoadCA(*CACertPath, *CAKeyPath, *ServerCAPath)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading CA")
+		}
+		ca.Validity = *CertValidity
+		ctrl.CA = ca
+	}
+	if *ConfigKeyPath != "" {
+		key, err := ztp.LoadPrivateKey(*ConfigKeyPath)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error reading configuration key")
+		}
+		ctrl.ConfigKey = key
+	}
+	if *Flows {
+		ctrl.EnableFlows()
+	}
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Listening at %s", *ListenAddr)
+	if *CertPath == "" {
+		log.WithFields(log.Fields{"module": moduleName}).Warnln("Serving plaintext, routers will not be able to connect")
+		log.Panic(http.ListenAndServe(*ListenAddr, ctrl))
+	}
+	tlsConfig, err := controller.ServerTLSConfig(*CertPath, *KeyPath, *ClientCAPath)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Invalid TLS configuration")
+	}
+	tlsConfig.VerifyConnection = ctrl.VerifyConnection
+	server := &http.Server{
+		Addr:      *ListenAddr,
+		Handler:   ctrl,
+		TLSConfig: tlsConfig,
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
+			tunnel.Protocol: ctrl.ServeTunnel,
+		},
+	}
+	log.Panic(server.ListenAndServeTLS("", ""))
 }
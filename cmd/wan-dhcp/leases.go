@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+/*
+runCommand talks to the API of a running wan-dhcp:
+
+	wan-dhcp import <iface> <format> <file>
+	wan-dhcp export <iface> <format> [file]
+*/
+func runCommand(apiAddr string, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: wan-dhcp import|export <iface> <format> [file]")
+	}
+	url := fmt.Sprintf("http://%s/scopes/%s/%s?format=%s", apiAddr, args[1], args[0], args[2])
+	switch args[0] {
+	case "import":
+		if len(args) != 4 {
+			return fmt.Errorf("usage: wan-dhcp import <iface> <format> <file>")
+		}
+		f, err := os.Open(args[3])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		resp, err := http.Post(url, "text/plain", f)
+		if err != nil {
+			return err
+		}
+		return printResponse(resp, os.Stdout)
+	case "export":
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		if len(args) == 4 {
+			f, err := os.OpenFile(args[3], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return printResponse(resp, out)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func printResponse(resp *http.Response, out io.Writer) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	_, err := io.Copy(out, resp.Body)
+	return err
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	dhcp "github.com/krolaw/dhcp4"
+	"github.com/maesoser/wan-controller/pkg/config"
 	dhcpeng "github.com/maesoser/wan-controller/pkg/dhcpengine"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 )
@@ -15,6 +16,39 @@ const (
 	moduleName = "wan-dhcp"
 )
 
+// scopeFromConfig builds the scope of the LAN network, served through the
+// lstack TAP whose address follows the gateway one.
+func scopeFromConfig(c config.Config, iface string) (*dhcpeng.Scope, error) {
+	gateway := net.ParseIP(c.Network.Gateway).To4()
+	mask := net.ParseIP(c.Network.Mask).To4()
+	if gateway == nil || mask == nil {
+		return nil, fmt.Errorf("invalid network %s/%s", c.Network.Gateway, c.Network.Mask)
+	}
+	serverIP := make(net.IP, len(gateway))
+	copy(serverIP, gateway)
+	serverIP[3]++
+	dns := serverIP
+	if c.ResolverMode() == config.ResolverVPP {
+		// VPP answers the queries on its own address.
+		dns = gateway
+	}
+	scope := dhcpeng.NewScope(iface, serverIP, mask, gateway, dns, "")
+	if relay := c.Network.DHCPRelay; relay != nil {
+		scope.Config.Relay = &dhcpeng.RelayConfig{
+			Servers:   relay.Servers,
+			CircuitID: relay.CircuitID,
+			RemoteID:  relay.RemoteID,
+		}
+		if scope.Config.Relay.RemoteID == "" {
+			scope.Config.Relay.RemoteID = c.UUID
+		}
+		if err := scope.Config.Relay.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return scope, nil
+}
+
 func main() {
 
 	log.SetFormatter(&log.TextFormatter{
@@ -24,8 +58,18 @@ func main() {
 
 	PidPath := flag.String("pid", "/etc/wan-data/wan-dhcp.pid", "PID File")
 	ListenAddr := flag.String("listen", "127.0.0.1:9610", "Server Addr")
+	DHCPAddr := flag.String("dhcp", "0.0.0.0:67", "DHCP Listening Addr")
+	ConfigPath := flag.String("config", "/etc/wan-data/routerconfig.json", "Configuration Path")
+	LANIface := flag.String("iface", "lstack", "LAN Interface")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(*ListenAddr, flag.Args()); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Command failed")
+		}
+		return
+	}
+
 	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-dhcp")
 
 	err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
@@ -33,13 +77,21 @@ func main() {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writting PID file")
 	}
 
-	engine := dhcpeng.Server{}
+	engine := dhcpeng.NewServer()
+	var routerConfig config.Config
+	if err := routerConfig.Load(*ConfigPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to load config, waiting for scopes through the API")
+	} else if scope, err := scopeFromConfig(routerConfig, *LANIface); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Unable to build LAN scope from config")
+	} else {
+		engine.AddScope(scope)
+	}
 	go func() {
-		log.WithFields(log.Fields{"module": moduleName}).Infof("DHCP Listening at 0.0.0.0:67")
-		err := dhcp.ListenAndServe(&engine)
+		log.WithFields(log.Fields{"module": moduleName}).Infof("DHCP Listening at %s", *DHCPAddr)
+		err := engine.ListenAndServe(*DHCPAddr)
 		log.Panic(err)
 	}()
 	log.WithFields(log.Fields{"module": moduleName}).Infof("API Listening at %s", *ListenAddr)
-	err = http.ListenAndServe(*ListenAddr, &engine)
+	err = http.ListenAndServe(*ListenAddr, engine)
 	log.Panic(err)
 }
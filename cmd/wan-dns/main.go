@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/resolver"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "wan-dns"
+)
+
+func main() {
+
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: false,
+		FullTimestamp: true,
+	})
+
+	PidPath := flag.String("pid", "/etc/wan-data/wan-dns.pid", "PID File")
+	ListenAddr := flag.String("listen", "127.0.0.1:9630", "Stats Server Addr")
+	ConfigPath := flag.String("config", "/etc/wan-data/routerconfig.json", "Configuration Path")
+	flag.Parse()
+
+	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-dns")
+
+	var routerConfig config.Config
+	if err := routerConfig.Load(*ConfigPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Unable to load config")
+	}
+	if mode := routerConfig.ResolverMode(); mode != config.ResolverForwarder {
+		log.WithFields(log.Fields{"module": moduleName, "mode": mode}).Infoln("Resolver is not in forwarder mode, nothing to do")
+		return
+	}
+
+	err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writting PID file")
+	}
+
+	settings := routerConfig.Resolver
+	dns, err := resolver.New(routerConfig.ResolverUpstreams(), settings.CacheSize)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Invalid resolver config")
+	}
+	for _, record := range settings.Records {
+		if err := dns.AddRecord(record.Name, record.Type, record.Value, record.TTL); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "record": record.Name, "error": err.Error()}).Errorln("Invalid record, skipping it")
+		}
+	}
+
+	go func() {
+		log.WithFields(log.Fields{"module": moduleName}).Infof("Listening at %s", *ListenAddr)
+		log.Panic(http.ListenAndServe(*ListenAddr, dns))
+	}()
+	// The LAN reaches the resolver on the lstack TAP address.
+	listen := settings.Listen
+	if listen == "" {
+		listen = ":53"
+	}
+	log.Panic(dns.ListenAndServe(listen))
+}
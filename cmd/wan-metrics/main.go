@@ -1,17 +1,25 @@
 package main
 
-import (	
+import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/maesoser/wan-controller/pkg/config"
 	"github.com/maesoser/wan-controller/pkg/metrics"
+	"github.com/maesoser/wan-controller/pkg/pihole"
+	"github.com/maesoser/wan-controller/pkg/ping"
+	"github.com/maesoser/wan-controller/pkg/resolver"
+	"github.com/maesoser/wan-controller/pkg/speedtest"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"time"
 )
 
 const (
-	moduleName = "wan-dhcp"
+	moduleName = "wan-metrics"
 )
 
 func main() {
@@ -25,18 +33,99 @@ func main() {
 
 	ListenAddr := flag.String("listen", "127.0.0.1:9600", "Server Addr")
 	PidPath := flag.String("pid", "/etc/wan-data/wan-metrics.pid", "PID File")
+	Interval := flag.Duration("interval", 10*time.Second, "Collection Interval")
+	HistoryDir := flag.String("history", "/etc/wan-data/history", "History Directory, empty to disable it")
+	HistoryStep := flag.Duration("history-step", time.Minute, "History Resolution")
+	HistoryRetention := flag.Duration("history-retention", 7*24*time.Hour, "History Retention")
+	ConfigPath := flag.String("config", "/etc/wan-data/routerconfig.json", "Configuration Path")
+	Push := flag.Bool("push", true, "Push metrics to the controller")
+	PushInterval := flag.Duration("push-interval", time.Minute, "Push Interval")
+	ConnectorPath := flag.String("connector", "/etc/wan-data/wan-connector.sock", "wan-connect Socket")
+	SpoolPath := flag.String("spool", "/etc/wan-data/metrics-spool.jsonl", "Pending Metrics Spool")
+	Probe := flag.Bool("probe", true, "Probe the uplink quality")
+	SpeedTestServer := flag.String("speedtest-server", "", "Speed Test Server URL, a controller by default")
 	flag.Parse()
 
 	log.WithFields(log.Fields{"module": moduleName}).Info("Starting wan-metrics")
-	
-        err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
+
+	err := ioutil.WriteFile(*PidPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0664)
 	if err != nil {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Fatalln("Error writting PID file")
 	}
 
+	var routerConfig config.Config
+	if err := routerConfig.Load(*ConfigPath); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Unable to load config, metrics will not carry the router uuid")
+	}
+	monitor.UUID = routerConfig.UUID
+
 	monitor.Init()
+	if routerConfig.DNSFilter != nil {
+		monitor.PiHole = pihole.NewClient(routerConfig.DNSFilter.Address, routerConfig.DNSFilter.Token)
+	} else {
+		monitor.PiHole = pihole.NewClient(pihole.DefaultAddr, "")
+	}
+	if routerConfig.ResolverMode() == config.ResolverForwarder {
+		monitor.ResolverAddr = resolver.DefaultStatsAddr
+	}
+	if *Probe {
+		monitor.Prober = ping.NewEngine()
+		if err := monitor.Prober.AddUplink(routerConfig.Network.Uplink); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Invalid uplink probes, using the default ones")
+			uplink := routerConfig.Network.Uplink
+			uplink.Probes = nil
+			monitor.Prober.AddUplink(uplink)
+		}
+		go monitor.Prober.Run(nil)
+	}
+	if *Push {
+		monitor.Pusher = metrics.NewPusher(*ConnectorPath, *SpoolPath)
+		go monitor.Pusher.Run(*PushInterval, nil)
+	}
+	if *HistoryDir != "" {
+		monitor.History, err = metrics.NewHistory(*HistoryDir, *HistoryStep, *HistoryRetention)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error opening history, it will not be kept")
+		}
+	}
+	monitor.SpeedTester = newSpeedTester(routerConfig, *SpeedTestServer, *ConnectorPath)
+	if monitor.SpeedTester != nil {
+		monitor.SpeedTester.OnResult = monitor.RecordSpeedTest
+		go monitor.SpeedTester.Run(nil)
+	}
+	go monitor.Run(*Interval, nil)
 	log.WithFields(log.Fields{"module": moduleName}).Infof("Listening at %s", *ListenAddr)
 	err = http.ListenAndServe(*ListenAddr, &monitor)
 	log.Panic(err)
 
 }
+
+// newSpeedTester returns the speed test runner described in the config.
+// Without a schedule tests can still be run on demand. Tests against the
+// controller go through wan-connect, which only speaks TLS to it.
+func newSpeedTester(routerConfig config.Config, server, connector string) *speedtest.Runner {
+	settings := config.SpeedTest{}
+	if routerConfig.SpeedTest != nil {
+		settings = *routerConfig.SpeedTest
+	}
+	if server == "" {
+		server = settings.Server
+	}
+	viaConnector := false
+	if server == "" {
+		if len(routerConfig.Controllers) == 0 {
+			log.WithFields(log.Fields{"module": moduleName}).Warnln("No controller to run speed tests against")
+			return nil
+		}
+		server = "http://controller"
+		viaConnector = true
+	}
+	client := speedtest.NewClient(server, settings.Streams, time.Duration(settings.Duration)*time.Second)
+	if viaConnector {
+		client.Dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", connector)
+		}
+	}
+	return speedtest.NewRunner(client, time.Duration(settings.Interval)*time.Second)
+}
@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"time"
 
@@ -15,34 +17,196 @@ import (
 )
 
 type Config struct {
-	Name        string        `json:"name"`
-	Description string        `json:"description"`
-	UUID        string        `json:"uuid"`
-	DNSs        []string      `json:"dns"`
-	Network     Network       `json:"network"`
-	Encryption  EncryptConfig `json:"encryption"`
-	Controllers []string      `json:"controllers"`
+	Name            string        `json:"name"`
+	Description     string        `json:"description"`
+	UUID            string        `json:"uuid"`
+	DNSs            []string      `json:"dns"`
+	Network         Network       `json:"network"`
+	Encryption      EncryptConfig `json:"encryption"`
+	Controllers     []string      `json:"controllers"`
+	ControllerOrder string        `json:"controller_order,omitempty"`
+	SpeedTest       *SpeedTest    `json:"speedtest,omitempty"`
+	FlowExport      *FlowExport   `json:"flow_export,omitempty"`
+	DNSFilter       *DNSFilter    `json:"dns_filter,omitempty"`
+	Resolver        *Resolver     `json:"resolver,omitempty"`
+	// Revision grows with every configuration a controller signs, routers
+	// do not go back to an older one.
+	Revision uint64  `json:"revision,omitempty"`
+	Signed   *Signed `json:"signed,omitempty"`
+}
+
+// Controller orders. By priority the controllers are tried in the order
+// they are listed, by latency the fastest to answer is tried first.
+const (
+	ControllerByPriority = "priority"
+	ControllerByLatency  = "latency"
+)
+
+// Resolver modes. In system mode the DNSs are only written to resolv.conf,
+// pihole leaves resolution to the Pi-hole, vpp enables the VPP dns plugin
+// and forwarder runs wan-dns.
+const (
+	ResolverSystem    = "system"
+	ResolverPiHole    = "pihole"
+	ResolverVPP       = "vpp"
+	ResolverForwarder = "forwarder"
+)
+
+// Resolver is the local DNS resolver offered to the LAN. Upstreams are the
+// DNSs by default, DNS over TLS ones are written as tls://host[:port][#name].
+// Records and DNS over TLS need the forwarder mode.
+type Resolver struct {
+	Mode      string      `json:"mode"`
+	Listen    string      `json:"listen,omitempty"`
+	Upstreams []string    `json:"upstreams,omitempty"`
+	CacheSize int         `json:"cache_size,omitempty"`
+	Records   []DNSRecord `json:"records,omitempty"`
+}
+
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl,omitempty"` // seconds
+}
+
+// ResolverMode returns the resolver mode, system when there is none.
+func (c *Config) ResolverMode() string {
+	if c.Resolver == nil || c.Resolver.Mode == "" {
+		return ResolverSystem
+	}
+	return c.Resolver.Mode
+}
+
+// ResolverUpstreams returns the servers the local resolver forwards to.
+func (c *Config) ResolverUpstreams() []string {
+	if c.Resolver != nil && len(c.Resolver.Upstreams) > 0 {
+		return c.Resolver.Upstreams
+	}
+	return c.DNSs
+}
+
+// DNSFilter is the configuration of the Pi-hole at Address, reached with
+// the API Token. Blocking is on unless set to false, DisableFor then turns
+// it back on after that many seconds. The lists that are set replace what
+// the Pi-hole had, the missing ones are left alone.
+type DNSFilter struct {
+	Address    string   `json:"address,omitempty"`
+	Token      string   `json:"token"`
+	Blocking   *bool    `json:"blocking,omitempty"`
+	DisableFor int      `json:"disable_for,omitempty"` // seconds
+	Allow      []string `json:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+	RegexAllow []string `json:"regex_allow,omitempty"`
+	RegexDeny  []string `json:"regex_deny,omitempty"`
+	Adlists    []string `json:"adlists,omitempty"`
+}
+
+// FlowExport makes VPP export the flows of Interfaces over IPFIX, the LAN
+// by default, so that the records carry the addresses of the hosts and not
+// the NATed ones. Direction is rx, tx or both, rx by default. Collector is
+// wan-connect on the host, which relays the records to the controller over
+// the router session, and Source, the address the records come from, the
+// gateway. Template is ip4, ip6 or l2 and Record the fields of the records,
+// any of l2, l3 and l4.
+type FlowExport struct {
+	Collector        string   `json:"collector,omitempty"`
+	Source           string   `json:"source,omitempty"`
+	Interfaces       []string `json:"interfaces,omitempty"`
+	Direction        string   `json:"direction,omitempty"`
+	Template         string   `json:"template,omitempty"`
+	Record           []string `json:"record,omitempty"`
+	ActiveTimeout    int      `json:"active_timeout,omitempty"`    // seconds
+	InactiveTimeout  int      `json:"inactive_timeout,omitempty"`  // seconds
+	TemplateInterval int      `json:"template_interval,omitempty"` // seconds
+}
+
+// IPFIXPort is where wan-connect receives the flows by default.
+const IPFIXPort = "4739"
+
+// FlowCollector returns where the flows are exported to, by default
+// wan-connect on the host end of the TAP, the address after the gateway.
+func (c *Config) FlowCollector() (string, error) {
+	if c.FlowExport != nil && c.FlowExport.Collector != "" {
+		return c.FlowExport.Collector, nil
+	}
+	gateway := net.ParseIP(c.Network.Gateway).To4()
+	if gateway == nil {
+		return "", errors.New("no collector and no gateway to reach wan-connect through")
+	}
+	host := make(net.IP, len(gateway))
+	copy(host, gateway)
+	host[3]++
+	return net.JoinHostPort(host.String(), IPFIXPort), nil
+}
+
+// FlowSource returns the address the flows are exported from, the gateway
+// by default.
+func (c *Config) FlowSource() (net.IP, error) {
+	source := c.Network.Gateway
+	if c.FlowExport != nil && c.FlowExport.Source != "" {
+		source = c.FlowExport.Source
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid flow export source %q", source)
+	}
+	return ip, nil
+}
+
+// SpeedTest schedules throughput tests against Server, a controller by
+// default.
+type SpeedTest struct {
+	Server   string `json:"server,omitempty"`
+	Interval int    `json:"interval"`           // seconds, 0 for on demand only
+	Streams  int    `json:"streams,omitempty"`  // per direction
+	Duration int    `json:"duration,omitempty"` // seconds, per direction
 }
 
 type Network struct {
-	Name        string   `json:"name"`
-	Description string   `json:"descr"`
-	UUID        string   `json:"uuid"`
-	Address     string   `json:"addr"`
-	Mask        string   `json:"mask"`
-	Gateway     string   `json:"gateway"`
-	Uplink      Uplink   `json:"uplink"`
-	Ports       []string `json:"ports"`
+	Name        string     `json:"name"`
+	Description string     `json:"descr"`
+	UUID        string     `json:"uuid"`
+	Address     string     `json:"addr"`
+	Mask        string     `json:"mask"`
+	Gateway     string     `json:"gateway"`
+	Uplink      Uplink     `json:"uplink"`
+	Ports       []string   `json:"ports"`
+	DHCPRelay   *DHCPRelay `json:"dhcp_relay,omitempty"`
+}
+
+// DHCPRelay makes wan-dhcp relay the requests of the network to the given
+// DHCP servers instead of serving them itself.
+type DHCPRelay struct {
+	Servers   []string `json:"servers"`
+	CircuitID string   `json:"circuit_id,omitempty"`
+	RemoteID  string   `json:"remote_id,omitempty"`
 }
 
 type Uplink struct {
-	Name    string `json:"name"`
-	Address string `json:"addr"`
-	DHCP    bool   `json:"dhcp_enabled"`
+	Name    string  `json:"name"`
+	Address string  `json:"addr"`
+	DHCP    bool    `json:"dhcp_enabled"`
+	Probes  []Probe `json:"probes,omitempty"`
+}
+
+// Probe checks the quality of an uplink. Type is icmp, tcp, http or dns.
+// Target is a host for icmp, a host:port for tcp, a URL for http and a
+// resolver address for dns, which resolves Query.
+type Probe struct {
+	Type     string  `json:"type"`
+	Target   string  `json:"target"`
+	Query    string  `json:"query,omitempty"`
+	Interval int     `json:"interval,omitempty"` // seconds
+	Timeout  int     `json:"timeout,omitempty"`  // milliseconds
+	MaxLoss  float64 `json:"max_loss,omitempty"` // percent
+	MaxRTT   int     `json:"max_rtt,omitempty"`  // milliseconds
 }
 
+// WriteDNS points resolv.conf to the DNSs, or to the local resolver when
+// it listens on the router itself.
 func (c *Config) WriteDNS() error {
-	f, err := os.OpenFile("/etc/resolv.conf", os.O_WRONLY, 0644)
+	f, err := os.OpenFile("/etc/resolv.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -53,7 +217,12 @@ func (c *Config) WriteDNS() error {
 	if err != nil {
 		return err
 	}
-	for dns, _ := range c.DNSs {
+	servers := c.DNSs
+	switch c.ResolverMode() {
+	case ResolverPiHole, ResolverForwarder:
+		servers = []string{"127.0.0.1"}
+	}
+	for _, dns := range servers {
 		_, err := fmt.Fprintf(w, "nameserver %s\n", dns)
 		if err != nil {
 			return err
@@ -104,15 +273,8 @@ func (c *Config) Save(filepath string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		return 0, err
-	}
-	n, err := file.Write(buffer.Bytes())
-	if err != nil {
-		return 0, err
-	}
-	return n, nil
+	// It holds the router key.
+	return writePrivate(filepath, buffer.Bytes())
 }
 
 func (c *Config) Backup(filepath string) (int, error) {
@@ -136,6 +298,6 @@ func (c *Config) GetController() string {
 		return c.Controllers[0]
 	}
 	rand.Seed(time.Now().UnixNano())
-	num := rand.Intn(len(c.Controllers) - 1)
+	num := rand.Intn(len(c.Controllers))
 	return c.Controllers[num]
 }
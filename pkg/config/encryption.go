@@ -2,15 +2,30 @@ package config
 
 import (
 	"bytes"
-	"os"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 )
 
+// EncryptConfig holds, in PEM, the client certificate and key the router
+// presents to the controllers and the CA their certificates must chain to.
+// The controller name is only checked when ServerName is set, controllers
+// are usually reached by address and the CA is pinned anyway.
 type EncryptConfig struct {
 	Certificate string `json:"cert"`
 	Key         string `json:"key"`
+	CA          string `json:"ca"`
+	ServerName  string `json:"server_name,omitempty"`
+	// KeyStore, when set, is the secret the key is sealed with, see
+	// SealKey.
+	KeyStore string `json:"keystore,omitempty"`
 }
 
+// SaveToFile writes the encryption section, key included, readable only by
+// its owner.
 func (c *EncryptConfig) SaveToFile(filepath string) (int, error) {
 
 	buffer := new(bytes.Buffer)
@@ -21,13 +36,110 @@ func (c *EncryptConfig) SaveToFile(filepath string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0755)
+	return writePrivate(filepath, buffer.Bytes())
+}
+
+// writePrivate replaces the file at path with data, readable only by its
+// owner. The data is written to a temporary file first, so that the file
+// is never left half written.
+func writePrivate(path string, data []byte) (int, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return 0, err
 	}
-	n, err := file.Write([]byte(c.Certificate))
+	n, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// The mode of an existing file is not changed by OpenFile.
+		err = os.Chmod(tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return 0, err
 	}
 	return n, nil
 }
+
+// CertPool returns a pool holding only the pinned CA.
+func (c *EncryptConfig) CertPool() (*x509.CertPool, error) {
+	if c.CA == "" {
+		return nil, errors.New("no CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.CA)) {
+		return nil, errors.New("invalid CA certificate")
+	}
+	return pool, nil
+}
+
+// ClientTLSConfig returns the TLS 1.3 configuration used to reach the
+// controllers.
+func (c *EncryptConfig) ClientTLSConfig() (*tls.Config, error) {
+	key, err := c.PrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(c.Certificate), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %v", err)
+	}
+	pool, err := c.CertPool()
+	if err != nil {
+		return nil, err
+	}
+	config := PinnedTLSConfig(pool, c.ServerName)
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// PinnedTLSConfig returns a TLS 1.3 configuration that only trusts
+// certificates signed by pool. The name is only checked when serverName is
+// set.
+func PinnedTLSConfig(pool *x509.CertPool, serverName string) *tls.Config {
+	config := &tls.Config{
+		RootCAs:    pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS13,
+	}
+	if serverName == "" {
+		// The standard verification needs a name, verify the chain alone.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, pool)
+		}
+	}
+	return config
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
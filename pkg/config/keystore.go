@@ -0,0 +1,82 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// sealedKeyType is the PEM type of a key sealed with a keystore secret.
+const sealedKeyType = "WAN SEALED KEY"
+
+/*
+SealKey encrypts a PEM key with AES-256-GCM under the secret in the
+keystore file at path, which is created, with random bytes, if needed. It
+keeps the key out of configuration files, backups and the controller
+copies of them; without a TPM the secret still lives on the router, apart.
+*/
+func SealKey(keyPEM, path string) (string, error) {
+	aead, err := keystoreCipher(path, true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(keyPEM), []byte(sealedKeyType))
+	return string(pem.EncodeToMemory(&pem.Block{Type: sealedKeyType, Bytes: sealed})), nil
+}
+
+// PrivateKey returns the key in PEM, opening it with the keystore when it
+// is sealed.
+func (c *EncryptConfig) PrivateKey() (string, error) {
+	block, _ := pem.Decode([]byte(c.Key))
+	if block == nil || block.Type != sealedKeyType {
+		return c.Key, nil
+	}
+	if c.KeyStore == "" {
+		return "", errors.New("sealed key without keystore")
+	}
+	aead, err := keystoreCipher(c.KeyStore, false)
+	if err != nil {
+		return "", err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return "", errors.New("invalid sealed key")
+	}
+	nonce, sealed := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(sealedKeyType))
+	if err != nil {
+		return "", errors.New("unable to open sealed key")
+	}
+	return string(key), nil
+}
+
+func keystoreCipher(path string, create bool) (cipher.AEAD, error) {
+	secret, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+		_, err = writePrivate(path, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < 32 {
+		return nil, errors.New("keystore secret is too short")
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
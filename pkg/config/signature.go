@@ -0,0 +1,44 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Signed is a configuration as a controller signed it: its JSON, as it was
+// signed, and the signature. It never holds the encryption section, which
+// belongs to the router and changes on its own when the certificate is
+// renewed.
+type Signed struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign signs payload, the JSON of a configuration, with the key of a
+// controller.
+func Sign(payload []byte, key ed25519.PrivateKey) *Signed {
+	return &Signed{Payload: payload, Signature: ed25519.Sign(key, payload)}
+}
+
+// Open checks the signature and returns the configuration, if it is for the
+// router uuid and its revision is not below minimum.
+func (s *Signed) Open(key ed25519.PublicKey, uuid string, minimum uint64) (Config, error) {
+	var c Config
+	if !ed25519.Verify(key, s.Payload, s.Signature) {
+		return c, errors.New("invalid configuration signature")
+	}
+	if err := json.Unmarshal(s.Payload, &c); err != nil {
+		return c, err
+	}
+	if c.UUID != uuid {
+		return c, fmt.Errorf("configuration is for router %q", c.UUID)
+	}
+	if c.Revision < minimum {
+		return c, fmt.Errorf("revision %d is older than %d", c.Revision, minimum)
+	}
+	c.Encryption = EncryptConfig{}
+	c.Signed = s
+	return c, nil
+}
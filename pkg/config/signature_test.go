@@ -0,0 +1,111 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPayload = `{"uuid": "e0c5a9f2-0001", "name": "branch", "revision": 7, "future_field": {"enabled": true}}`
+
+func testKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestOpen(t *testing.T) {
+	public, private := testKey(t)
+	other, _ := testKey(t)
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		change  func(*Signed)
+		uuid    string
+		minimum uint64
+		valid   bool
+	}{
+		{"valid", public, func(s *Signed) {}, "e0c5a9f2-0001", 0, true},
+		{"same revision", public, func(s *Signed) {}, "e0c5a9f2-0001", 7, true},
+		{"older revision", public, func(s *Signed) {}, "e0c5a9f2-0001", 8, false},
+		{"other router", public, func(s *Signed) {}, "e0c5a9f2-0002", 0, false},
+		{"other key", other, func(s *Signed) {}, "e0c5a9f2-0001", 0, false},
+		{"no signature", public, func(s *Signed) { s.Signature = nil }, "e0c5a9f2-0001", 0, false},
+		{"payload changed", public, func(s *Signed) {
+			s.Payload = bytes.Replace(s.Payload, []byte(`"revision": 7`), []byte(`"revision": 9`), 1)
+		}, "e0c5a9f2-0001", 0, false},
+		// The signature covers the payload as it was sent, not its
+		// meaning.
+		{"payload reformatted", public, func(s *Signed) {
+			var compact bytes.Buffer
+			json.Compact(&compact, s.Payload)
+			s.Payload = compact.Bytes()
+		}, "e0c5a9f2-0001", 0, false},
+	}
+	for _, test := range tests {
+		signed := Sign([]byte(testPayload), private)
+		test.change(signed)
+		c, err := signed.Open(test.key, test.uuid, test.minimum)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+		if test.valid && (c.Name != "branch" || c.Revision != 7 || c.Signed != signed) {
+			t.Errorf("%s: got %+v", test.name, c)
+		}
+	}
+}
+
+func TestOpenDropsEncryption(t *testing.T) {
+	public, private := testKey(t)
+	payload := []byte(`{"uuid": "e0c5a9f2-0001", "encryption": {"key": "not the router key"}}`)
+	c, err := Sign(payload, private).Open(public, "e0c5a9f2-0001", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Encryption.Key != "" {
+		t.Errorf("encryption section of the controller kept: %+v", c.Encryption)
+	}
+}
+
+// The signed configuration is saved with the rest, and still verifies once
+// read again, fields unknown to this version included.
+func TestSignedSaved(t *testing.T) {
+	public, private := testKey(t)
+	c, err := Sign([]byte(testPayload), private).Open(public, "e0c5a9f2-0001", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Encryption = EncryptConfig{Certificate: "router certificate"}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routerconfig.json")
+	if _, err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	var loaded Config
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Signed == nil {
+		t.Fatal("signed configuration not saved")
+	}
+	if !bytes.Equal(loaded.Signed.Payload, []byte(testPayload)) {
+		t.Errorf("payload changed: %s", loaded.Signed.Payload)
+	}
+	if _, err := loaded.Signed.Open(public, "e0c5a9f2-0001", 7); err != nil {
+		t.Error(err)
+	}
+}
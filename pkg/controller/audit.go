@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxAuditEntries    = 1000
+	maxDiagnosticInput = 4096
+)
+
+// AuditEntry records a request made to a router through the controller,
+// a diagnostic run or any other.
+type AuditEntry struct {
+	Time       time.Time       `json:"time"`
+	Operator   string          `json:"operator"`
+	Remote     string          `json:"remote"`
+	Router     string          `json:"router"`
+	Method     string          `json:"method"`
+	Service    string          `json:"service"`
+	Path       string          `json:"path"`
+	Diagnostic string          `json:"diagnostic,omitempty"`
+	Request    json.RawMessage `json:"request,omitempty"`
+	Status     int             `json:"status"`
+	Bytes      int64           `json:"bytes"`
+	Duration   float64         `json:"duration"` // ms
+}
+
+// AuditLog keeps the last entries and appends every one, as a JSON line, to
+// Writer when it is set.
+type AuditLog struct {
+	Writer  io.Writer
+	mtx     sync.Mutex
+	entries []AuditEntry
+}
+
+func (a *AuditLog) Add(entry AuditEntry) {
+	log.WithFields(log.Fields{
+		"module":     moduleName,
+		"operator":   entry.Operator,
+		"router":     entry.Router,
+		"method":     entry.Method,
+		"service":    entry.Service,
+		"path":       entry.Path,
+		"diagnostic": entry.Diagnostic,
+		"request":    string(entry.Request),
+		"status":     entry.Status,
+	}).Infoln("Remote request")
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = a.entries[len(a.entries)-maxAuditEntries:]
+	}
+	if a.Writer != nil {
+		if err := json.NewEncoder(a.Writer).Encode(entry); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error writing audit log")
+		}
+	}
+}
+
+// Entries returns the entries of a router, the last first.
+func (a *AuditLog) Entries(router string) []AuditEntry {
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	entries := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		if a.entries[i].Router == router {
+			entries = append(entries, a.entries[i])
+		}
+	}
+	return entries
+}
+
+// OpenAuditLog appends the entries to the file at path.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{Writer: file}, nil
+}
+
+// LoadOperators reads the operators allowed to reach the routers, one
+// "name token" pair per line. Lines starting with # are comments.
+func LoadOperators(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	operators := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a token", path, n)
+		}
+		operators[fields[0]] = fields[1]
+	}
+	return operators, scanner.Err()
+}
+
+// operator returns the name of the operator whose bearer token the request
+// carries.
+func (c *Controller) operator(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return "", false
+	}
+	for name, t := range c.Operators {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// authorize checks that a request to a router comes from an operator.
+// Without operators configured nobody can reach the routers.
+func (c *Controller) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if len(c.Operators) == 0 {
+		http.Error(w, "reaching the routers needs operators", http.StatusForbidden)
+		return "", false
+	}
+	name, ok := c.operator(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+	return name, ok
+}
+
+// authorizeRead checks that a request for the data of the router uuid comes
+// from an operator or from that router itself.
+func (c *Controller) authorizeRead(w http.ResponseWriter, r *http.Request, uuid string) bool {
+	if identity, err := routerIdentity(r); err == nil {
+		if identity != uuid {
+			http.Error(w, "routers can only read their own data", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	_, ok := c.authorize(w, r)
+	return ok
+}
+
+// newAuditEntry starts the entry of a request to a service of a router.
+func newAuditEntry(r *http.Request, uuid, service, path string) AuditEntry {
+	return AuditEntry{
+		Time:    time.Now(),
+		Remote:  r.RemoteAddr,
+		Router:  uuid,
+		Method:  r.Method,
+		Service: service,
+		Path:    "/" + strings.TrimPrefix(path, "/"),
+	}
+}
+
+// audit completes entry with the response and adds it to the audit log.
+func (c *Controller) audit(entry AuditEntry, recorder *responseRecorder) {
+	entry.Status = recorder.status
+	entry.Bytes = recorder.bytes
+	entry.Duration = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+	c.Audit.Add(entry)
+}
+
+// handleDiagnostic runs a diagnostic on the router and streams its output
+// back. It needs an operator, and is audited.
+func (c *Controller) handleDiagnostic(w http.ResponseWriter, r *http.Request, uuid, diagnostic string) {
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	entry := newAuditEntry(r, uuid, tunnel.ServiceAgent, "diagnostics/"+diagnostic)
+	entry.Diagnostic = diagnostic
+	// Rejected attempts are audited too.
+	defer func() { c.audit(entry, recorder) }()
+	if r.Method != "POST" {
+		http.Error(recorder, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fromRouter(r) {
+		http.Error(recorder, "routers can not reach other routers", http.StatusForbidden)
+		return
+	}
+	operator, ok := c.authorize(recorder, r)
+	if !ok {
+		return
+	}
+	entry.Operator = operator
+	input, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDiagnosticInput+1))
+	if err != nil || len(input) > maxDiagnosticInput || (len(bytes.TrimSpace(input)) > 0 && !json.Valid(input)) {
+		http.Error(recorder, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(input)) > 0 {
+		entry.Request = json.RawMessage(input)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(input))
+	r.ContentLength = int64(len(input))
+	c.proxy(recorder, r, uuid, tunnel.ServiceAgent, "diagnostics/"+diagnostic)
+}
+
+// responseRecorder keeps the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
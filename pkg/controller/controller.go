@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/maesoser/wan-controller/pkg/enroll"
+	"github.com/maesoser/wan-controller/pkg/ipfix"
+	"github.com/maesoser/wan-controller/pkg/metrics"
+	"github.com/maesoser/wan-controller/pkg/speedtest"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "wan-controller"
+)
+
+const maxSpeedTests = 500
+
+type Router struct {
+	UUID       string             `json:"uuid"`
+	Address    string             `json:"address,omitempty"`
+	Connected  bool               `json:"connected"`
+	LastSeen   time.Time          `json:"last_seen"`
+	Metric     *metrics.Metric    `json:"metrics,omitempty"`
+	SpeedTests []speedtest.Result `json:"-"`
+}
+
+// Controller keeps the state reported by the routers and serves the API.
+type Controller struct {
+	// StaleAfter is how long a router is still exported to Prometheus
+	// after its last snapshot.
+	StaleAfter time.Duration
+	// Flows, when set, collects the flows exported by the routers.
+	Flows *ipfix.Collector
+	// Operators are the names and tokens of the operators allowed to reach
+	// the routers. Without operators anyone can, but diagnostics are off.
+	Operators map[string]string
+	// Audit records the requests made to the routers.
+	Audit *AuditLog
+	// CA, when set, issues the certificates of the routers that enroll
+	// with one of the Enrollments tokens.
+	CA          *CA
+	Enrollments *Enrollments
+	// ConfigKey, when set, signs the configurations pushed to the routers.
+	ConfigKey ed25519.PrivateKey
+	mtx       sync.Mutex
+	routers   map[string]*Router
+	sessions  map[string]*yamux.Session
+	mux       *http.ServeMux
+}
+
+func NewController() *Controller {
+	c := &Controller{
+		StaleAfter:  15 * time.Minute,
+		routers:     make(map[string]*Router),
+		sessions:    make(map[string]*yamux.Session),
+		Audit:       &AuditLog{},
+		Enrollments: &Enrollments{byUUID: make(map[string]*Enrollment)},
+		mux:         http.NewServeMux(),
+	}
+	c.mux.HandleFunc(metrics.PushPath, c.handlePush)
+	c.mux.HandleFunc(enroll.Path, c.handleEnroll)
+	c.mux.HandleFunc(enroll.RenewPath, c.handleRenew)
+	c.mux.HandleFunc("/api/v1/enrollments", c.handleEnrollments)
+	c.mux.HandleFunc("/api/v1/routers", c.handleRouters)
+	c.mux.HandleFunc("/api/v1/routers/", c.handleRouter)
+	c.mux.HandleFunc("/metrics", c.handlePrometheus)
+	c.mux.Handle("/speedtest/", &speedtest.Handler{Authorize: c.speedTester})
+	return c
+}
+
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+// router returns the state of a router, creating it if needed. Must be
+// called with the lock held.
+func (c *Controller) router(uuid string) *Router {
+	router, ok := c.routers[uuid]
+	if !ok {
+		router = &Router{UUID: uuid}
+		c.routers[uuid] = router
+	}
+	return router
+}
+
+func (c *Controller) handleRouters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fromRouter(r) {
+		http.Error(w, "routers can not list the routers", http.StatusForbidden)
+		return
+	}
+	if _, ok := c.authorize(w, r); !ok {
+		return
+	}
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	var routers []*Router
+	for _, router := range c.routers {
+		routers = append(routers, &Router{UUID: router.UUID, LastSeen: router.LastSeen, Connected: router.Connected})
+	}
+	sort.Slice(routers, func(i, j int) bool { return routers[i].UUID < routers[j].UUID })
+	writeJSON(w, routers)
+}
+
+/*
+handleRouter serves the resources of a single router:
+
+	GET /api/v1/routers/{uuid}
+	GET /api/v1/routers/{uuid}/metrics
+	GET /api/v1/routers/{uuid}/speedtest
+	GET /api/v1/routers/{uuid}/dns
+	GET /api/v1/routers/{uuid}/flows?window=15m&top=10
+
+and, over the session of the router, its live state and local services:
+
+	GET /api/v1/routers/{uuid}/metrics?live=true
+	GET/PUT /api/v1/routers/{uuid}/config
+	POST /api/v1/routers/{uuid}/commands/{command}
+	POST /api/v1/routers/{uuid}/diagnostics/{diagnostic}
+	GET /api/v1/routers/{uuid}/audit
+	POST /api/v1/routers/{uuid}/revoke
+	* /api/v1/routers/{uuid}/proxy/{agent|metrics|dhcp}/{path}
+*/
+func (c *Controller) handleRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/routers/"), "/"), "/")
+	c.mtx.Lock()
+	router, ok := c.routers[path[0]]
+	c.mtx.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	resource := ""
+	if len(path) > 1 {
+		resource = path[1]
+	}
+	switch {
+	case resource == "diagnostics" && len(path) == 3:
+		c.handleDiagnostic(w, r, router.UUID, path[2])
+	case resource == "proxy" && len(path) > 3 && path[2] == tunnel.ServiceAgent && path[3] == "diagnostics":
+		// Diagnostics are audited, they can not go around it.
+		http.Error(w, "use /diagnostics", http.StatusForbidden)
+	case r.Method == "POST" && resource == "revoke":
+		c.handleRevoke(w, r, router.UUID)
+	case r.Method == "GET" && resource == "audit":
+		if _, ok := c.authorize(w, r); ok {
+			writeJSON(w, c.Audit.Entries(router.UUID))
+		}
+	case resource == "proxy" && len(path) > 2:
+		c.handleRemote(w, r, router.UUID, path[2], strings.Join(path[3:], "/"))
+	case r.Method == "PUT" && resource == "config" && c.ConfigKey != nil:
+		c.handleConfig(w, r, router.UUID)
+	case (r.Method == "GET" || r.Method == "PUT") && resource == "config":
+		c.handleRemote(w, r, router.UUID, tunnel.ServiceAgent, "config")
+	case r.Method == "POST" && resource == "commands" && len(path) == 3:
+		c.handleRemote(w, r, router.UUID, tunnel.ServiceAgent, "commands/"+path[2])
+	case r.Method == "GET" && resource == "metrics" && r.URL.Query().Get("live") == "true":
+		c.handleRemote(w, r, router.UUID, tunnel.ServiceMetrics, "")
+	case r.Method == "GET" && resource == "":
+		if c.authorizeRead(w, r, router.UUID) {
+			c.mtx.Lock()
+			writeJSON(w, router)
+			c.mtx.Unlock()
+		}
+	case r.Method == "GET" && resource == "metrics":
+		if c.authorizeRead(w, r, router.UUID) {
+			c.mtx.Lock()
+			writeJSON(w, router.Metric)
+			c.mtx.Unlock()
+		}
+	case r.Method == "GET" && resource == "speedtest":
+		if c.authorizeRead(w, r, router.UUID) {
+			c.mtx.Lock()
+			writeJSON(w, router.SpeedTests)
+			c.mtx.Unlock()
+		}
+	case r.Method == "GET" && resource == "dns":
+		if !c.authorizeRead(w, r, router.UUID) {
+			return
+		}
+		c.mtx.Lock()
+		if router.Metric != nil {
+			writeJSON(w, router.Metric.DNS)
+		} else {
+			http.NotFound(w, r)
+		}
+		c.mtx.Unlock()
+	case r.Method == "GET" && resource == "flows":
+		c.handleFlows(w, r, router.UUID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error encoding response")
+	}
+}
@@ -0,0 +1,577 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/enroll"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultTokenTTL = 7 * 24 * time.Hour
+	maxHelloSize    = 16384
+)
+
+// CA signs the router certificates.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	// Bundle is the CA of the controller certificates, in PEM, the routers
+	// pin it.
+	Bundle   string
+	Validity time.Duration
+}
+
+// LoadCA reads the CA certificate and key. The bundle is the CA itself when
+// bundleFile is empty.
+func LoadCA(certFile, keyFile, bundleFile string) (*CA, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New(certFile + " is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key")
+	}
+	ca := &CA{Cert: cert, Key: key, Validity: 90 * 24 * time.Hour}
+	if bundleFile == "" {
+		ca.Bundle = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		return ca, nil
+	}
+	bundle, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	ca.Bundle = string(bundle)
+	return ca, nil
+}
+
+// Sign issues a client certificate for the router uuid. The request must be
+// signed with the key it is for and name the router.
+func (ca *CA) Sign(csrPEM, uuid string) (string, error) {
+	csr, err := checkRequest(csrPEM, uuid)
+	if err != nil {
+		return "", err
+	}
+	cert, _, err := ca.issue(csr, time.Time{})
+	return cert, err
+}
+
+func checkRequest(csrPEM, uuid string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("invalid certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if csr.Subject.CommonName != uuid {
+		return nil, fmt.Errorf("certificate request is for %q", csr.Subject.CommonName)
+	}
+	return csr, nil
+}
+
+// issue returns the certificate, in PEM, and its serial number. It is not
+// valid before notBefore, or a few minutes ago, whatever is later.
+func (ca *CA) issue(csr *x509.CertificateRequest, notBefore time.Time) (string, string, error) {
+	uuid := csr.Subject.CommonName
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	if earliest := now.Add(-5 * time.Minute); notBefore.Before(earliest) {
+		notBefore = earliest
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: uuid},
+		NotBefore:    notBefore,
+		NotAfter:     now.Add(ca.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, csr.PublicKey, ca.Key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), serial.Text(16), nil
+}
+
+// Enrollment is a token a router can enroll with, once, the serial numbers
+// of the certificates issued to it and the revision of the last
+// configuration signed for it. Key is the fingerprint of the public key the
+// token was used with: a router that lost the answer asks again with the
+// same key.
+type Enrollment struct {
+	UUID      string    `json:"uuid"`
+	Token     string    `json:"token,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+	Enrolled  time.Time `json:"enrolled,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Serials   []string  `json:"serials,omitempty"`
+	Revoked   []string  `json:"revoked,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+	Revision  uint64    `json:"revision,omitempty"`
+}
+
+/*
+Enrollments keeps the enrollment tokens and the revocations, in the file at
+Path when set so that they outlive the controller. Controllers that share
+the file, on shared storage, share them too: every change is made with the
+file locked and on its latest contents, and the file is read again whenever
+it changes.
+*/
+type Enrollments struct {
+	Path    string
+	mtx     sync.Mutex
+	byUUID  map[string]*Enrollment
+	modTime time.Time
+	size    int64
+}
+
+func LoadEnrollments(path string) (*Enrollments, error) {
+	e := &Enrollments{Path: path, byUUID: make(map[string]*Enrollment)}
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	if err := e.refresh(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// refresh reads the file again if it changed, must be called with the lock
+// held. A file that can not be read leaves the enrollments as they were.
+func (e *Enrollments) refresh() error {
+	if e.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(e.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(e.Path)
+	if err != nil {
+		return err
+	}
+	var list []*Enrollment
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	byUUID := make(map[string]*Enrollment, len(list))
+	for _, enrollment := range list {
+		byUUID[enrollment.UUID] = enrollment
+	}
+	e.byUUID, e.modTime, e.size = byUUID, info.ModTime(), info.Size()
+	return nil
+}
+
+// read refreshes the enrollments before they are read, must be called with
+// the lock held.
+func (e *Enrollments) read() {
+	if err := e.refresh(); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error reading enrollments")
+	}
+}
+
+// update applies change to the latest enrollments, with the file locked
+// against the other controllers, and saves them.
+func (e *Enrollments) update(change func() error) error {
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	if e.Path == "" {
+		return change()
+	}
+	lock, err := os.OpenFile(e.Path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+	if err := e.refresh(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return e.save()
+}
+
+// save writes the enrollments, must be called with the lock held. The file
+// is replaced at once, so other controllers never read it half written.
+func (e *Enrollments) save() error {
+	list := make([]*Enrollment, 0, len(e.byUUID))
+	for _, enrollment := range e.byUUID {
+		list = append(list, enrollment)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UUID < list[j].UUID })
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := e.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.Path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(e.Path); err == nil {
+		e.modTime, e.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// enrollment returns the enrollment of a router, creating it if needed.
+// Must be called with the lock held.
+func (e *Enrollments) enrollment(uuid string) *Enrollment {
+	enrollment, ok := e.byUUID[uuid]
+	if !ok {
+		enrollment = &Enrollment{UUID: uuid}
+		e.byUUID[uuid] = enrollment
+	}
+	return enrollment
+}
+
+// Issue creates the token of a router, replacing any previous one.
+func (e *Enrollments) Issue(uuid string, ttl time.Duration) (Enrollment, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return Enrollment{}, err
+	}
+	var issued Enrollment
+	err := e.update(func() error {
+		enrollment := e.enrollment(uuid)
+		enrollment.Token = base64.RawURLEncoding.EncodeToString(secret)
+		enrollment.Expires = time.Now().Add(ttl).UTC().Truncate(time.Second)
+		enrollment.Enrolled = time.Time{}
+		enrollment.Key = ""
+		issued = Enrollment{UUID: uuid, Token: enrollment.Token, Expires: enrollment.Expires}
+		return nil
+	})
+	return issued, err
+}
+
+// Redeem uses up the token of a router for the public key with fingerprint
+// key. It can be used again, until it expires, with the same key.
+func (e *Enrollments) Redeem(uuid, token, key string) error {
+	return e.update(func() error {
+		enrollment, ok := e.byUUID[uuid]
+		if !ok || enrollment.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(enrollment.Token)) != 1 {
+			return errors.New("invalid enrollment token")
+		}
+		if time.Now().After(enrollment.Expires) {
+			return errors.New("enrollment token expired")
+		}
+		if !enrollment.Enrolled.IsZero() {
+			if enrollment.Key != key {
+				return errors.New("enrollment token already used")
+			}
+			return nil
+		}
+		enrollment.Enrolled = time.Now().UTC()
+		enrollment.Key = key
+		return nil
+	})
+}
+
+// Issued records a certificate issued to a router.
+func (e *Enrollments) Issued(uuid, serial string) error {
+	return e.update(func() error {
+		enrollment := e.enrollment(uuid)
+		enrollment.Serials = append(enrollment.Serials, serial)
+		return nil
+	})
+}
+
+// Revoke revokes every certificate issued to a router until now, and its
+// token if it was not used yet. It needs a new enrollment to connect again.
+func (e *Enrollments) Revoke(uuid string) error {
+	return e.update(func() error {
+		enrollment := e.enrollment(uuid)
+		enrollment.Revoked = append(enrollment.Revoked, enrollment.Serials...)
+		enrollment.Serials = nil
+		enrollment.Token = ""
+		enrollment.RevokedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// RevokedAt returns when the certificates of a router were last revoked.
+func (e *Enrollments) RevokedAt(uuid string) time.Time {
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	e.read()
+	if enrollment, ok := e.byUUID[uuid]; ok {
+		return enrollment.RevokedAt
+	}
+	return time.Time{}
+}
+
+// NextRevision returns the revision of a new configuration of a router. It
+// is the time in milliseconds, so that revisions grow across controllers,
+// and above the last one given by those sharing the enrollments.
+func (e *Enrollments) NextRevision(uuid string) (uint64, error) {
+	var revision uint64
+	err := e.update(func() error {
+		enrollment := e.enrollment(uuid)
+		revision = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		if revision <= enrollment.Revision {
+			revision = enrollment.Revision + 1
+		}
+		enrollment.Revision = revision
+		return nil
+	})
+	return revision, err
+}
+
+// IsRevoked tells whether a router certificate was revoked: its serial was,
+// or it is older than the last revocation of its router, which covers the
+// certificates the controllers did not record.
+func (e *Enrollments) IsRevoked(cert *x509.Certificate) bool {
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	e.read()
+	enrollment, ok := e.byUUID[cert.Subject.CommonName]
+	if !ok {
+		return false
+	}
+	if !enrollment.RevokedAt.IsZero() && cert.NotBefore.Before(enrollment.RevokedAt) {
+		return true
+	}
+	serial := cert.SerialNumber.Text(16)
+	for _, revoked := range enrollment.Revoked {
+		if revoked == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEnrollments lets operators issue enrollment tokens:
+//
+//	POST /api/v1/enrollments {"uuid": "...", "ttl": "168h"}
+func (c *Controller) handleEnrollments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fromRouter(r) {
+		http.Error(w, "routers can not enroll routers", http.StatusForbidden)
+		return
+	}
+	if c.CA == nil {
+		http.Error(w, "enrollment is disabled", http.StatusNotFound)
+		return
+	}
+	// A token is a router certificate, it always takes an operator.
+	if len(c.Operators) == 0 {
+		http.Error(w, "enrollment tokens need operators", http.StatusForbidden)
+		return
+	}
+	if _, ok := c.authorize(w, r); !ok {
+		return
+	}
+	var req struct {
+		UUID string `json:"uuid"`
+		TTL  string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHelloSize)).Decode(&req); err != nil || req.UUID == "" {
+		http.Error(w, "a uuid is needed", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	enrollment, err := c.Enrollments.Issue(req.UUID, ttl)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error saving enrollment tokens")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, enrollment)
+}
+
+// handleEnroll answers the hello of a router with its certificate.
+func (c *Controller) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.CA == nil {
+		http.Error(w, "enrollment is disabled", http.StatusNotFound)
+		return
+	}
+	var hello enroll.Hello
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHelloSize)).Decode(&hello); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := log.Fields{"module": moduleName, "router": hello.UUID, "remote": r.RemoteAddr}
+	// The request is checked before the token is used up.
+	csr, err := checkRequest(hello.CSR, hello.UUID)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Warnln("Rejected enrollment")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fingerprint := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	if err := c.Enrollments.Redeem(hello.UUID, hello.Token, hex.EncodeToString(fingerprint[:])); err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Warnln("Rejected enrollment")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cert, err := c.issue(csr)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Errorln("Error issuing certificate")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.mtx.Lock()
+	c.router(hello.UUID)
+	c.mtx.Unlock()
+	log.WithFields(fields).Infoln("Router enrolled")
+	writeJSON(w, enroll.Reply{Certificate: cert, CA: c.CA.Bundle})
+}
+
+// issue issues a certificate and records it, so that it can be revoked. It
+// is only valid after the last revocation of the router, to the second.
+func (c *Controller) issue(csr *x509.CertificateRequest) (string, error) {
+	notBefore := c.Enrollments.RevokedAt(csr.Subject.CommonName)
+	if !notBefore.IsZero() {
+		notBefore = notBefore.Truncate(time.Second).Add(time.Second)
+	}
+	cert, serial, err := c.CA.issue(csr, notBefore)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Enrollments.Issued(csr.Subject.CommonName, serial); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error saving enrollments")
+	}
+	return cert, nil
+}
+
+// handleRenew issues a new certificate to a router, asked for over its
+// session before the current one expires.
+func (c *Controller) handleRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.CA == nil {
+		http.Error(w, "enrollment is disabled", http.StatusNotFound)
+		return
+	}
+	uuid, err := routerIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var renewal enroll.Renewal
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHelloSize)).Decode(&renewal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := log.Fields{"module": moduleName, "router": uuid}
+	csr, err := checkRequest(renewal.CSR, uuid)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Warnln("Rejected renewal")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cert, err := c.issue(csr)
+	if err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Errorln("Error issuing certificate")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(fields).Infoln("Router certificate renewed")
+	writeJSON(w, enroll.Reply{Certificate: cert, CA: c.CA.Bundle})
+}
+
+// handleRevoke revokes the certificates of a router and closes its session.
+func (c *Controller) handleRevoke(w http.ResponseWriter, r *http.Request, uuid string) {
+	if fromRouter(r) {
+		http.Error(w, "routers can not revoke routers", http.StatusForbidden)
+		return
+	}
+	if len(c.Operators) == 0 {
+		http.Error(w, "revocation needs operators", http.StatusForbidden)
+		return
+	}
+	operator, ok := c.authorize(w, r)
+	if !ok {
+		return
+	}
+	if err := c.Enrollments.Revoke(uuid); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "router": uuid, "error": err.Error()}).Errorln("Error saving enrollments")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.mtx.Lock()
+	if session, ok := c.sessions[uuid]; ok {
+		session.Close()
+	}
+	c.mtx.Unlock()
+	log.WithFields(log.Fields{"module": moduleName, "router": uuid, "operator": operator}).Warnln("Router revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyConnection rejects the router certificates that were revoked. It is
+// meant to be set as the VerifyConnection of the server TLS configuration.
+func (c *Controller) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	if c.Enrollments.IsRevoked(cert) {
+		return fmt.Errorf("certificate of %s is revoked", cert.Subject.CommonName)
+	}
+	return nil
+}
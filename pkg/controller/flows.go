@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/ipfix"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+func (c *Controller) handleFlows(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !c.authorizeRead(w, r, uuid) {
+		return
+	}
+	if c.Flows == nil {
+		http.Error(w, "flow collection is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	window := 15 * time.Minute
+	if q.Get("window") != "" {
+		var err error
+		if window, err = time.ParseDuration(q.Get("window")); err != nil {
+			http.Error(w, "invalid window: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n := 10
+	if q.Get("top") != "" {
+		var err error
+		if n, err = strconv.Atoi(q.Get("top")); err != nil {
+			http.Error(w, "invalid top: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := c.Flows.Report(uuid, window, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// EnableFlows starts collecting the flows the routers relay over their
+// sessions.
+func (c *Controller) EnableFlows() {
+	c.Flows = ipfix.NewCollector()
+	go func() {
+		for range time.Tick(time.Minute) {
+			c.Flows.Expire()
+		}
+	}()
+}
+
+// serveFlows collects the IPFIX messages a router relays on stream, they
+// are counted as exported by uuid whatever they claim.
+func (c *Controller) serveFlows(uuid string, stream net.Conn) {
+	defer stream.Close()
+	buf := make([]byte, 65535)
+	for {
+		msg, err := tunnel.ReadDatagram(stream, buf)
+		if err != nil {
+			if err != io.EOF {
+				log.WithFields(log.Fields{"module": moduleName, "router": uuid, "error": err.Error()}).Debugln("Flow stream closed")
+			}
+			return
+		}
+		if err := c.Flows.Collect(uuid, msg); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "router": uuid, "error": err.Error()}).Debugln("Error decoding flows")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/metrics"
+	"github.com/maesoser/wan-controller/pkg/speedtest"
+	log "github.com/sirupsen/logrus"
+)
+
+// handlePush ingests a batch of snapshots pushed by a router. Batches
+// replayed after an outage may be older than what is already known, only
+// the newest snapshot of every router is kept.
+func (c *Controller) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Snapshots are only taken from the router the certificate was issued
+	// to, the uuid they carry is not enough.
+	identity, err := routerIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var batch []*metrics.Metric
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, snapshot := range batch {
+		if snapshot.UUID != identity {
+			log.WithFields(log.Fields{"module": moduleName, "router": identity, "uuid": snapshot.UUID}).Warnln("Rejected snapshots of another router")
+			http.Error(w, "certificate is not valid for router "+snapshot.UUID, http.StatusForbidden)
+			return
+		}
+	}
+	address, _, _ := net.SplitHostPort(r.RemoteAddr)
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	for _, snapshot := range batch {
+		router := c.router(snapshot.UUID)
+		router.Address = address
+		if router.Metric == nil || snapshot.Timestamp.After(router.Metric.Timestamp) {
+			router.Metric = snapshot
+		}
+		if snapshot.Timestamp.After(router.LastSeen) {
+			router.LastSeen = snapshot.Timestamp
+		}
+		if snapshot.SpeedTest != nil {
+			router.addSpeedTest(*snapshot.SpeedTest)
+		}
+	}
+	log.WithFields(log.Fields{"module": moduleName}).Debugf("Ingested %d snapshots", len(batch))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePrometheus re-exports the last snapshot of every router that
+// reported recently, to operators.
+func (c *Controller) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if fromRouter(r) {
+		http.Error(w, "routers can not read the metrics of the routers", http.StatusForbidden)
+		return
+	}
+	if _, ok := c.authorize(w, r); !ok {
+		return
+	}
+	c.mtx.Lock()
+	var snapshots []*metrics.Metric
+	for _, router := range c.routers {
+		if router.Metric != nil && time.Since(router.LastSeen) < c.StaleAfter {
+			snapshots = append(snapshots, router.Metric)
+		}
+	}
+	c.mtx.Unlock()
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].UUID < snapshots[j].UUID })
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WritePrometheusAll(w, snapshots...); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error writing prometheus metrics")
+	}
+}
+
+// addSpeedTest keeps the results of a router in chronological order. Every
+// snapshot carries the last result, so most of them are already known.
+func (r *Router) addSpeedTest(result speedtest.Result) {
+	i := sort.Search(len(r.SpeedTests), func(i int) bool { return !r.SpeedTests[i].Time.Before(result.Time) })
+	if i < len(r.SpeedTests) && r.SpeedTests[i].Time.Equal(result.Time) {
+		return
+	}
+	r.SpeedTests = append(r.SpeedTests, speedtest.Result{})
+	copy(r.SpeedTests[i+1:], r.SpeedTests[i:])
+	r.SpeedTests[i] = result
+	if len(r.SpeedTests) > maxSpeedTests {
+		r.SpeedTests = r.SpeedTests[len(r.SpeedTests)-maxSpeedTests:]
+	}
+}
+
+// speedTester tells who runs a speed test: the routers, over their session
+// or with their certificate, and the operators.
+func (c *Controller) speedTester(r *http.Request) (string, bool) {
+	if identity, err := routerIdentity(r); err == nil {
+		return "router " + identity, true
+	}
+	if name, ok := c.operator(r); ok {
+		return "operator " + name, true
+	}
+	return "", false
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+// remoteServices are the router services the controller can reach over the
+// session of the router.
+var remoteServices = map[string]bool{
+	tunnel.ServiceAgent:   true,
+	tunnel.ServiceMetrics: true,
+	tunnel.ServiceDHCP:    true,
+}
+
+// handleRemote forwards a request to path on a service of the router,
+// through its session. Routers themselves are not allowed to, only the
+// operators are, and every attempt is audited.
+func (c *Controller) handleRemote(w http.ResponseWriter, r *http.Request, uuid, service, path string) {
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	entry := newAuditEntry(r, uuid, service, path)
+	defer func() { c.audit(entry, recorder) }()
+	if fromRouter(r) {
+		http.Error(recorder, "routers can not reach other routers", http.StatusForbidden)
+		return
+	}
+	operator, ok := c.authorize(recorder, r)
+	if !ok {
+		return
+	}
+	entry.Operator = operator
+	if !remoteServices[service] {
+		http.NotFound(recorder, r)
+		return
+	}
+	c.proxy(recorder, r, uuid, service, path)
+}
+
+// proxy forwards a request, once allowed, through the session of the router.
+func (c *Controller) proxy(w http.ResponseWriter, r *http.Request, uuid, service, path string) {
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = service
+			req.URL.Path = "/" + strings.TrimPrefix(path, "/")
+			req.URL.RawPath = ""
+			req.Host = service
+		},
+		// Diagnostics stream their output.
+		FlushInterval: -1,
+		// Streams are cheap, a new one is opened for every request.
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return c.OpenStream(uuid, service)
+			},
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.WithFields(log.Fields{"module": moduleName, "router": uuid, "service": service, "error": err.Error()}).Warnln("Error reaching router")
+			status := http.StatusBadGateway
+			if strings.Contains(err.Error(), ErrNotConnected.Error()) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxConfigSize = 1 << 20
+
+// handleConfig signs a configuration for a router, with the next revision,
+// and pushes it. The uuid of the router is filled in when missing.
+func (c *Controller) handleConfig(rw http.ResponseWriter, r *http.Request, uuid string) {
+	w := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+	entry := newAuditEntry(r, uuid, tunnel.ServiceAgent, "config")
+	defer func() { c.audit(entry, w) }()
+	if fromRouter(r) {
+		http.Error(w, "routers can not reach other routers", http.StatusForbidden)
+		return
+	}
+	operator, ok := c.authorize(w, r)
+	if !ok {
+		return
+	}
+	entry.Operator = operator
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var routerConfig config.Config
+	if err := json.Unmarshal(body, &routerConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if routerConfig.UUID != "" && routerConfig.UUID != uuid {
+		http.Error(w, "configuration is for router "+routerConfig.UUID, http.StatusBadRequest)
+		return
+	}
+	// The fields are kept as they were sent, even those the controller does
+	// not know about.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revision, err := c.Enrollments.NextRevision(uuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	delete(fields, "encryption")
+	delete(fields, "signed")
+	fields["uuid"], _ = json.Marshal(uuid)
+	fields["revision"], _ = json.Marshal(revision)
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The signed configuration goes along with its fields, which routers
+	// that do not check signatures read.
+	fields["signed"], err = json.Marshal(config.Sign(payload, c.ConfigKey))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(log.Fields{"module": moduleName, "router": uuid, "revision": revision}).Infoln("Pushing signed configuration")
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Config-Revision", strconv.FormatUint(revision, 10))
+	c.proxy(w, r, uuid, tunnel.ServiceAgent, "config")
+}
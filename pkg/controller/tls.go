@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+)
+
+// ServerTLSConfig returns the TLS 1.3 configuration of the controller.
+// Client certificates are verified against clientCA when presented, the
+// router endpoints then require one, see routerIdentity.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("invalid client CA certificate")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{tunnel.Protocol, "http/1.1"},
+	}, nil
+}
+
+var errNoIdentity = errors.New("client certificate required")
+
+// routerIdentity returns the router uuid, the common name of the verified
+// client certificate, of the session or of the request. Requests without
+// one, plaintext ones included, get errNoIdentity: they are not from a
+// router, and only operators may make them.
+func routerIdentity(r *http.Request) (string, error) {
+	if uuid, ok := r.Context().Value(identityKey).(string); ok && uuid != "" {
+		return uuid, nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", errNoIdentity
+	}
+	uuid := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if uuid == "" {
+		return "", errNoIdentity
+	}
+	return uuid, nil
+}
+
+// fromRouter tells whether a request carries a router certificate.
+func fromRouter(r *http.Request) bool {
+	_, err := routerIdentity(r)
+	return err == nil
+}
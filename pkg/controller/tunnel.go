@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/maesoser/wan-controller/pkg/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const identityKey contextKey = iota
+
+// revocationInterval is how often the sessions check whether the router was
+// revoked meanwhile.
+const revocationInterval = time.Minute
+
+var ErrNotConnected = errors.New("router is not connected")
+
+// ServeTunnel runs the session of a router that connected over TLS with the
+// tunnel protocol. Its streams are served by the API as if they were
+// requests made with the router certificate. It is meant to be set as the
+// tunnel.Protocol entry of http.Server.TLSNextProto.
+func (c *Controller) ServeTunnel(server *http.Server, conn *tls.Conn, _ http.Handler) {
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		log.WithFields(log.Fields{"module": moduleName, "remote": conn.RemoteAddr().String()}).Warnln("Rejected session without a client certificate")
+		return
+	}
+	cert := state.VerifiedChains[0][0]
+	uuid := cert.Subject.CommonName
+	session, err := yamux.Server(conn, yamux.DefaultConfig())
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "router": uuid, "error": err.Error()}).Errorln("Error starting session")
+		return
+	}
+	log.WithFields(log.Fields{"module": moduleName, "router": uuid, "remote": conn.RemoteAddr().String()}).Infoln("Router session established")
+	c.addSession(uuid, session, conn.RemoteAddr())
+	defer c.removeSession(uuid, session)
+	go c.watchRevocation(cert, session)
+
+	mux := tunnel.NewMux()
+	mux.HandleHTTP(tunnel.ServiceAPI, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = conn.RemoteAddr().String()
+		c.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, uuid)))
+	}))
+	if c.Flows != nil {
+		mux.Handle(tunnel.ServiceIPFIX, func(stream net.Conn) {
+			c.serveFlows(uuid, stream)
+		})
+	}
+	mux.Serve(session)
+	mux.Close()
+	log.WithFields(log.Fields{"module": moduleName, "router": uuid}).Infoln("Router session closed")
+}
+
+// watchRevocation closes the session of a router once its certificate is
+// revoked, by this controller or by another one sharing the enrollments.
+func (c *Controller) watchRevocation(cert *x509.Certificate, session *yamux.Session) {
+	ticker := time.NewTicker(revocationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+			if c.Enrollments.IsRevoked(cert) {
+				log.WithFields(log.Fields{"module": moduleName, "router": cert.Subject.CommonName}).Warnln("Closing session of a revoked router")
+				session.Close()
+				return
+			}
+		}
+	}
+}
+
+// addSession makes session the one streams to the router are opened on. A
+// previous session of the router is left behind by a reconnection, it is
+// closed.
+func (c *Controller) addSession(uuid string, session *yamux.Session, remote net.Addr) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	if old, ok := c.sessions[uuid]; ok {
+		old.Close()
+	}
+	c.sessions[uuid] = session
+	router := c.router(uuid)
+	router.Connected = true
+	if address, _, err := net.SplitHostPort(remote.String()); err == nil {
+		router.Address = address
+	}
+}
+
+func (c *Controller) removeSession(uuid string, session *yamux.Session) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	if c.sessions[uuid] != session {
+		return
+	}
+	delete(c.sessions, uuid)
+	c.router(uuid).Connected = false
+}
+
+// OpenStream opens a stream to service on the router.
+func (c *Controller) OpenStream(uuid, service string) (net.Conn, error) {
+	c.mtx.Lock()
+	session, ok := c.sessions[uuid]
+	c.mtx.Unlock()
+	if !ok {
+		return nil, ErrNotConnected
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := tunnel.WriteService(stream, service); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
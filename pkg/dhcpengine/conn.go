@@ -0,0 +1,68 @@
+package dhcpengine
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// ifaceConn is a dhcp.ServeConn that remembers the interface the last
+// request came from, so the reply leaves through that same interface and
+// the handler can pick the scope configured for it.
+type ifaceConn struct {
+	conn    *ipv4.PacketConn
+	ifIndex int
+	src     net.Addr
+}
+
+func newIfaceConn(pc net.PacketConn) (*ifaceConn, error) {
+	conn := ipv4.NewPacketConn(pc)
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return &ifaceConn{conn: conn}, nil
+}
+
+func (c *ifaceConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, cm, addr, err := c.conn.ReadFrom(b)
+	c.src = addr
+	if cm != nil {
+		c.ifIndex = cm.IfIndex
+	} else {
+		c.ifIndex = 0
+	}
+	return n, addr, err
+}
+
+func (c *ifaceConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.writeTo(b, addr, c.ifIndex)
+}
+
+// writeTo sends b through the interface ifIndex, or wherever the routing
+// table says if ifIndex is 0.
+func (c *ifaceConn) writeTo(b []byte, addr net.Addr, ifIndex int) (int, error) {
+	if ifIndex == 0 {
+		return c.conn.WriteTo(b, nil, addr)
+	}
+	return c.conn.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, addr)
+}
+
+// ifaceName returns the name of the interface the last request came from.
+func (c *ifaceConn) ifaceName() string {
+	if c.ifIndex == 0 {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(c.ifIndex)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// source returns the address the last request came from.
+func (c *ifaceConn) source() net.IP {
+	if addr, ok := c.src.(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	dhcp "github.com/krolaw/dhcp4"
-	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,261 +28,259 @@ func incIPv4Addr(ip net.IP) {
 	}
 }
 
-type DHCPLease struct {
-	IPAddr   net.IP
-	MACAddr  net.HardwareAddr
-	Creation time.Time
-	Static   bool
-}
-
+// Server holds one Scope per LAN network, keyed by the name of the
+// interface that network is reached through.
 type Server struct {
-	Config DHCPConfig
-	Leases []DHCPLease
+	Scopes map[string]*Scope `json:"scopes"`
+	mtx    sync.Mutex
+	conn   *ifaceConn
 }
 
-type DHCPConfig struct {
-	ServerIP      net.IP        `json:"server"`
-	Subnet        net.IP        `json:"subnet"`
-	Gateway       net.IP        `json:"gw"`
-	DNS           net.IP        `json:"dns"`
-	DomainName    string        `json:"domain"`
-	LeaseDuration time.Duration `json:"lease"`
-}
-
-func NewServer(
-	serverIP net.IP,
-	subnet net.IP,
-	gateway net.IP,
-	dns net.IP,
-	domainName string) Server {
-	log.WithFields(log.Fields{"module": moduleName}).Info("Serving from %s, net: %s/%s dns: %s domain: %s\n",
-		serverIP, gateway, subnet, dns, domainName)
-	config := DHCPConfig{
-		ServerIP:      serverIP,
-		Subnet:        subnet,
-		Gateway:       gateway,
-		DNS:           dns,
-		DomainName:    domainName,
-		LeaseDuration: 24 * time.Hour,
-	}
-	return Server{
-		Config: config,
+func NewServer() *Server {
+	return &Server{
+		Scopes: make(map[string]*Scope),
 	}
 }
 
-func (s *Server) getOptions() dhcp.Options {
-	options := dhcp.Options{
-		dhcp.OptionSubnetMask:       s.getMask(),
-		dhcp.OptionRouter:           s.getGateway(),
-		dhcp.OptionDomainNameServer: s.getDNS(),
+// AddScope adds or replaces the scope served on scope.Config.Interface.
+// Leases of a replaced scope are kept.
+func (s *Server) AddScope(scope *Scope) error {
+	if scope.Config.Interface == "" {
+		return fmt.Errorf("scope has no interface")
 	}
-	if s.Config.DomainName != "" {
-		options[dhcp.OptionDomainName] = []byte(s.Config.DomainName)
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	if s.Scopes == nil {
+		s.Scopes = make(map[string]*Scope)
 	}
-	return options
-}
-
-func (s *Server) getGateway() net.IP {
-	return s.Config.Gateway
-}
-
-func (s *Server) getDNS() net.IP {
-	return s.Config.ServerIP
-}
-
-func (s *Server) getMask() net.IPMask {
-	return net.IPMask(s.Config.Subnet)
-}
-
-func (s *Server) getNetwork() net.IPNet {
-	return net.IPNet{
-		IP:   s.getGateway(),
-		Mask: s.getMask(),
+	if old, ok := s.Scopes[scope.Config.Interface]; ok && scope.Leases == nil {
+		scope.Leases = old.Leases
 	}
+	s.Scopes[scope.Config.Interface] = scope
+	return nil
 }
 
-// Get's
-func (s *Server) findLeaseByMac(addr net.HardwareAddr) (DHCPLease, error) {
-	for _, lease := range s.Leases {
-		if lease.MACAddr.String() == addr.String() {
-			return lease, nil
-		}
-	}
-	return DHCPLease{}, fmt.Errorf("no preassigned lease found for %s", addr.String())
+func (s *Server) DelScope(iface string) {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	delete(s.Scopes, iface)
 }
 
-func (s *Server) findLeaseByIPAddr(addr net.IP) (DHCPLease, error) {
-	for _, lease := range s.Leases {
-		if lease.IPAddr.Equal(addr) {
-			return lease, nil
+// selectScope returns the scope a request belongs to. Relayed requests are
+// matched by giaddr, the rest by the interface they were received on.
+func (s *Server) selectScope(req dhcp.Packet) *Scope {
+	if giaddr := req.GIAddr(); giaddr != nil && !giaddr.Equal(net.IPv4zero) {
+		for _, scope := range s.Scopes {
+			if scope.Contains(giaddr) {
+				return scope
+			}
 		}
+		return nil
 	}
-	return DHCPLease{}, fmt.Errorf("no preassigned lease found for %s", addr.String())
-}
-
-func (s *Server) releaseOutdated() int {
-	var leases []DHCPLease
-	deleted := 0
-	for _, lease := range s.Leases {
-		if lease.Creation.Add(s.Config.LeaseDuration).After(time.Now()) || lease.Static {
-			leases = append(leases, lease)
-		} else {
-			deleted++
-		}
+	if s.conn == nil {
+		return nil
 	}
-	s.Leases = leases
-	return deleted
+	return s.Scopes[s.conn.ifaceName()]
 }
 
-/*
-createLease:
-	- Gives a new allocatied leases
-	- Gives you the old one, with an updated Creation timestamp
-*/
-func (s *Server) createLease(req dhcp.Packet) DHCPLease {
-	var lease DHCPLease
-	network := s.getNetwork()
-	for ip := s.getGateway().Mask(s.getMask()); network.Contains(ip); incIPv4Addr(ip) {
-		var err error
-		lease, err = s.findLeaseByIPAddr(ip)
-		if err != nil && lease.IPAddr == nil { // If this addr is empty
-			lease.Creation = time.Now()
-			lease.MACAddr = req.CHAddr()
-			lease.Static = true
-			lease.IPAddr = ip
-			return lease
-		}
-		lease.Creation = time.Now()
-		return lease
+// ListenAndServe serves every scope from a single socket bound to addr.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return err
 	}
-	return lease
-}
-
-func (s *Server) dhcpDiscover(req dhcp.Packet, options dhcp.Options) dhcp.Packet {
-	lease, err := s.findLeaseByMac(req.CHAddr())
+	defer pc.Close()
+	conn, err := newIfaceConn(pc)
 	if err != nil {
-		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error finding Lease by MAC Addr")
-		lease = s.createLease(req)
-		s.Leases = append(s.Leases, lease)
+		return err
 	}
-	log.WithFields(log.Fields{"module": moduleName}).Info("Offering %s to %s", lease.IPAddr, req.CHAddr().String())
-	opts := s.getOptions()
-	return dhcp.ReplyPacket(req,
-		dhcp.Offer,
-		s.Config.ServerIP,
-		lease.IPAddr,
-		s.Config.LeaseDuration,
-		opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]),
-	)
+	s.mtx.Lock()
+	s.conn = conn
+	s.mtx.Unlock()
+	return dhcp.Serve(conn, s)
 }
 
-func (s *Server) dhcpRequest(req dhcp.Packet, options dhcp.Options) dhcp.Packet {
-	if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(s.Config.ServerIP) {
-		log.WithFields(log.Fields{"module": moduleName}).Info("Message for a different server?")
+// ServeDHCP handles incoming dhcp requests.
+func (s *Server) ServeDHCP(req dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	scope := s.selectScope(req)
+	if scope == nil {
+		log.WithFields(log.Fields{"module": moduleName}).Warnf("No scope for %s request from %s, ignoring", msgType, req.CHAddr())
 		return nil
 	}
-	reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
-	if reqIP == nil {
-		reqIP = net.IP(req.CIAddr())
+	log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface}).Infof("Recv DHCP type %s", msgType)
+	if scope.Config.Relay != nil {
+		return s.relay(scope, req)
 	}
-	opts := s.getOptions()
-	if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
-		lease, err := s.findLeaseByMac(req.CHAddr())
-		if err != nil {
-			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorf("NAK to %s\n", req.CHAddr().String())
-			return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
-		}
-		if lease.IPAddr.Equal(reqIP) == false {
-			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorf("NAK to %s: expected %s, requested %s\n",
-				req.CHAddr().String(), lease.IPAddr.String(), reqIP.String())
-			return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
-		}
-		return dhcp.ReplyPacket(req, dhcp.ACK, s.Config.ServerIP, reqIP, s.Config.LeaseDuration,
-			opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+	if req.OpCode() != dhcp.BootRequest {
+		return nil
 	}
-	return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
+	return scope.ServeDHCP(req, msgType, options)
 }
 
-func (s *Server) dhcpRelease(req dhcp.Packet, options dhcp.Options) int {
-	var leases []DHCPLease
-	deleted := 0
-	for _, lease := range s.Leases {
-		if lease.MACAddr.String() != eq.CHAddr().String() {
-			leases = append(leases, lease)
-		} else {
-			deleted++
-		}
+func (s *Server) scopeNames() []string {
+	var names []string
+	for name := range s.Scopes {
+		names = append(names, name)
 	}
-	s.Leases = leases
-	return deleted
+	sort.Strings(names)
+	return names
 }
 
-// ServeDHCP handles incoming dhcp requests.
-func (s *Server) ServeDHCP(req dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
-	if s.Config.ServerIP == nil {
-		log.WithFields(log.Fields{"module": moduleName}).Errorln("Server not yet configuring, waiting for a POST request with the configuration")
-		return nil
-	}
-	log.WithFields(log.Fields{"module": moduleName}).Info("Recv DHCP type %\n", msgType)
-	switch msgType {
-	case dhcp.Discover:
-		return s.dhcpDiscover(req, options)
-	case dhcp.Request:
-		return s.dhcpRequest(req, options)
-	case dhcp.Release:
-		return s.dhcpRelease(req, options)
-	case dhcp.Decline:
-		return s.dhcpRelease(req, options)
+/*
+ServeHTTP exposes the scopes:
+
+	GET    /scopes                  names of the configured scopes
+	GET    /scopes/{iface}          configuration and leases of a scope
+	DELETE /scopes/{iface}          removes a scope
+	GET    /scopes/{iface}/config   configuration of a scope
+	POST   /scopes/{iface}/config   creates or updates a scope
+	GET    /scopes/{iface}/leases   leases of a scope
+	POST   /scopes/{iface}/leases   adds a lease to a scope
+	GET    /scopes/{iface}/export   leases of a scope as ?format=isc-leases|isc-hosts|dnsmasq-leases|dnsmasq-hosts
+	POST   /scopes/{iface}/import   adds the leases in the body, given in ?format=
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if path[0] != "scopes" {
+		http.NotFound(w, r)
+		return
 	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
 
-	return nil
-}
+	if len(path) == 1 {
+		writeJSON(w, s.scopeNames())
+		return
+	}
+	iface := path[1]
+	scope, ok := s.Scopes[iface]
+	resource := ""
+	if len(path) > 2 {
+		resource = path[2]
+	}
 
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		if r.URL.Path == "/config" {
-			b := new(bytes.Buffer)
-			json.NewEncoder(b).Encode(s.Config)
-			fmt.Fprintf(w, "%v", b)
-		} else if r.URL.Path == "/leases" {
-			b := new(bytes.Buffer)
-			json.NewEncoder(b).Encode(s.Leases)
-			fmt.Fprintf(w, "%v", b)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch resource {
+		case "":
+			writeJSON(w, scope)
+		case "config":
+			writeJSON(w, scope.Config)
+		case "leases":
+			writeJSON(w, scope.Leases)
+		case "export":
+			// Written to a buffer first, an error can not be sent once the
+			// body started.
+			var buffer bytes.Buffer
+			if err := WriteLeases(&buffer, r.URL.Query().Get("format"), scope.Leases, scope.Config.LeaseDuration); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(buffer.Bytes())
+		default:
+			http.NotFound(w, r)
 		}
+	case "DELETE":
+		if !ok || resource != "" {
+			http.NotFound(w, r)
+			return
+		}
+		log.WithFields(log.Fields{"module": moduleName, "scope": iface}).Info("Removing scope")
+		delete(s.Scopes, iface)
 	case "POST":
-		if r.URL.Path == "/config" {
+		switch resource {
+		case "config":
 			var config DHCPConfig
 			err := json.NewDecoder(r.Body).Decode(&config)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			log.WithFields(log.Fields{"module": moduleName}).Info("Serving from %s, Net: %s/%s DNS: %s Domain: %s\n",
+			if err := config.Options.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if config.Relay != nil {
+				if err := config.Relay.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			config.Interface = iface
+			if config.LeaseDuration == 0 {
+				config.LeaseDuration = 24 * time.Hour
+			}
+			log.WithFields(log.Fields{"module": moduleName, "scope": iface}).Infof("Serving from %s, Net: %s/%s DNS: %s Domain: %s",
 				config.ServerIP,
 				config.Gateway,
 				config.Subnet,
 				config.DNS,
 				config.DomainName,
 			)
-			s.Config = config
-		} else if r.URL.Path == "/leases" {
+			if !ok {
+				scope = &Scope{}
+				s.Scopes[iface] = scope
+			}
+			scope.Config = config
+		case "leases":
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
 			var lease DHCPLease
 			err := json.NewDecoder(r.Body).Decode(&lease)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			if err := scope.checkLease(lease); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if lease.Options != nil {
+				if err := lease.Options.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
 			lease.Creation = time.Now()
-			log.WithFields(log.Fields{"module": moduleName}).Info("Adding Lease %v=%v Static: %v\n",
+			log.WithFields(log.Fields{"module": moduleName, "scope": iface}).Infof("Adding Lease %v=%v Static: %v",
 				lease.IPAddr,
 				lease.MACAddr,
 				lease.Static,
 			)
-			s.Leases = append(s.Leases, lease)
+			scope.Leases = append(scope.Leases, lease)
+		case "import":
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			leases, err := ParseLeases(r.Body, r.URL.Query().Get("format"), scope.Config.LeaseDuration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			imported := scope.Import(leases)
+			log.WithFields(log.Fields{"module": moduleName, "scope": iface}).Infof("Imported %d of %d leases", imported, len(leases))
+			writeJSON(w, map[string]int{"found": len(leases), "imported": imported})
+		default:
+			http.NotFound(w, r)
 		}
 	default:
-		fmt.Fprintf(w, "%v", s)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error encoding response")
 	}
 }
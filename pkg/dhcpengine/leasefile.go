@@ -0,0 +1,453 @@
+package dhcpengine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lease file formats understood by ParseLeases and WriteLeases.
+const (
+	FormatISCLeases     = "isc-leases"     // dhcpd.leases
+	FormatISCHosts      = "isc-hosts"      // host blocks of dhcpd.conf
+	FormatDnsmasqLeases = "dnsmasq-leases" // dnsmasq.leases
+	FormatDnsmasqHosts  = "dnsmasq-hosts"  // dhcp-host lines or dhcp-hostsfile
+)
+
+const iscTimeLayout = "2006/01/02 15:04:05"
+
+var dnsmasqLeaseTime = regexp.MustCompile(`^([0-9]+[smhdw]?|infinite)$`)
+
+// ParseLeases reads reservations and active leases in the given format.
+// duration is the lease time of the scope they will be imported in, used to
+// translate the lease expiry times into creation times.
+func ParseLeases(r io.Reader, format string, duration time.Duration) ([]DHCPLease, error) {
+	switch format {
+	case FormatISCLeases, FormatISCHosts:
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		blocks, err := parseISC(string(data))
+		if err != nil {
+			return nil, err
+		}
+		if format == FormatISCLeases {
+			return iscLeases(blocks, duration), nil
+		}
+		return iscHosts(blocks), nil
+	case FormatDnsmasqLeases:
+		return parseDnsmasqLeases(r, duration)
+	case FormatDnsmasqHosts:
+		return parseDnsmasqHosts(r)
+	}
+	return nil, fmt.Errorf("unknown lease format %q", format)
+}
+
+// WriteLeases writes leases in the given format. Host formats only contain
+// the static reservations.
+func WriteLeases(w io.Writer, format string, leases []DHCPLease, duration time.Duration) error {
+	switch format {
+	case FormatISCLeases, FormatISCHosts, FormatDnsmasqLeases, FormatDnsmasqHosts:
+	default:
+		return fmt.Errorf("unknown lease format %q", format)
+	}
+	bw := bufio.NewWriter(w)
+	for _, lease := range leases {
+		var err error
+		switch format {
+		case FormatISCLeases:
+			ends := "never"
+			if !lease.Static {
+				ends = iscTime(lease.Creation.Add(duration))
+			}
+			_, err = fmt.Fprintf(bw, "lease %s {\n  starts %s;\n  ends %s;\n  binding state active;\n  hardware ethernet %s;\n",
+				lease.IPAddr, iscTime(lease.Creation), ends, lease.MACAddr)
+			if err == nil && lease.Hostname != "" {
+				_, err = fmt.Fprintf(bw, "  client-hostname %q;\n", lease.Hostname)
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(bw, "}\n")
+			}
+		case FormatISCHosts:
+			if !lease.Static {
+				continue
+			}
+			_, err = fmt.Fprintf(bw, "host %s {\n  hardware ethernet %s;\n  fixed-address %s;\n}\n",
+				hostName(lease), lease.MACAddr, lease.IPAddr)
+		case FormatDnsmasqLeases:
+			var expiry int64
+			if !lease.Static {
+				expiry = lease.Creation.Add(duration).Unix()
+			}
+			hostname := lease.Hostname
+			if hostname == "" {
+				hostname = "*"
+			}
+			_, err = fmt.Fprintf(bw, "%d %s %s %s *\n", expiry, lease.MACAddr, lease.IPAddr, hostname)
+		case FormatDnsmasqHosts:
+			if !lease.Static {
+				continue
+			}
+			if lease.Hostname != "" {
+				_, err = fmt.Fprintf(bw, "dhcp-host=%s,%s,%s\n", lease.MACAddr, lease.IPAddr, lease.Hostname)
+			} else {
+				_, err = fmt.Fprintf(bw, "dhcp-host=%s,%s\n", lease.MACAddr, lease.IPAddr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// iscTime formats t the way dhcpd does: weekday followed by the UTC date.
+func iscTime(t time.Time) string {
+	return strconv.Itoa(int(t.UTC().Weekday())) + " " + t.UTC().Format(iscTimeLayout)
+}
+
+func hostName(lease DHCPLease) string {
+	if lease.Hostname != "" {
+		return lease.Hostname
+	}
+	return "host-" + strings.Replace(lease.MACAddr.String(), ":", "", -1)
+}
+
+// iscBlock is a `kind name { ... }` block of an ISC dhcpd file, with its
+// statements and nested blocks.
+type iscBlock struct {
+	Kind       string
+	Name       string
+	Statements [][]string
+	Blocks     []*iscBlock
+}
+
+func (b *iscBlock) statement(words ...string) []string {
+	for _, statement := range b.Statements {
+		if len(statement) < len(words) {
+			continue
+		}
+		match := true
+		for i, word := range words {
+			if statement[i] != word {
+				match = false
+				break
+			}
+		}
+		if match {
+			return statement[len(words):]
+		}
+	}
+	return nil
+}
+
+func tokenizeISC(data string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, data[i+1:i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{};\"#", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, data[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+func parseISC(data string) ([]*iscBlock, error) {
+	tokens, err := tokenizeISC(data)
+	if err != nil {
+		return nil, err
+	}
+	root := &iscBlock{}
+	stack := []*iscBlock{root}
+	var words []string
+	for _, token := range tokens {
+		current := stack[len(stack)-1]
+		switch token {
+		case ";":
+			if len(words) > 0 {
+				current.Statements = append(current.Statements, words)
+			}
+			words = nil
+		case "{":
+			block := &iscBlock{}
+			if len(words) > 0 {
+				block.Kind = words[0]
+				block.Name = strings.Join(words[1:], " ")
+			}
+			current.Blocks = append(current.Blocks, block)
+			stack = append(stack, block)
+			words = nil
+		case "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unbalanced braces")
+			}
+			stack = stack[:len(stack)-1]
+			words = nil
+		default:
+			words = append(words, token)
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+	return root.Blocks, nil
+}
+
+// walkISC calls fn for every block of the given kind, at any depth.
+func walkISC(blocks []*iscBlock, kind string, fn func(*iscBlock)) {
+	for _, block := range blocks {
+		if block.Kind == kind {
+			fn(block)
+		}
+		walkISC(block.Blocks, kind, fn)
+	}
+}
+
+func parseISCTime(words []string) (time.Time, bool) {
+	if len(words) == 1 && words[0] == "never" {
+		return time.Time{}, true
+	}
+	if len(words) != 3 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(iscTimeLayout, words[1]+" "+words[2])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func iscLeases(blocks []*iscBlock, duration time.Duration) []DHCPLease {
+	byIP := make(map[string]DHCPLease)
+	seen := make(map[string]bool)
+	var order []string
+	walkISC(blocks, "lease", func(block *iscBlock) {
+		ip := net.ParseIP(block.Name).To4()
+		if ip == nil {
+			return
+		}
+		// dhcpd appends a new block every time a lease changes, the last one wins.
+		if state := block.statement("binding", "state"); len(state) == 1 && state[0] != "active" {
+			delete(byIP, ip.String())
+			return
+		}
+		hw := block.statement("hardware", "ethernet")
+		if len(hw) != 1 {
+			return
+		}
+		mac, err := net.ParseMAC(hw[0])
+		if err != nil {
+			return
+		}
+		lease := DHCPLease{IPAddr: ip, MACAddr: mac, Creation: time.Now()}
+		if starts, ok := parseISCTime(block.statement("starts")); ok && !starts.IsZero() {
+			lease.Creation = starts
+		}
+		if ends, ok := parseISCTime(block.statement("ends")); ok {
+			if ends.IsZero() {
+				lease.Static = true
+			} else if ends.Before(time.Now()) {
+				delete(byIP, ip.String())
+				return
+			} else {
+				lease.Creation = ends.Add(-duration)
+			}
+		}
+		if hostname := block.statement("client-hostname"); len(hostname) == 1 {
+			lease.Hostname = hostname[0]
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			order = append(order, ip.String())
+		}
+		byIP[ip.String()] = lease
+	})
+	var leases []DHCPLease
+	for _, ip := range order {
+		if lease, ok := byIP[ip]; ok {
+			leases = append(leases, lease)
+		}
+	}
+	return leases
+}
+
+func iscHosts(blocks []*iscBlock) []DHCPLease {
+	var leases []DHCPLease
+	walkISC(blocks, "host", func(block *iscBlock) {
+		hw := block.statement("hardware", "ethernet")
+		addr := block.statement("fixed-address")
+		if len(hw) != 1 || len(addr) < 1 {
+			return
+		}
+		mac, err := net.ParseMAC(hw[0])
+		if err != nil {
+			return
+		}
+		ip := net.ParseIP(strings.TrimSuffix(addr[0], ",")).To4()
+		if ip == nil {
+			return
+		}
+		hostname := block.Name
+		if name := block.statement("option", "host-name"); len(name) == 1 {
+			hostname = name[0]
+		}
+		leases = append(leases, DHCPLease{
+			IPAddr:   ip,
+			MACAddr:  mac,
+			Creation: time.Now(),
+			Static:   true,
+			Hostname: hostname,
+		})
+	})
+	return leases
+}
+
+func parseDnsmasqLeases(r io.Reader, duration time.Duration) ([]DHCPLease, error) {
+	var leases []DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// DUID lines of DHCPv6 leases have a different layout
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(fields[2]).To4()
+		if ip == nil {
+			continue
+		}
+		lease := DHCPLease{IPAddr: ip, MACAddr: mac, Creation: time.Now()}
+		if expiry == 0 {
+			lease.Static = true
+		} else if ends := time.Unix(expiry, 0); ends.Before(time.Now()) {
+			continue
+		} else {
+			lease.Creation = ends.Add(-duration)
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+func parseDnsmasqHosts(r io.Reader) ([]DHCPLease, error) {
+	var leases []DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "=") {
+			if !strings.HasPrefix(line, "dhcp-host=") {
+				continue
+			}
+			line = strings.TrimPrefix(line, "dhcp-host=")
+		}
+		lease := DHCPLease{Creation: time.Now(), Static: true}
+		ignore := false
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case field == "ignore":
+				ignore = true
+			case strings.HasPrefix(field, "id:"), strings.HasPrefix(field, "set:"), strings.HasPrefix(field, "tag:"):
+			case dnsmasqLeaseTime.MatchString(field):
+			default:
+				if mac, err := net.ParseMAC(field); err == nil {
+					if lease.MACAddr == nil {
+						lease.MACAddr = mac
+					}
+				} else if ip := net.ParseIP(field).To4(); ip != nil {
+					lease.IPAddr = ip
+				} else if lease.Hostname == "" {
+					lease.Hostname = field
+				}
+			}
+		}
+		if ignore || lease.MACAddr == nil || lease.IPAddr == nil {
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// Import adds leases to the scope, replacing the ones with the same MAC or
+// IP address. Leases outside the scope network, or on a reserved address,
+// are skipped. It returns the
+// number of leases imported.
+func (s *Scope) Import(leases []DHCPLease) int {
+	imported := 0
+	for _, lease := range leases {
+		if err := s.checkLease(lease); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Warnf("Skipping lease: %v", err)
+			continue
+		}
+		var kept []DHCPLease
+		for _, old := range s.Leases {
+			if old.IPAddr.Equal(lease.IPAddr) || old.MACAddr.String() == lease.MACAddr.String() {
+				continue
+			}
+			kept = append(kept, old)
+		}
+		s.Leases = append(kept, lease)
+		imported++
+	}
+	return imported
+}
+
+// checkLease tells whether a lease can be given on the scope: its address
+// must be in the network and not one of the reserved ones.
+func (s *Scope) checkLease(lease DHCPLease) error {
+	if lease.IPAddr.To4() == nil || len(lease.MACAddr) == 0 {
+		return fmt.Errorf("invalid lease %v=%v", lease.IPAddr, lease.MACAddr)
+	}
+	if !s.Contains(lease.IPAddr) {
+		network := s.getNetwork()
+		return fmt.Errorf("%v is not in %v", lease.IPAddr, network.String())
+	}
+	if s.isReserved(lease.IPAddr.To4()) {
+		return fmt.Errorf("%v is reserved", lease.IPAddr)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package dhcpengine
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const (
+	optionWPAD dhcp.OptionCode = 252
+	// maxOptionLength is the longest value an option can carry, its length
+	// is a single byte.
+	maxOptionLength = 255
+)
+
+type StaticRoute struct {
+	Destination string `json:"dst"`
+	Gateway     net.IP `json:"gw"`
+}
+
+// BootRule selects the PXE boot server and file for the clients whose
+// vendor class (option 60) starts with VendorClass and, if set, whose
+// architecture (option 93) is Arch. Empty fields match everything.
+type BootRule struct {
+	VendorClass string  `json:"vendor_class,omitempty"`
+	Arch        *uint16 `json:"arch,omitempty"`
+	TFTPServer  string  `json:"tftp_server"`
+	BootFile    string  `json:"bootfile"`
+}
+
+// RawOption is sent as is. Value is given either as Hex or as Text.
+// Options are only sent to clients asking for them unless Always is set.
+type RawOption struct {
+	Code   uint8  `json:"code"`
+	Hex    string `json:"hex,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Always bool   `json:"always,omitempty"`
+}
+
+type DHCPOptions struct {
+	NTPServers []net.IP      `json:"ntp,omitempty"`
+	Routes     []StaticRoute `json:"routes,omitempty"`
+	TFTPServer string        `json:"tftp_server,omitempty"`
+	BootFile   string        `json:"bootfile,omitempty"`
+	BootRules  []BootRule    `json:"boot_rules,omitempty"`
+	MTU        uint16        `json:"mtu,omitempty"`
+	WPAD       string        `json:"wpad,omitempty"`
+	Raw        []RawOption   `json:"raw,omitempty"`
+}
+
+func (o *DHCPOptions) Validate() error {
+	for _, route := range o.Routes {
+		_, dst, err := net.ParseCIDR(route.Destination)
+		if err != nil {
+			return fmt.Errorf("invalid route destination %q: %v", route.Destination, err)
+		}
+		if _, bits := dst.Mask.Size(); dst.IP.To4() == nil || bits != 32 {
+			return fmt.Errorf("route destination %s is not IPv4", route.Destination)
+		}
+		if route.Gateway.To4() == nil {
+			return fmt.Errorf("invalid gateway for route %s", route.Destination)
+		}
+	}
+	for _, ntp := range o.NTPServers {
+		if ntp.To4() == nil {
+			return fmt.Errorf("invalid NTP server %s", ntp)
+		}
+	}
+	if o.MTU != 0 && o.MTU < 68 {
+		return fmt.Errorf("invalid MTU %d", o.MTU)
+	}
+	if len(o.WPAD) > maxOptionLength || len(o.TFTPServer) > maxOptionLength || len(o.BootFile) > maxOptionLength {
+		return fmt.Errorf("wpad, tftp_server and bootfile can not be longer than %d bytes", maxOptionLength)
+	}
+	for _, rule := range o.BootRules {
+		if len(rule.TFTPServer) > maxOptionLength || len(rule.BootFile) > maxOptionLength {
+			return fmt.Errorf("boot rule for %q longer than %d bytes", rule.VendorClass, maxOptionLength)
+		}
+	}
+	for _, raw := range o.Raw {
+		if !raw.allowed() {
+			return fmt.Errorf("invalid option code %d", raw.Code)
+		}
+		value, err := raw.value()
+		if err != nil {
+			return fmt.Errorf("invalid value for option %d: %v", raw.Code, err)
+		}
+		if len(value) > maxOptionLength {
+			return fmt.Errorf("value for option %d longer than %d bytes", raw.Code, maxOptionLength)
+		}
+	}
+	return nil
+}
+
+// allowed tells whether the option can be set as is. The message type and
+// the server identifier are always the ones of the server.
+func (r RawOption) allowed() bool {
+	switch dhcp.OptionCode(r.Code) {
+	case dhcp.Pad, dhcp.End, dhcp.OptionDHCPMessageType, dhcp.OptionServerIdentifier:
+		return false
+	}
+	return true
+}
+
+func (r RawOption) value() ([]byte, error) {
+	if r.Hex != "" {
+		return hex.DecodeString(strings.Replace(r.Hex, ":", "", -1))
+	}
+	return []byte(r.Text), nil
+}
+
+// Merge returns the options in o overridden by the ones set in override.
+func (o DHCPOptions) Merge(override *DHCPOptions) DHCPOptions {
+	if override == nil {
+		return o
+	}
+	merged := o
+	if override.NTPServers != nil {
+		merged.NTPServers = override.NTPServers
+	}
+	if override.Routes != nil {
+		merged.Routes = override.Routes
+	}
+	if override.TFTPServer != "" {
+		merged.TFTPServer = override.TFTPServer
+	}
+	if override.BootFile != "" {
+		merged.BootFile = override.BootFile
+	}
+	if override.BootRules != nil {
+		merged.BootRules = override.BootRules
+	}
+	if override.MTU != 0 {
+		merged.MTU = override.MTU
+	}
+	if override.WPAD != "" {
+		merged.WPAD = override.WPAD
+	}
+	if override.Raw != nil {
+		raws := make(map[uint8]RawOption)
+		for _, raw := range o.Raw {
+			raws[raw.Code] = raw
+		}
+		for _, raw := range override.Raw {
+			raws[raw.Code] = raw
+		}
+		merged.Raw = nil
+		for _, raw := range raws {
+			merged.Raw = append(merged.Raw, raw)
+		}
+	}
+	return merged
+}
+
+// bootRule returns the TFTP server and boot file to offer to a client.
+func (o DHCPOptions) bootRule(req dhcp.Options) (string, string) {
+	vendorClass := string(req[dhcp.OptionVendorClassIdentifier])
+	var arch *uint16
+	if a := req[dhcp.OptionClientArchitecture]; len(a) >= 2 {
+		value := binary.BigEndian.Uint16(a)
+		arch = &value
+	}
+	for _, rule := range o.BootRules {
+		if !strings.HasPrefix(vendorClass, rule.VendorClass) {
+			continue
+		}
+		if rule.Arch != nil && (arch == nil || *rule.Arch != *arch) {
+			continue
+		}
+		return rule.TFTPServer, rule.BootFile
+	}
+	return o.TFTPServer, o.BootFile
+}
+
+// classlessRoutes encodes the routes as described in RFC 3442. Clients
+// honouring option 121 ignore the router option, so the default route
+// through gateway is always added.
+func classlessRoutes(routes []StaticRoute, gateway net.IP) []byte {
+	var out []byte
+	hasDefault := false
+	for _, route := range routes {
+		// Options read back from a lease file were not validated.
+		_, dst, err := net.ParseCIDR(route.Destination)
+		if err != nil || dst.IP.To4() == nil || route.Gateway.To4() == nil {
+			continue
+		}
+		ones, bits := dst.Mask.Size()
+		if bits != 32 {
+			continue
+		}
+		if ones == 0 {
+			hasDefault = true
+		}
+		out = append(out, byte(ones))
+		out = append(out, dst.IP.To4()[:(ones+7)/8]...)
+		out = append(out, route.Gateway.To4()...)
+	}
+	if !hasDefault && gateway != nil {
+		out = append(out, 0)
+		out = append(out, gateway.To4()...)
+	}
+	return out
+}
+
+// encode adds the options to opts and returns the ones that must be sent
+// even if the client did not request them.
+func (o DHCPOptions) encode(opts dhcp.Options, req dhcp.Options, gateway net.IP) []dhcp.Option {
+	if len(o.NTPServers) > 0 {
+		var ntp []byte
+		for _, server := range o.NTPServers {
+			ntp = append(ntp, server.To4()...)
+		}
+		opts[dhcp.OptionNetworkTimeProtocolServers] = ntp
+	}
+	if len(o.Routes) > 0 {
+		opts[dhcp.OptionClasslessRouteFormat] = classlessRoutes(o.Routes, gateway)
+	}
+	if o.MTU != 0 {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, o.MTU)
+		opts[dhcp.OptionInterfaceMTU] = mtu
+	}
+	if o.WPAD != "" {
+		opts[optionWPAD] = []byte(o.WPAD)
+	}
+	if tftp, file := o.bootRule(req); tftp != "" || file != "" {
+		if tftp != "" {
+			opts[dhcp.OptionTFTPServerName] = []byte(tftp)
+		}
+		if file != "" {
+			opts[dhcp.OptionBootFileName] = []byte(file)
+		}
+	}
+	var always []dhcp.Option
+	for _, raw := range o.Raw {
+		// Options read back from a lease file were not validated.
+		value, err := raw.value()
+		if err != nil || !raw.allowed() || len(value) > maxOptionLength {
+			continue
+		}
+		if raw.Always {
+			always = append(always, dhcp.Option{Code: dhcp.OptionCode(raw.Code), Value: value})
+		} else {
+			opts[dhcp.OptionCode(raw.Code)] = value
+		}
+	}
+	return always
+}
@@ -0,0 +1,195 @@
+package dhcpengine
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	dhcp "github.com/krolaw/dhcp4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	agentCircuitID = 1
+	agentRemoteID  = 2
+
+	maxHops = 16
+)
+
+// RelayConfig turns a scope into a DHCP relay (RFC 3046): requests received
+// on the scope interface are forwarded to Servers with giaddr set to the
+// scope ServerIP and the relay agent information option appended, unless
+// another relay did it already. Only replies from Servers are relayed back.
+type RelayConfig struct {
+	Servers   []string `json:"servers"`
+	CircuitID string   `json:"circuit_id,omitempty"`
+	RemoteID  string   `json:"remote_id,omitempty"`
+}
+
+func (r *RelayConfig) Validate() error {
+	if len(r.Servers) == 0 {
+		return fmt.Errorf("relay has no servers")
+	}
+	for _, server := range r.Servers {
+		if _, err := r.resolve(server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RelayConfig) resolve(server string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, strconv.Itoa(dhcpServerPort))
+	}
+	return net.ResolveUDPAddr("udp4", server)
+}
+
+// optionsEnd returns the offset of the End option of p, or len(p) if the
+// packet has none.
+func optionsEnd(p []byte) int {
+	for i := 240; i < len(p); {
+		switch dhcp.OptionCode(p[i]) {
+		case dhcp.Pad:
+			i++
+		case dhcp.End:
+			return i
+		default:
+			if i+1 >= len(p) {
+				return len(p)
+			}
+			i += 2 + int(p[i+1])
+		}
+	}
+	return len(p)
+}
+
+func (r *RelayConfig) agentInformation(iface string) []byte {
+	circuitID := r.CircuitID
+	if circuitID == "" {
+		circuitID = iface
+	}
+	var info []byte
+	info = append(info, agentCircuitID, byte(len(circuitID)))
+	info = append(info, circuitID...)
+	if r.RemoteID != "" {
+		info = append(info, agentRemoteID, byte(len(r.RemoteID)))
+		info = append(info, r.RemoteID...)
+	}
+	return info
+}
+
+// stripAgentInformation returns a copy of p without option 82.
+func stripAgentInformation(p []byte) dhcp.Packet {
+	out := make([]byte, 240, len(p))
+	copy(out, p[:240])
+	end := optionsEnd(p)
+	for i := 240; i < end; {
+		if dhcp.OptionCode(p[i]) == dhcp.Pad {
+			i++
+			continue
+		}
+		next := i + 2 + int(p[i+1])
+		if next > end {
+			break
+		}
+		if dhcp.OptionCode(p[i]) != dhcp.OptionRelayAgentInformation {
+			out = append(out, p[i:next]...)
+		}
+		i = next
+	}
+	out = append(out, byte(dhcp.End))
+	packet := dhcp.Packet(out)
+	packet.PadToMinSize()
+	return packet
+}
+
+// relayRequest forwards a client request to the upstream servers.
+func (s *Server) relayRequest(scope *Scope, req dhcp.Packet) {
+	relay := scope.Config.Relay
+	if req.Hops() >= maxHops {
+		return
+	}
+	end := optionsEnd(req)
+	out := make([]byte, end, end+64)
+	copy(out, req[:end])
+	packet := dhcp.Packet(out)
+	packet.SetHops(req.Hops() + 1)
+	// A request already relayed keeps the giaddr and the agent information
+	// of the first relay (RFC 3046 2.1), the reply goes back through it.
+	_, informed := req.ParseOptions()[dhcp.OptionRelayAgentInformation]
+	if giaddr := req.GIAddr(); giaddr == nil || giaddr.Equal(net.IPv4zero) {
+		packet.SetGIAddr(scope.Config.ServerIP)
+	} else {
+		informed = true
+	}
+	if !informed {
+		info := relay.agentInformation(scope.Config.Interface)
+		packet = append(packet, byte(dhcp.OptionRelayAgentInformation), byte(len(info)))
+		packet = append(packet, info...)
+	}
+	packet = append(packet, byte(dhcp.End))
+	packet.PadToMinSize()
+
+	for _, server := range relay.Servers {
+		addr, err := relay.resolve(server)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface, "error": err.Error()}).Errorln("Unable to resolve DHCP server")
+			continue
+		}
+		if _, err := s.conn.writeTo(packet, addr, 0); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface, "error": err.Error()}).Errorf("Unable to relay request to %s", addr)
+			continue
+		}
+		log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface}).Infof("Relayed request from %s to %s", req.CHAddr(), addr)
+	}
+}
+
+// isServer tells whether ip is one of the upstream servers of the relay.
+func (r *RelayConfig) isServer(ip net.IP) bool {
+	for _, server := range r.Servers {
+		if addr, err := r.resolve(server); err == nil && addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayReply sends an upstream server reply back to the client. Replies
+// from anywhere but the upstream servers are dropped.
+func (s *Server) relayReply(scope *Scope, reply dhcp.Packet) {
+	if source := s.conn.source(); !scope.Config.Relay.isServer(source) {
+		log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface}).Warnf("Dropped reply from %s, not a relay server", source)
+		return
+	}
+	iface, err := net.InterfaceByName(scope.Config.Interface)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface, "error": err.Error()}).Errorln("Unable to find relay interface")
+		return
+	}
+	packet := stripAgentInformation(reply)
+	addr := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+	if ciaddr := packet.CIAddr(); !packet.Broadcast() && !ciaddr.Equal(net.IPv4zero) {
+		addr.IP = ciaddr
+	}
+	if _, err := s.conn.writeTo(packet, addr, iface.Index); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface, "error": err.Error()}).Errorln("Unable to relay reply")
+		return
+	}
+	log.WithFields(log.Fields{"module": moduleName, "scope": scope.Config.Interface}).Infof("Relayed reply to %s", packet.CHAddr())
+}
+
+// relay handles the packets of a scope working as a relay. Nothing is ever
+// answered directly, so the returned packet is always nil.
+func (s *Server) relay(scope *Scope, req dhcp.Packet) dhcp.Packet {
+	switch req.OpCode() {
+	case dhcp.BootRequest:
+		s.relayRequest(scope, req)
+	case dhcp.BootReply:
+		s.relayReply(scope, req)
+	}
+	return nil
+}
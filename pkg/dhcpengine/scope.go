@@ -0,0 +1,315 @@
+package dhcpengine
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	log "github.com/sirupsen/logrus"
+)
+
+type DHCPLease struct {
+	IPAddr   net.IP
+	MACAddr  net.HardwareAddr
+	Creation time.Time
+	Static   bool
+	Hostname string       `json:",omitempty"`
+	Options  *DHCPOptions `json:",omitempty"`
+}
+
+type DHCPConfig struct {
+	Interface     string        `json:"iface"`
+	ServerIP      net.IP        `json:"server"`
+	Subnet        net.IP        `json:"subnet"`
+	Gateway       net.IP        `json:"gw"`
+	DNS           net.IP        `json:"dns"`
+	DomainName    string        `json:"domain"`
+	LeaseDuration time.Duration `json:"lease"`
+	Options       DHCPOptions   `json:"options"`
+	Relay         *RelayConfig  `json:"relay,omitempty"`
+}
+
+// declineHold is how long an address declined by a client, because another
+// host is already using it, is kept out of the pool.
+const declineHold = time.Hour
+
+// Scope is the address pool and configuration served on a single LAN
+// network, i.e. one bridge or VLAN reachable through one interface.
+// Declined holds the addresses in quarantine and when they leave it.
+type Scope struct {
+	Config   DHCPConfig           `json:"config"`
+	Leases   []DHCPLease          `json:"leases"`
+	Declined map[string]time.Time `json:"declined,omitempty"`
+}
+
+func NewScope(
+	iface string,
+	serverIP net.IP,
+	subnet net.IP,
+	gateway net.IP,
+	dns net.IP,
+	domainName string) *Scope {
+	log.WithFields(log.Fields{"module": moduleName, "scope": iface}).Infof("Serving from %s, net: %s/%s dns: %s domain: %s",
+		serverIP, gateway, subnet, dns, domainName)
+	return &Scope{
+		Config: DHCPConfig{
+			Interface:     iface,
+			ServerIP:      serverIP,
+			Subnet:        subnet,
+			Gateway:       gateway,
+			DNS:           dns,
+			DomainName:    domainName,
+			LeaseDuration: 24 * time.Hour,
+		},
+	}
+}
+
+func (s *Scope) getOptions() dhcp.Options {
+	options := dhcp.Options{
+		dhcp.OptionSubnetMask:       s.getMask(),
+		dhcp.OptionRouter:           s.getGateway(),
+		dhcp.OptionDomainNameServer: s.getDNS(),
+	}
+	if s.Config.DomainName != "" {
+		options[dhcp.OptionDomainName] = []byte(s.Config.DomainName)
+	}
+	return options
+}
+
+// reply builds an Offer or ACK for lease, adding the scope options merged
+// with the ones reserved for that lease.
+func (s *Scope) reply(req dhcp.Packet, msgType dhcp.MessageType, lease DHCPLease, options dhcp.Options) dhcp.Packet {
+	opts := s.getOptions()
+	extra := s.Config.Options.Merge(lease.Options)
+	always := extra.encode(opts, options, s.getGateway())
+	selected := append(opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]), always...)
+	packet := dhcp.ReplyPacket(req, msgType, s.Config.ServerIP, lease.IPAddr, s.Config.LeaseDuration, selected)
+	if tftp, file := extra.bootRule(options); tftp != "" || file != "" {
+		if ip := net.ParseIP(tftp); ip != nil {
+			packet.SetSIAddr(ip)
+		} else if tftp != "" {
+			packet.SetSName([]byte(tftp))
+		}
+		packet.SetFile([]byte(file))
+	}
+	return packet
+}
+
+func (s *Scope) getGateway() net.IP {
+	return s.Config.Gateway.To4()
+}
+
+func (s *Scope) getDNS() net.IP {
+	if s.Config.DNS != nil {
+		return s.Config.DNS.To4()
+	}
+	return s.Config.ServerIP.To4()
+}
+
+func (s *Scope) getMask() net.IPMask {
+	return net.IPMask(s.Config.Subnet.To4())
+}
+
+func (s *Scope) getNetwork() net.IPNet {
+	return net.IPNet{
+		IP:   s.getGateway().Mask(s.getMask()),
+		Mask: s.getMask(),
+	}
+}
+
+// Contains reports whether addr belongs to the network served by the scope.
+func (s *Scope) Contains(addr net.IP) bool {
+	if s.Config.Gateway == nil || s.Config.Subnet == nil {
+		return false
+	}
+	network := s.getNetwork()
+	return network.Contains(addr)
+}
+
+func (s *Scope) findLeaseByMac(addr net.HardwareAddr) (DHCPLease, error) {
+	for _, lease := range s.Leases {
+		if lease.MACAddr.String() == addr.String() {
+			return lease, nil
+		}
+	}
+	return DHCPLease{}, fmt.Errorf("no preassigned lease found for %s", addr.String())
+}
+
+func (s *Scope) findLeaseByIPAddr(addr net.IP) (DHCPLease, error) {
+	for _, lease := range s.Leases {
+		if lease.IPAddr.Equal(addr) {
+			return lease, nil
+		}
+	}
+	return DHCPLease{}, fmt.Errorf("no preassigned lease found for %s", addr.String())
+}
+
+func (s *Scope) releaseOutdated() int {
+	var leases []DHCPLease
+	deleted := 0
+	for _, lease := range s.Leases {
+		if lease.Creation.Add(s.Config.LeaseDuration).After(time.Now()) || lease.Static {
+			leases = append(leases, lease)
+		} else {
+			deleted++
+		}
+	}
+	s.Leases = leases
+	for addr, until := range s.Declined {
+		if time.Now().After(until) {
+			delete(s.Declined, addr)
+		}
+	}
+	return deleted
+}
+
+// isDeclined tells whether ip is in quarantine after a DHCPDECLINE.
+func (s *Scope) isDeclined(ip net.IP) bool {
+	until, ok := s.Declined[ip.String()]
+	return ok && time.Now().Before(until)
+}
+
+// isReserved tells whether ip is one of the addresses that must never be
+// handed out: network, broadcast, gateway and the server itself.
+func (s *Scope) isReserved(ip net.IP) bool {
+	network := s.getNetwork()
+	broadcast := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		broadcast[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip.Equal(network.IP) || ip.Equal(broadcast) ||
+		ip.Equal(s.getGateway()) || ip.Equal(s.Config.ServerIP)
+}
+
+/*
+createLease:
+  - Gives a new allocated lease with the first free address of the scope
+  - Returns an error if the scope is exhausted
+*/
+func (s *Scope) createLease(req dhcp.Packet, options dhcp.Options) (DHCPLease, error) {
+	s.releaseOutdated()
+	network := s.getNetwork()
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	for ; network.Contains(ip); incIPv4Addr(ip) {
+		if s.isReserved(ip) || s.isDeclined(ip) {
+			continue
+		}
+		if _, err := s.findLeaseByIPAddr(ip); err == nil {
+			continue
+		}
+		addr := make(net.IP, len(ip))
+		copy(addr, ip)
+		// The packet buffer is reused for the next one.
+		mac := append(net.HardwareAddr(nil), req.CHAddr()...)
+		return DHCPLease{
+			IPAddr:   addr,
+			MACAddr:  mac,
+			Creation: time.Now(),
+			Hostname: string(options[dhcp.OptionHostName]),
+		}, nil
+	}
+	return DHCPLease{}, fmt.Errorf("no free addresses left on %s", network.String())
+}
+
+func (s *Scope) renewLease(addr net.HardwareAddr) {
+	for i := range s.Leases {
+		if s.Leases[i].MACAddr.String() == addr.String() {
+			s.Leases[i].Creation = time.Now()
+		}
+	}
+}
+
+func (s *Scope) dhcpDiscover(req dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	lease, err := s.findLeaseByMac(req.CHAddr())
+	if err != nil {
+		lease, err = s.createLease(req, options)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface, "error": err.Error()}).Errorln("Unable to allocate a lease")
+			return nil
+		}
+		s.Leases = append(s.Leases, lease)
+	}
+	log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Infof("Offering %s to %s", lease.IPAddr, req.CHAddr().String())
+	return s.reply(req, dhcp.Offer, lease, options)
+}
+
+func (s *Scope) dhcpRequest(req dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(s.Config.ServerIP) {
+		log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Info("Message for a different server?")
+		return nil
+	}
+	reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
+	if reqIP == nil {
+		reqIP = net.IP(req.CIAddr())
+	}
+	if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
+		lease, err := s.findLeaseByMac(req.CHAddr())
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface, "error": err.Error()}).Errorf("NAK to %s", req.CHAddr().String())
+			return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
+		}
+		if !lease.IPAddr.Equal(reqIP) {
+			log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Errorf("NAK to %s: expected %s, requested %s",
+				req.CHAddr().String(), lease.IPAddr.String(), reqIP.String())
+			return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
+		}
+		s.renewLease(req.CHAddr())
+		return s.reply(req, dhcp.ACK, lease, options)
+	}
+	return dhcp.ReplyPacket(req, dhcp.NAK, s.Config.ServerIP, nil, 0, nil)
+}
+
+func (s *Scope) dhcpRelease(req dhcp.Packet, options dhcp.Options) int {
+	var leases []DHCPLease
+	deleted := 0
+	for _, lease := range s.Leases {
+		if lease.Static || lease.MACAddr.String() != req.CHAddr().String() {
+			leases = append(leases, lease)
+		} else {
+			deleted++
+		}
+	}
+	s.Leases = leases
+	return deleted
+}
+
+// dhcpDecline drops the lease of a client that found its address in use, and
+// keeps that address out of the pool for a while.
+func (s *Scope) dhcpDecline(req dhcp.Packet, options dhcp.Options) {
+	addr := net.IP(options[dhcp.OptionRequestedIPAddress]).To4()
+	if addr == nil {
+		if lease, err := s.findLeaseByMac(req.CHAddr()); err == nil {
+			addr = lease.IPAddr.To4()
+		}
+	}
+	s.dhcpRelease(req, options)
+	if addr == nil || !s.Contains(addr) {
+		return
+	}
+	log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Warnf("%s declined %s, it is in use, holding it for %v", req.CHAddr().String(), addr, declineHold)
+	if s.Declined == nil {
+		s.Declined = make(map[string]time.Time)
+	}
+	s.Declined[addr.String()] = time.Now().Add(declineHold)
+}
+
+// ServeDHCP handles a request that has already been routed to this scope.
+func (s *Scope) ServeDHCP(req dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	if s.Config.ServerIP == nil {
+		log.WithFields(log.Fields{"module": moduleName, "scope": s.Config.Interface}).Errorln("Scope not yet configured, waiting for a POST request with the configuration")
+		return nil
+	}
+	switch msgType {
+	case dhcp.Discover:
+		return s.dhcpDiscover(req, options)
+	case dhcp.Request:
+		return s.dhcpRequest(req, options)
+	case dhcp.Release:
+		s.dhcpRelease(req, options)
+	case dhcp.Decline:
+		s.dhcpDecline(req, options)
+	}
+	return nil
+}
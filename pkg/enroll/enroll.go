@@ -0,0 +1,141 @@
+/*
+Package enroll is how a router gets its certificate: it sends a hello to a
+controller with the enrollment token of its bootstrap and a certificate
+request for its uuid, and the controller answers with the certificate and
+the CA bundle of the controllers.
+*/
+package enroll
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+)
+
+const (
+	// Path is where controllers take hellos.
+	Path = "/api/v1/enroll"
+	// RenewPath is where enrolled routers renew their certificate, over
+	// their session.
+	RenewPath = "/api/v1/renew"
+)
+
+type Hello struct {
+	UUID  string `json:"uuid"`
+	Token string `json:"token"`
+	CSR   string `json:"csr"` // PEM
+}
+
+// Renewal asks for a new certificate, for the router whose certificate the
+// session is authenticated with.
+type Renewal struct {
+	CSR string `json:"csr"` // PEM
+}
+
+type Reply struct {
+	Certificate string `json:"cert"` // PEM
+	CA          string `json:"ca"`   // PEM, the CA bundle of the controllers
+}
+
+// NewKey returns a new router key and a certificate request for uuid signed
+// with it, both in PEM.
+func NewKey(uuid string) (keyPEM, csrPEM string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	csrPEM, err = NewRequest(uuid, keyPEM)
+	return keyPEM, csrPEM, err
+}
+
+// NewRequest returns a certificate request for uuid signed with a key in
+// PEM, as made by NewKey.
+func NewRequest(uuid, keyPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return "", errors.New("invalid router key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: uuid},
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})), nil
+}
+
+// Send sends the hello to the controllers in turn, checking their
+// certificate against ca, until one answers.
+func Send(controllers []string, ca string, hello Hello) (*Reply, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return nil, errors.New("invalid CA certificate")
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config.PinnedTLSConfig(pool, "")},
+	}
+	body, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, controller := range controllers {
+		reply, err := post(client, "https://"+controller+Path, body)
+		if err == nil {
+			return reply, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", controller, err))
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// Renew asks for a new certificate with client, which reaches the
+// controller through wan-connect.
+func Renew(client *http.Client, csrPEM string) (*Reply, error) {
+	body, err := json.Marshal(Renewal{CSR: csrPEM})
+	if err != nil {
+		return nil, err
+	}
+	return post(client, "http://controller"+RenewPath, body)
+}
+
+func post(client *http.Client, url string, body []byte) (*Reply, error) {
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	reply := &Reply{}
+	if err := json.NewDecoder(response.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,279 @@
+package ipfix
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	moduleName = "ipfix-collector"
+
+	bucketSize = time.Minute
+	// maxKeys bounds the distinct addresses and applications of a bucket,
+	// the rest are counted as "other".
+	maxKeys = 10000
+	// maxExporters bounds the exporters known at once.
+	maxExporters = 4096
+)
+
+var servicePorts = map[uint16]string{
+	20: "ftp", 21: "ftp", 22: "ssh", 25: "smtp", 53: "dns", 67: "dhcp", 80: "http",
+	110: "pop3", 123: "ntp", 143: "imap", 443: "https", 465: "smtps", 587: "smtp",
+	853: "dot", 993: "imaps", 995: "pop3s", 1194: "openvpn", 1935: "rtmp",
+	3389: "rdp", 3478: "stun", 5060: "sip", 5222: "xmpp", 8080: "http-alt",
+	51820: "wireguard",
+}
+
+type Usage struct {
+	Key     string `json:"key"`
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+	Flows   uint64 `json:"flows"`
+}
+
+func (u *Usage) add(flow *Flow) {
+	u.Bytes += flow.Bytes
+	u.Packets += flow.Packets
+	u.Flows++
+}
+
+type Report struct {
+	Exporter     string    `json:"exporter"`
+	Since        time.Time `json:"since"`
+	Bytes        uint64    `json:"bytes"`
+	Packets      uint64    `json:"packets"`
+	Flows        uint64    `json:"flows"`
+	Sources      []Usage   `json:"sources"`
+	Destinations []Usage   `json:"destinations"`
+	Applications []Usage   `json:"applications"`
+}
+
+type bucket struct {
+	start        time.Time
+	total        Usage
+	sources      map[string]*Usage
+	destinations map[string]*Usage
+	applications map[string]*Usage
+}
+
+func newBucket(start time.Time) *bucket {
+	return &bucket{
+		start:        start,
+		sources:      make(map[string]*Usage),
+		destinations: make(map[string]*Usage),
+		applications: make(map[string]*Usage),
+	}
+}
+
+func count(usages map[string]*Usage, key string, flow *Flow) {
+	usage, ok := usages[key]
+	if !ok {
+		if len(usages) >= maxKeys {
+			key = "other"
+			usage, ok = usages[key]
+		}
+		if !ok {
+			usage = &Usage{Key: key}
+			usages[key] = usage
+		}
+	}
+	usage.add(flow)
+}
+
+// application names the service of a flow after the lowest of its ports,
+// usually the server one.
+func application(flow *Flow) string {
+	switch flow.Protocol {
+	case 1, 58:
+		return "icmp"
+	case 6, 17:
+	default:
+		return "proto/" + strconv.Itoa(int(flow.Protocol))
+	}
+	transport := "tcp"
+	if flow.Protocol == 17 {
+		transport = "udp"
+	}
+	port := flow.DstPort
+	if flow.SrcPort != 0 && flow.SrcPort < port {
+		port = flow.SrcPort
+	}
+	name, ok := servicePorts[port]
+	switch {
+	case ok && transport == "udp" && port == 443:
+		return "quic"
+	case ok:
+		return name
+	}
+	return transport + "/" + strconv.Itoa(int(port))
+}
+
+/*
+Collector decodes IPFIX and NetFlow v9 messages and keeps, per exporter and
+per minute over the last Retention, the traffic of every source and
+destination address and application.
+
+It does not listen by itself: exporters are named by whoever hands it their
+messages, the controller names them after the router of the session they
+came over. Exporters silent for Retention are forgotten, and at most
+maxExporters are kept.
+*/
+type Collector struct {
+	Retention time.Duration
+	decoder   *Decoder
+	mtx       sync.Mutex
+	exporters map[string][]*bucket
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		Retention: time.Hour,
+		decoder:   NewDecoder(),
+		exporters: make(map[string][]*bucket),
+	}
+}
+
+// Collect decodes a message of exporter and counts its flows.
+func (c *Collector) Collect(exporter string, msg []byte) error {
+	flows, err := c.decoder.Decode(exporter, msg)
+	if len(flows) > 0 {
+		if addErr := c.Add(exporter, flows); addErr != nil {
+			return addErr
+		}
+	}
+	return err
+}
+
+// Expire forgets the exporters that sent nothing for Retention, and the
+// templates not seen for a while. It is meant to be called periodically.
+func (c *Collector) Expire() {
+	c.decoder.Expire()
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	for exporter, buckets := range c.exporters {
+		if len(buckets) == 0 || time.Since(buckets[len(buckets)-1].start) > c.Retention {
+			delete(c.exporters, exporter)
+		}
+	}
+}
+
+// Forget drops everything known about exporter.
+func (c *Collector) Forget(exporter string) {
+	c.decoder.Forget(exporter)
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	delete(c.exporters, exporter)
+}
+
+// Add counts flows in the current bucket of exporter.
+func (c *Collector) Add(exporter string, flows []Flow) error {
+	now := time.Now()
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	buckets, ok := c.exporters[exporter]
+	if !ok && len(c.exporters) >= maxExporters {
+		return fmt.Errorf("too many exporters, dropping the flows of %s", exporter)
+	}
+	for len(buckets) > 0 && now.Sub(buckets[0].start) > c.Retention {
+		buckets = buckets[1:]
+	}
+	start := now.Truncate(bucketSize)
+	if len(buckets) == 0 || !buckets[len(buckets)-1].start.Equal(start) {
+		buckets = append(buckets, newBucket(start))
+	}
+	b := buckets[len(buckets)-1]
+	for i := range flows {
+		flow := &flows[i]
+		b.total.add(flow)
+		if flow.Source != nil {
+			count(b.sources, flow.Source.String(), flow)
+		}
+		if flow.Dest != nil {
+			count(b.destinations, flow.Dest.String(), flow)
+		}
+		count(b.applications, application(flow), flow)
+	}
+	c.exporters[exporter] = buckets
+	return nil
+}
+
+func (c *Collector) Exporters() []string {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	var exporters []string
+	for exporter := range c.exporters {
+		exporters = append(exporters, exporter)
+	}
+	sort.Strings(exporters)
+	return exporters
+}
+
+func top(usages map[string]*Usage, n int) []Usage {
+	list := make([]Usage, 0, len(usages))
+	for _, usage := range usages {
+		list = append(list, *usage)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Key < list[j].Key
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func merge(into map[string]*Usage, from map[string]*Usage) {
+	for key, usage := range from {
+		total, ok := into[key]
+		if !ok {
+			total = &Usage{Key: key}
+			into[key] = total
+		}
+		total.Bytes += usage.Bytes
+		total.Packets += usage.Packets
+		total.Flows += usage.Flows
+	}
+}
+
+// Report returns the n top talkers and applications of exporter over the
+// last window.
+func (c *Collector) Report(exporter string, window time.Duration, n int) (Report, error) {
+	if window > c.Retention {
+		return Report{}, fmt.Errorf("window longer than the %v retention", c.Retention)
+	}
+	since := time.Now().Add(-window)
+	c.mtx.Lock()
+	buckets, ok := c.exporters[exporter]
+	total := newBucket(since)
+	for _, b := range buckets {
+		if b.start.Add(bucketSize).Before(since) {
+			continue
+		}
+		total.total.Bytes += b.total.Bytes
+		total.total.Packets += b.total.Packets
+		total.total.Flows += b.total.Flows
+		merge(total.sources, b.sources)
+		merge(total.destinations, b.destinations)
+		merge(total.applications, b.applications)
+	}
+	c.mtx.Unlock()
+	if !ok {
+		return Report{}, fmt.Errorf("no flows from %s", exporter)
+	}
+	return Report{
+		Exporter:     exporter,
+		Since:        since,
+		Bytes:        total.total.Bytes,
+		Packets:      total.total.Packets,
+		Flows:        total.total.Flows,
+		Sources:      top(total.sources, n),
+		Destinations: top(total.destinations, n),
+		Applications: top(total.applications, n),
+	}, nil
+}
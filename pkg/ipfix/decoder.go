@@ -0,0 +1,367 @@
+package ipfix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Information elements the collector understands (RFC 7012). NetFlow v9
+// uses the same numbers for them.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowEndSeconds           = 151
+	ieFlowEndMilliseconds      = 153
+
+	variableLength = 0xffff
+
+	// Templates are resent every few seconds, the ones not seen for
+	// templateTTL are forgotten. At most maxTemplates are kept, and
+	// maxExporterTemplates of a single exporter.
+	templateTTL          = 30 * time.Minute
+	maxTemplates         = 4096
+	maxExporterTemplates = 256
+)
+
+const (
+	versionNetflow9 = 9
+	versionIPFIX    = 10
+
+	ipfixHeaderSize    = 16
+	netflow9HeaderSize = 20
+	setHeaderSize      = 4
+)
+
+var (
+	errShort            = errors.New("truncated message")
+	errTooManyTemplates = errors.New("too many templates")
+)
+
+type Flow struct {
+	Exporter string
+	Source   net.IP
+	Dest     net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	Bytes    uint64
+	Packets  uint64
+	End      time.Time
+}
+
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+}
+
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+type template struct {
+	fields []templateField
+	seen   time.Time
+}
+
+// Decoder turns IPFIX and NetFlow v9 messages into flows. Templates are
+// remembered per exporter and observation domain, data sets received before
+// their template are dropped.
+type Decoder struct {
+	mtx       sync.Mutex
+	templates map[templateKey]*template
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{templates: make(map[templateKey]*template)}
+}
+
+// Expire forgets the templates not seen for templateTTL.
+func (d *Decoder) Expire() {
+	defer d.mtx.Unlock()
+	d.mtx.Lock()
+	d.expire()
+}
+
+func (d *Decoder) expire() {
+	for key, t := range d.templates {
+		if time.Since(t.seen) > templateTTL {
+			delete(d.templates, key)
+		}
+	}
+}
+
+// Forget drops the templates of an exporter.
+func (d *Decoder) Forget(exporter string) {
+	defer d.mtx.Unlock()
+	d.mtx.Lock()
+	for key := range d.templates {
+		if key.exporter == exporter {
+			delete(d.templates, key)
+		}
+	}
+}
+
+// Decode parses a message received from exporter.
+func (d *Decoder) Decode(exporter string, msg []byte) ([]Flow, error) {
+	if len(msg) < 2 {
+		return nil, errShort
+	}
+	switch version := binary.BigEndian.Uint16(msg); version {
+	case versionIPFIX:
+		return d.decodeIPFIX(exporter, msg)
+	case versionNetflow9:
+		return d.decodeNetflow9(exporter, msg)
+	default:
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+}
+
+func (d *Decoder) decodeIPFIX(exporter string, msg []byte) ([]Flow, error) {
+	if len(msg) < ipfixHeaderSize {
+		return nil, errShort
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if length > len(msg) || length < ipfixHeaderSize {
+		return nil, errShort
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(msg[4:])), 0)
+	domain := binary.BigEndian.Uint32(msg[12:])
+	return d.decodeSets(exporter, domain, exportTime, msg[ipfixHeaderSize:length], 2, 3)
+}
+
+func (d *Decoder) decodeNetflow9(exporter string, msg []byte) ([]Flow, error) {
+	if len(msg) < netflow9HeaderSize {
+		return nil, errShort
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(msg[8:])), 0)
+	domain := binary.BigEndian.Uint32(msg[16:])
+	return d.decodeSets(exporter, domain, exportTime, msg[netflow9HeaderSize:], 0, 1)
+}
+
+// decodeSets walks the sets of a message. The template and options
+// template set ids are 2 and 3 in IPFIX, 0 and 1 in NetFlow v9.
+func (d *Decoder) decodeSets(exporter string, domain uint32, exportTime time.Time, sets []byte, templateSet, optionsSet uint16) ([]Flow, error) {
+	var flows []Flow
+	for len(sets) >= setHeaderSize {
+		id := binary.BigEndian.Uint16(sets)
+		length := int(binary.BigEndian.Uint16(sets[2:]))
+		if length < setHeaderSize || length > len(sets) {
+			return flows, errShort
+		}
+		body := sets[setHeaderSize:length]
+		sets = sets[length:]
+		var err error
+		switch {
+		case id == templateSet:
+			err = d.parseTemplates(exporter, domain, body, templateSet == 2)
+		case id == optionsSet:
+			err = d.parseOptionsTemplates(exporter, domain, body, templateSet == 2)
+		case id >= 256:
+			var decoded []Flow
+			decoded, err = d.parseData(exporter, domain, id, exportTime, body)
+			flows = append(flows, decoded...)
+		}
+		if err != nil {
+			return flows, err
+		}
+	}
+	return flows, nil
+}
+
+func parseFields(body []byte, count int, ipfix bool) ([]templateField, []byte, error) {
+	fields := make([]templateField, 0, count)
+	for i := 0; i < count; i++ {
+		if len(body) < 4 {
+			return nil, nil, errShort
+		}
+		field := templateField{
+			id:     binary.BigEndian.Uint16(body),
+			length: binary.BigEndian.Uint16(body[2:]),
+		}
+		body = body[4:]
+		if ipfix && field.id&0x8000 != 0 {
+			if len(body) < 4 {
+				return nil, nil, errShort
+			}
+			field.id &^= 0x8000
+			field.enterprise = true
+			body = body[4:]
+		}
+		fields = append(fields, field)
+	}
+	return fields, body, nil
+}
+
+func (d *Decoder) parseTemplates(exporter string, domain uint32, body []byte, ipfix bool) error {
+	// Sets are padded up to 4 bytes, a template needs at least 4.
+	for len(body) >= 4 {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		fields, rest, err := parseFields(body[4:], count, ipfix)
+		if err != nil {
+			return err
+		}
+		body = rest
+		if err := d.setTemplate(templateKey{exporter, domain, id}, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOptionsTemplates keeps the layout of options records only so that
+// their data sets can be skipped.
+func (d *Decoder) parseOptionsTemplates(exporter string, domain uint32, body []byte, ipfix bool) error {
+	for len(body) >= 6 {
+		id := binary.BigEndian.Uint16(body)
+		var count int
+		if ipfix {
+			// template id, field count, scope field count
+			count = int(binary.BigEndian.Uint16(body[2:]))
+		} else {
+			// template id, scope length, options length, in bytes
+			count = int(binary.BigEndian.Uint16(body[2:])+binary.BigEndian.Uint16(body[4:])) / 4
+		}
+		fields, rest, err := parseFields(body[6:], count, ipfix)
+		if err != nil {
+			return err
+		}
+		body = rest
+		if err := d.setTemplate(templateKey{exporter, domain, id}, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) setTemplate(key templateKey, fields []templateField) error {
+	defer d.mtx.Unlock()
+	d.mtx.Lock()
+	if len(fields) == 0 {
+		// A template withdrawal.
+		delete(d.templates, key)
+		return nil
+	}
+	if _, ok := d.templates[key]; !ok {
+		if len(d.templates) >= maxTemplates {
+			d.expire()
+			if len(d.templates) >= maxTemplates {
+				return errTooManyTemplates
+			}
+		}
+		n := 0
+		for k := range d.templates {
+			if k.exporter == key.exporter {
+				n++
+			}
+		}
+		if n >= maxExporterTemplates {
+			return errTooManyTemplates
+		}
+	}
+	d.templates[key] = &template{fields: fields, seen: time.Now()}
+	return nil
+}
+
+func (d *Decoder) parseData(exporter string, domain uint32, id uint16, exportTime time.Time, body []byte) ([]Flow, error) {
+	d.mtx.Lock()
+	t, ok := d.templates[templateKey{exporter, domain, id}]
+	d.mtx.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	fields := t.fields
+	minLength := 0
+	for _, field := range fields {
+		if field.length == variableLength {
+			minLength++
+		} else {
+			minLength += int(field.length)
+		}
+	}
+	if minLength == 0 {
+		return nil, fmt.Errorf("empty template %d", id)
+	}
+	var flows []Flow
+	for len(body) >= minLength {
+		flow := Flow{Exporter: exporter, End: exportTime}
+		for _, field := range fields {
+			length := int(field.length)
+			if field.length == variableLength {
+				if len(body) < 1 {
+					return flows, errShort
+				}
+				length, body = int(body[0]), body[1:]
+				if length == 255 {
+					if len(body) < 2 {
+						return flows, errShort
+					}
+					length, body = int(binary.BigEndian.Uint16(body)), body[2:]
+				}
+			}
+			if len(body) < length {
+				return flows, errShort
+			}
+			if !field.enterprise {
+				flow.set(field.id, body[:length])
+			}
+			body = body[length:]
+		}
+		if flow.Source != nil || flow.Dest != nil {
+			flows = append(flows, flow)
+		}
+	}
+	return flows, nil
+}
+
+// decodeUint decodes an unsigned integer of any length, exporters may use
+// reduced-size encoding.
+func decodeUint(value []byte) uint64 {
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func (f *Flow) set(id uint16, value []byte) {
+	switch id {
+	case ieOctetDeltaCount:
+		f.Bytes = decodeUint(value)
+	case iePacketDeltaCount:
+		f.Packets = decodeUint(value)
+	case ieProtocolIdentifier:
+		f.Protocol = uint8(decodeUint(value))
+	case ieSourceTransportPort:
+		f.SrcPort = uint16(decodeUint(value))
+	case ieDestinationTransportPort:
+		f.DstPort = uint16(decodeUint(value))
+	case ieSourceIPv4Address, ieSourceIPv6Address:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			f.Source = append(net.IP(nil), value...)
+		}
+	case ieDestinationIPv4Address, ieDestinationIPv6Address:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			f.Dest = append(net.IP(nil), value...)
+		}
+	case ieFlowEndSeconds:
+		f.End = time.Unix(int64(decodeUint(value)), 0)
+	case ieFlowEndMilliseconds:
+		ms := int64(decodeUint(value))
+		f.End = time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+	}
+}
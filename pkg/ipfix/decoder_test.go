@@ -0,0 +1,136 @@
+package ipfix
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// set builds a set with its header.
+func set(id uint16, body ...[]byte) []byte {
+	var b []byte
+	for _, part := range body {
+		b = append(b, part...)
+	}
+	header := make([]byte, setHeaderSize)
+	binary.BigEndian.PutUint16(header, id)
+	binary.BigEndian.PutUint16(header[2:], uint16(setHeaderSize+len(b)))
+	return append(header, b...)
+}
+
+// message builds an IPFIX message of observation domain 1.
+func message(sets ...[]byte) []byte {
+	var b []byte
+	for _, s := range sets {
+		b = append(b, s...)
+	}
+	header := make([]byte, ipfixHeaderSize)
+	binary.BigEndian.PutUint16(header, versionIPFIX)
+	binary.BigEndian.PutUint16(header[2:], uint16(ipfixHeaderSize+len(b)))
+	binary.BigEndian.PutUint32(header[4:], 1600000000)
+	binary.BigEndian.PutUint32(header[12:], 1)
+	return append(header, b...)
+}
+
+func u16(values ...uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// template 256: source and destination IPv4 addresses and bytes.
+var testTemplate = set(2, u16(256, 3, ieSourceIPv4Address, 4, ieDestinationIPv4Address, 4, ieOctetDeltaCount, 4))
+
+var testRecord = append(append(net.IPv4(192, 168, 2, 10).To4(), net.IPv4(1, 1, 1, 1).To4()...), u32(1500)...)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    [][]byte
+		flows   int
+		wantErr bool
+	}{
+		{"template and data", [][]byte{message(testTemplate, set(256, testRecord))}, 1, false},
+		{"template then data", [][]byte{message(testTemplate), message(set(256, testRecord, testRecord))}, 2, false},
+		{"data before template", [][]byte{message(set(256, testRecord)), message(testTemplate)}, 0, false},
+		{"padded data set", [][]byte{message(testTemplate, set(256, testRecord, []byte{0, 0, 0}))}, 1, false},
+		{"empty message", [][]byte{{}}, 0, true},
+		{"unknown version", [][]byte{u16(7, 0)}, 0, true},
+		{"short header", [][]byte{message()[:ipfixHeaderSize-1]}, 0, true},
+		{"length beyond message", [][]byte{message(testTemplate)[:ipfixHeaderSize+4]}, 0, true},
+		{"length below header", [][]byte{append(u16(versionIPFIX, 4), make([]byte, ipfixHeaderSize)...)}, 0, true},
+		{"set length beyond message", [][]byte{message(append(u16(256, 200), testRecord...))}, 0, true},
+		{"set length below header", [][]byte{message(u16(256, 2))}, 0, true},
+		{"truncated template", [][]byte{message(set(2, u16(256, 3, ieSourceIPv4Address, 4)))}, 0, true},
+		{"truncated enterprise field", [][]byte{message(set(2, u16(256, 1, 0x8000|ieSourceIPv4Address, 4)))}, 0, true},
+		{"empty template", [][]byte{message(set(2, u16(256, 1, ieSourceIPv4Address, 0)), set(256, testRecord))}, 0, true},
+		{"truncated variable length", [][]byte{message(set(2, u16(256, 2, ieSourceIPv4Address, 4, 82, variableLength)), set(256, net.IPv4(10, 0, 0, 1).To4(), []byte{255, 0}))}, 0, true},
+		{"variable length beyond set", [][]byte{message(set(2, u16(256, 2, ieSourceIPv4Address, 4, 82, variableLength)), set(256, net.IPv4(10, 0, 0, 1).To4(), []byte{40, 1, 2}))}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder()
+			var flows []Flow
+			var err error
+			for _, msg := range tt.msgs {
+				var decoded []Flow
+				decoded, err = d.Decode("router", msg)
+				flows = append(flows, decoded...)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(flows) != tt.flows {
+				t.Fatalf("got %d flows, want %d", len(flows), tt.flows)
+			}
+			for _, flow := range flows {
+				if flow.Exporter != "router" || !flow.Source.Equal(net.IPv4(192, 168, 2, 10)) || !flow.Dest.Equal(net.IPv4(1, 1, 1, 1)) || flow.Bytes != 1500 {
+					t.Errorf("unexpected flow %+v", flow)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplatesPerExporter(t *testing.T) {
+	d := NewDecoder()
+	data := message(set(256, testRecord))
+	if _, err := d.Decode("a", message(testTemplate)); err != nil {
+		t.Fatal(err)
+	}
+	if flows, _ := d.Decode("b", data); len(flows) != 0 {
+		t.Fatalf("exporter b used the template of a")
+	}
+	d.Forget("a")
+	if flows, _ := d.Decode("a", data); len(flows) != 0 {
+		t.Fatalf("template of a not forgotten")
+	}
+}
+
+func TestTemplateLimit(t *testing.T) {
+	d := NewDecoder()
+	for id := uint16(256); id < 256+maxExporterTemplates; id++ {
+		if _, err := d.Decode("a", message(set(2, u16(id, 1, ieSourceIPv4Address, 4)))); err != nil {
+			t.Fatalf("template %d: %v", id, err)
+		}
+	}
+	if _, err := d.Decode("a", message(set(2, u16(256+maxExporterTemplates, 1, ieSourceIPv4Address, 4)))); err != errTooManyTemplates {
+		t.Fatalf("got %v, want %v", err, errTooManyTemplates)
+	}
+	// Replacing a known template is always allowed, and other exporters
+	// are not affected.
+	if _, err := d.Decode("a", message(set(2, u16(256, 1, ieSourceIPv4Address, 4)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode("b", message(testTemplate)); err != nil {
+		t.Fatal(err)
+	}
+}
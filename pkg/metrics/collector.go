@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Run collects a new snapshot every interval until stop is closed.
+func (m *Metric) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		m.Update()
+		if elapsed := time.Since(start); elapsed > interval {
+			log.WithFields(log.Fields{"module": moduleName}).Warnf("Collection took %v, longer than the %v interval", elapsed, interval)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// counterDelta returns how much a counter grew between two readings. A
+// counter lower than before was reset (e.g. VPP restarted), so everything
+// it counted since is the delta.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func perSecond(cur, prev uint64, elapsed time.Duration) float64 {
+	return float64(counterDelta(cur, prev)) / elapsed.Seconds()
+}
+
+// computeRates fills the rates of ifaces from the counters of the previous
+// snapshot taken elapsed ago. Interfaces that were not there before keep
+// zero rates until the next collection.
+func computeRates(ifaces, previous []Iface, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	byName := make(map[string]Iface, len(previous))
+	for _, iface := range previous {
+		byName[iface.Name] = iface
+	}
+	for i := range ifaces {
+		cur := &ifaces[i]
+		prev, ok := byName[cur.Name]
+		if !ok {
+			continue
+		}
+		cur.RxBps = 8 * perSecond(cur.RxBytes, prev.RxBytes, elapsed)
+		cur.TxBps = 8 * perSecond(cur.TxBytes, prev.TxBytes, elapsed)
+		cur.RxPps = perSecond(cur.RxPackets, prev.RxPackets, elapsed)
+		cur.TxPps = perSecond(cur.TxPackets, prev.TxPackets, elapsed)
+		cur.RxErrorRate = perSecond(cur.RxErrors, prev.RxErrors, elapsed)
+		cur.TxErrorRate = perSecond(cur.TxErrors, prev.TxErrors, elapsed)
+		cur.RxDropRate = perSecond(cur.RxDropped, prev.RxDropped, elapsed)
+		cur.TxDropRate = perSecond(cur.TxDropped, prev.TxDropped, elapsed)
+	}
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/cpu"
+	log "github.com/sirupsen/logrus"
+)
+
+const sysfs = "/sys"
+
+type Sensor struct {
+	Name string  `json:"name"`
+	Type string  `json:"type"`
+	Temp float64 `json:"temp"` // celsius
+}
+
+// CPUCore holds the usage of a core over the last collection interval, in
+// percent, and its frequency in MHz. The cores polled by the VPP workers
+// are always at 100%.
+type CPUCore struct {
+	Name  string  `json:"name"`
+	Usage float64 `json:"usage"`
+	Freq  float64 `json:"mhz,omitempty"`
+}
+
+type Hugepages struct {
+	Size     uint64 `json:"size"` // kB
+	Total    uint64 `json:"total"`
+	Free     uint64 `json:"free"`
+	Reserved uint64 `json:"reserved"`
+	Surplus  uint64 `json:"surplus"`
+}
+
+func readSysfs(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	value, err := readSysfs(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// UpdateSensors reads the thermal zones and the hwmon temperature sensors.
+func (m *Metric) UpdateSensors() {
+	m.Sensors = nil
+	zones, _ := filepath.Glob(filepath.Join(sysfs, "class/thermal/thermal_zone*"))
+	for _, zone := range zones {
+		temp, err := readSysfsUint(filepath.Join(zone, "temp"))
+		if err != nil {
+			continue
+		}
+		kind, _ := readSysfs(filepath.Join(zone, "type"))
+		m.Sensors = append(m.Sensors, Sensor{Name: filepath.Base(zone), Type: kind, Temp: float64(temp) / 1000})
+	}
+	inputs, _ := filepath.Glob(filepath.Join(sysfs, "class/hwmon/hwmon*/temp*_input"))
+	for _, input := range inputs {
+		temp, err := readSysfsUint(input)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(input)
+		sensor := strings.TrimSuffix(filepath.Base(input), "_input")
+		chip, _ := readSysfs(filepath.Join(dir, "name"))
+		kind := chip
+		if label, err := readSysfs(filepath.Join(dir, sensor+"_label")); err == nil {
+			kind = chip + " " + label
+		}
+		m.Sensors = append(m.Sensors, Sensor{Name: filepath.Base(dir) + "/" + sensor, Type: kind, Temp: float64(temp) / 1000})
+	}
+}
+
+// MaxTemp returns the hottest sensor reading.
+func (m *Metric) MaxTemp() float64 {
+	var max float64
+	for _, sensor := range m.Sensors {
+		if sensor.Temp > max {
+			max = sensor.Temp
+		}
+	}
+	return max
+}
+
+// UpdateCPU reads the time spent by every core, usage is computed against
+// the previous snapshot by computeCPUUsage.
+func (m *Metric) UpdateCPU() {
+	m.CPUs = nil
+	times, err := cpu.Times(true)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting cpu times")
+		return
+	}
+	m.cpuTimes = times
+	for _, t := range times {
+		core := CPUCore{Name: t.CPU}
+		id := strings.TrimPrefix(t.CPU, "cpu")
+		if khz, err := readSysfsUint(filepath.Join(sysfs, "devices/system/cpu/cpu"+id, "cpufreq/scaling_cur_freq")); err == nil {
+			core.Freq = float64(khz) / 1000
+		}
+		m.CPUs = append(m.CPUs, core)
+	}
+}
+
+func cpuBusy(t cpu.TimesStat) (busy, total float64) {
+	// Guest time is already accounted in user time.
+	total = t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	return total - t.Idle - t.Iowait, total
+}
+
+func computeCPUUsage(cores []CPUCore, cur, prev []cpu.TimesStat) {
+	byName := make(map[string]cpu.TimesStat, len(prev))
+	for _, t := range prev {
+		byName[t.CPU] = t
+	}
+	for i, t := range cur {
+		p, ok := byName[t.CPU]
+		if !ok || i >= len(cores) {
+			continue
+		}
+		busy, total := cpuBusy(t)
+		prevBusy, prevTotal := cpuBusy(p)
+		if total > prevTotal {
+			cores[i].Usage = 100 * (busy - prevBusy) / (total - prevTotal)
+		}
+	}
+}
+
+// UpdateHugepages reads the usage of every hugepage size, DPDK usually takes
+// 1GB pages besides the default 2MB ones.
+func (m *Metric) UpdateHugepages() {
+	m.Hugepages = nil
+	dirs, _ := filepath.Glob(filepath.Join(sysfs, "kernel/mm/hugepages/hugepages-*kB"))
+	for _, dir := range dirs {
+		size, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir), "hugepages-"), "kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+		pages := Hugepages{Size: size}
+		pages.Total, _ = readSysfsUint(filepath.Join(dir, "nr_hugepages"))
+		pages.Free, _ = readSysfsUint(filepath.Join(dir, "free_hugepages"))
+		pages.Reserved, _ = readSysfsUint(filepath.Join(dir, "resv_hugepages"))
+		pages.Surplus, _ = readSysfsUint(filepath.Join(dir, "surplus_hugepages"))
+		m.Hugepages = append(m.Hugepages, pages)
+	}
+	sort.Slice(m.Hugepages, func(i, j int) bool { return m.Hugepages[i].Size < m.Hugepages[j].Size })
+}
+
+// unixLink fills the link state of a kernel interface. Speed is unknown,
+// and reads as -1, on virtual interfaces and links that are down.
+func (iface *Iface) unixLink() {
+	dir := filepath.Join(sysfs, "class/net", iface.Name)
+	iface.Oper, _ = readSysfs(filepath.Join(dir, "operstate"))
+	if speed, err := readSysfs(filepath.Join(dir, "speed")); err == nil {
+		if mbps, err := strconv.ParseInt(speed, 10, 64); err == nil && mbps > 0 {
+			iface.Speed = uint64(mbps)
+		}
+	}
+	if duplex, err := readSysfs(filepath.Join(dir, "duplex")); err == nil && duplex != "unknown" {
+		iface.Duplex = duplex
+	}
+}
@@ -0,0 +1,431 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	historyMagic      = "GUANRRD1"
+	historyHeaderSize = 24 // magic, step, slots
+	historySlotSize   = 24 // timestamp, samples, mean
+	historyExt        = ".rrd"
+
+	// Only the rings used last are kept open, there is a series per
+	// interface, process and probe, so a collection writes some 150 of
+	// them. The limit stays above that, for them not to be reopened on
+	// every collection, and well below the default of 1024 open files.
+	maxOpenRings = 512
+	// Limits of a single query.
+	maxQuerySeries = 32
+	maxQueryPoints = 10000
+)
+
+var historyUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// History keeps one fixed-size ring file per series under Dir, so the
+// router remembers the last Step*Slots of every collected value whatever
+// happens to the controller. Samples falling in the same step are averaged.
+type History struct {
+	Dir   string
+	Step  time.Duration
+	Slots int64
+	mtx   sync.Mutex
+	rings map[string]*ring
+}
+
+type ring struct {
+	file *os.File
+	used time.Time
+}
+
+type HistoryPoint struct {
+	Time  time.Time `json:"t"`
+	Value *float64  `json:"v"`
+}
+
+func NewHistory(dir string, step, retention time.Duration) (*History, error) {
+	if step < time.Second || retention < step {
+		return nil, fmt.Errorf("invalid history step %v for retention %v", step, retention)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &History{
+		Dir:   dir,
+		Step:  step,
+		Slots: int64(retention / step),
+		rings: make(map[string]*ring),
+	}, nil
+}
+
+func (h *History) header() []byte {
+	header := make([]byte, historyHeaderSize)
+	copy(header, historyMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(h.Step/time.Second))
+	binary.LittleEndian.PutUint64(header[16:], uint64(h.Slots))
+	return header
+}
+
+// ring returns the file of a series, creating it if needed. Files written
+// with a different step or size are started over.
+func (h *History) ring(series string) (*os.File, error) {
+	if r, ok := h.rings[series]; ok {
+		r.used = time.Now()
+		return r.file, nil
+	}
+	if len(h.rings) >= maxOpenRings {
+		h.closeOldest()
+	}
+	path := filepath.Join(h.Dir, historyUnsafe.ReplaceAllString(series, "_")+historyExt)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	header := h.header()
+	current := make([]byte, historyHeaderSize)
+	if _, err := f.ReadAt(current, 0); err != nil || !bytes.Equal(current, header) {
+		if err == nil {
+			log.WithFields(log.Fields{"module": moduleName, "series": series}).Warnln("History layout changed, starting over")
+		}
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt(header, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Truncate(historyHeaderSize + h.Slots*historySlotSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	h.rings[series] = &ring{file: f, used: time.Now()}
+	return f, nil
+}
+
+// closeOldest closes the ring used the longest ago.
+func (h *History) closeOldest() {
+	oldest := ""
+	for series, r := range h.rings {
+		if oldest == "" || r.used.Before(h.rings[oldest].used) {
+			oldest = series
+		}
+	}
+	if oldest != "" {
+		h.rings[oldest].file.Close()
+		delete(h.rings, oldest)
+	}
+}
+
+// Close closes the files of every series.
+func (h *History) Close() error {
+	defer h.mtx.Unlock()
+	h.mtx.Lock()
+	var err error
+	for series, r := range h.rings {
+		if cerr := r.file.Close(); cerr != nil {
+			err = cerr
+		}
+		delete(h.rings, series)
+	}
+	return err
+}
+
+func (h *History) slotOffset(step int64) int64 {
+	return historyHeaderSize + (step%h.Slots)*historySlotSize
+}
+
+func readSlot(f *os.File, offset int64) (int64, uint64, float64, error) {
+	slot := make([]byte, historySlotSize)
+	if _, err := f.ReadAt(slot, offset); err != nil {
+		return 0, 0, 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(slot[0:])),
+		binary.LittleEndian.Uint64(slot[8:]),
+		math.Float64frombits(binary.LittleEndian.Uint64(slot[16:])),
+		nil
+}
+
+// Add stores a sample of series taken at ts.
+func (h *History) Add(series string, ts time.Time, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	defer h.mtx.Unlock()
+	h.mtx.Lock()
+	f, err := h.ring(series)
+	if err != nil {
+		return err
+	}
+	step := ts.Unix() / int64(h.Step/time.Second)
+	offset := h.slotOffset(step)
+	slotStep, samples, mean, err := readSlot(f, offset)
+	if err != nil {
+		return err
+	}
+	if slotStep != step {
+		samples, mean = 0, 0
+	}
+	mean = (mean*float64(samples) + value) / float64(samples+1)
+	samples++
+	slot := make([]byte, historySlotSize)
+	binary.LittleEndian.PutUint64(slot[0:], uint64(step))
+	binary.LittleEndian.PutUint64(slot[8:], samples)
+	binary.LittleEndian.PutUint64(slot[16:], math.Float64bits(mean))
+	_, err = f.WriteAt(slot, offset)
+	return err
+}
+
+// Record stores every value of a snapshot.
+func (h *History) Record(m *Metric) {
+	values := map[string]float64{
+		"uptime":  m.Uptime.Seconds(),
+		"memfree": float64(m.MemFree),
+		"membuff": float64(m.MemBuff),
+	}
+	if len(m.Load) == 3 {
+		values["load1"] = m.Load[0]
+		values["load5"] = m.Load[1]
+		values["load15"] = m.Load[2]
+	}
+	for _, iface := range m.Ifaces {
+		prefix := "iface." + iface.Name + "."
+		values[prefix+"rxbps"] = iface.RxBps
+		values[prefix+"txbps"] = iface.TxBps
+		values[prefix+"rxpps"] = iface.RxPps
+		values[prefix+"txpps"] = iface.TxPps
+		values[prefix+"rxerrps"] = iface.RxErrorRate
+		values[prefix+"txerrps"] = iface.TxErrorRate
+		values[prefix+"rxdropps"] = iface.RxDropRate
+		values[prefix+"txdropps"] = iface.TxDropRate
+	}
+	if len(m.Sensors) > 0 {
+		values["temp.max"] = m.MaxTemp()
+	}
+	for _, core := range m.CPUs {
+		values["cpu."+core.Name+".usage"] = core.Usage
+	}
+	for _, pages := range m.Hugepages {
+		values[fmt.Sprintf("hugepages.%dkB.free", pages.Size)] = float64(pages.Free)
+	}
+	for _, proc := range m.Processes {
+		values["proc."+proc.Name+".rss"] = float64(proc.RSS)
+	}
+	if len(m.VPP.WorkerVectorRates) > 0 {
+		values["vpp.vector_rate"] = m.VPP.VectorRate
+		values["vpp.input_rate"] = m.VPP.InputRate
+	}
+	for i, rate := range m.VPP.WorkerVectorRates {
+		values[fmt.Sprintf("vpp.worker%d.vector_rate", i)] = rate
+	}
+	for _, pool := range m.VPP.Buffers {
+		values["vpp.buffers."+pool.Name+".available"] = pool.Available
+	}
+	if m.NAT.MaxSessions > 0 {
+		values["nat.sessions"] = float64(m.NAT.Sessions)
+		values["nat.users"] = float64(m.NAT.Users)
+	}
+	for _, probe := range m.Probes {
+		if len(probe.Windows) == 0 || probe.Windows[0].Sent == 0 {
+			continue
+		}
+		prefix := "probe." + probe.Uplink + "." + probe.Type + "." + probe.Target + "."
+		values[prefix+"p50"] = probe.Windows[0].P50
+		values[prefix+"p99"] = probe.Windows[0].P99
+		values[prefix+"loss"] = probe.Windows[0].Loss
+		values[prefix+"jitter"] = probe.Windows[0].Jitter
+	}
+	for _, fs := range m.Disks {
+		values["disk."+fs.Mountpoint+".free"] = float64(fs.Free)
+	}
+	for series, value := range values {
+		if err := h.Add(series, m.Timestamp, value); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "series": series, "error": err.Error()}).Errorln("Error writing history")
+		}
+	}
+}
+
+// Series returns the name of the stored series.
+func (h *History) Series() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(h.Dir, "*"+historyExt))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(file), historyExt))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func aggregate(values []float64, agg string) (float64, error) {
+	result := values[0]
+	for _, v := range values[1:] {
+		switch agg {
+		case "avg", "sum":
+			result += v
+		case "min":
+			result = math.Min(result, v)
+		case "max":
+			result = math.Max(result, v)
+		case "last":
+			result = v
+		}
+	}
+	switch agg {
+	case "avg":
+		result /= float64(len(values))
+	case "sum", "min", "max", "last":
+	default:
+		return 0, fmt.Errorf("unknown aggregation %q", agg)
+	}
+	return result, nil
+}
+
+// Query returns the values of series between start and end, one point per
+// step aggregated with agg (avg, min, max, sum or last). Steps without
+// samples have a nil value.
+func (h *History) Query(series string, start, end time.Time, step time.Duration, agg string) ([]HistoryPoint, error) {
+	if step < h.Step {
+		step = h.Step
+	}
+	now := time.Now()
+	oldest := now.Add(-time.Duration(h.Slots) * h.Step)
+	if start.Before(oldest) {
+		start = oldest
+	}
+	if end.After(now) {
+		end = now
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("empty time range")
+	}
+	if end.Sub(start)/step > maxQueryPoints {
+		return nil, fmt.Errorf("too many points, increase the step")
+	}
+	defer h.mtx.Unlock()
+	h.mtx.Lock()
+	if _, err := os.Stat(filepath.Join(h.Dir, historyUnsafe.ReplaceAllString(series, "_")+historyExt)); err != nil {
+		return nil, fmt.Errorf("unknown series %q", series)
+	}
+	f, err := h.ring(series)
+	if err != nil {
+		return nil, err
+	}
+	stepSecs := int64(h.Step / time.Second)
+	var points []HistoryPoint
+	for t := start.Truncate(step); t.Before(end); t = t.Add(step) {
+		var values []float64
+		for s := t.Unix() / stepSecs; s < t.Add(step).Unix()/stepSecs; s++ {
+			slotStep, samples, mean, err := readSlot(f, h.slotOffset(s))
+			if err != nil {
+				return nil, err
+			}
+			if slotStep == s && samples > 0 {
+				values = append(values, mean)
+			}
+		}
+		point := HistoryPoint{Time: t}
+		if len(values) > 0 {
+			value, err := aggregate(values, agg)
+			if err != nil {
+				return nil, err
+			}
+			point.Value = &value
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func parseHistoryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+/*
+ServeHTTP answers history queries:
+
+	GET /history/series
+	GET /history?series=load1,iface.port1.rxbps&start=24h&end=now&step=5m&agg=avg
+
+start and end are unix timestamps, RFC3339 dates or durations back from now.
+*/
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/history/series" {
+		names, err := h.Series()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, names)
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	start, err := parseHistoryTime(q.Get("start"), now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end := now
+	if q.Get("end") != "now" {
+		if end, err = parseHistoryTime(q.Get("end"), now); err != nil {
+			http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	step := h.Step
+	if q.Get("step") != "" {
+		if step, err = time.ParseDuration(q.Get("step")); err != nil {
+			http.Error(w, "invalid step: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	agg := q.Get("agg")
+	if agg == "" {
+		agg = "avg"
+	}
+	names := strings.Split(q.Get("series"), ",")
+	if len(names) > maxQuerySeries {
+		http.Error(w, fmt.Sprintf("too many series, at most %d", maxQuerySeries), http.StatusBadRequest)
+		return
+	}
+	result := make(map[string][]HistoryPoint)
+	for _, series := range names {
+		if series == "" {
+			continue
+		}
+		points, err := h.Query(series, start, end, step, agg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result[series] = points
+	}
+	writeJSON(w, result)
+}
@@ -2,13 +2,14 @@ package metrics
 
 import (
 	"encoding/json"
-	"fmt"
+	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/load"
 	mnet "github.com/shirou/gopsutil/net"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +17,11 @@ import (
 	"git.fd.io/govpp.git/adapter/statsclient"
 	"git.fd.io/govpp.git/api"
 	"git.fd.io/govpp.git/core"
+	"github.com/maesoser/wan-controller/pkg/pihole"
+	"github.com/maesoser/wan-controller/pkg/ping"
+	"github.com/maesoser/wan-controller/pkg/resolver"
+	"github.com/maesoser/wan-controller/pkg/speedtest"
+	"github.com/maesoser/wan-controller/pkg/vppmgr"
 )
 
 type Filesystem struct {
@@ -35,30 +41,145 @@ type Iface struct {
 	RxPackets uint64 `json:"rxpkt"`
 	RxErrors  uint64 `json:"rxerr"`
 	RxDropped uint64 `json:"rxdrop"`
+	Speed     uint64 `json:"speed,omitempty"` // Mbps
+	Duplex    string `json:"duplex,omitempty"`
+	Oper      string `json:"oper,omitempty"`
+
+	// Only reported by VPP interfaces.
+	VPP           bool   `json:"vpp,omitempty"`
+	RxNoBuf       uint64 `json:"rxnobuf,omitempty"`
+	RxMiss        uint64 `json:"rxmiss,omitempty"`
+	Punts         uint64 `json:"punt,omitempty"`
+	RxIP4         uint64 `json:"rxip4,omitempty"`
+	RxIP6         uint64 `json:"rxip6,omitempty"`
+	RxUnicast     uint64 `json:"rxucast,omitempty"`
+	RxMulticast   uint64 `json:"rxmcast,omitempty"`
+	RxBroadcast   uint64 `json:"rxbcast,omitempty"`
+	TxUnicastMiss uint64 `json:"txucastmiss,omitempty"`
+	TxMulticast   uint64 `json:"txmcast,omitempty"`
+	TxBroadcast   uint64 `json:"txbcast,omitempty"`
+
+	TxBps       float64 `json:"txbps"`
+	RxBps       float64 `json:"rxbps"`
+	TxPps       float64 `json:"txpps"`
+	RxPps       float64 `json:"rxpps"`
+	TxErrorRate float64 `json:"txerrps"`
+	RxErrorRate float64 `json:"rxerrps"`
+	TxDropRate  float64 `json:"txdropps"`
+	RxDropRate  float64 `json:"rxdropps"`
 }
 
 type Metric struct {
-	UUID          string        `json:"uuid"`
-	Load          []float64     `json:"load"`
-	Uptime        time.Duration `json:"upt"`
-	MemTotal      uint64        `json:"memtotal"`
-	MemFree       uint64        `json:"memfree"`
-	MemBuff       uint64        `json:"membuff"`
-	Disks         []Filesystem  `json:"disks"`
-	Ifaces        []Iface       `json:"ifaces"`
-	DNS           PiHoleStatus  `json:"pihole"`
+	UUID          string             `json:"uuid"`
+	Timestamp     time.Time          `json:"ts"`
+	Load          []float64          `json:"load"`
+	Uptime        time.Duration      `json:"upt"`
+	MemTotal      uint64             `json:"memtotal"`
+	MemFree       uint64             `json:"memfree"`
+	MemBuff       uint64             `json:"membuff"`
+	Disks         []Filesystem       `json:"disks"`
+	Ifaces        []Iface            `json:"ifaces"`
+	DNS           PiHoleStatus       `json:"pihole"`
+	VPP           VPPStats           `json:"vpp"`
+	NAT           NATStats           `json:"nat"`
+	Uplinks       map[string]bool    `json:"uplinks,omitempty"`
+	Probes        []ping.ProbeStatus `json:"probes,omitempty"`
+	SpeedTest     *speedtest.Result  `json:"speedtest,omitempty"`
+	Sensors       []Sensor           `json:"sensors,omitempty"`
+	CPUs          []CPUCore          `json:"cpus,omitempty"`
+	Hugepages     []Hugepages        `json:"hugepages,omitempty"`
+	Processes     []Process          `json:"procs,omitempty"`
+	Resolver      *resolver.Stats    `json:"resolver,omitempty"`
+	cpuTimes      []cpu.TimesStat
 	mtx           sync.Mutex
 	vppClient     *statsclient.StatsClient
 	vppConnection *core.StatsConnection
+	vppAPI        *vppmgr.VPPManager
+	History       *History          `json:"-"`
+	Pusher        *Pusher           `json:"-"`
+	Prober        *ping.Engine      `json:"-"`
+	SpeedTester   *speedtest.Runner `json:"-"`
+	PiHole        *pihole.Client    `json:"-"`
+	// ResolverAddr is where wan-dns serves its stats, when it runs.
+	ResolverAddr string `json:"-"`
 }
 
+// Update collects a new snapshot. Collection happens without holding the
+// lock, so requests keep being served from the previous snapshot meanwhile.
 func (m *Metric) Update() {
-	defer m.mtx.Unlock()
+	next := &Metric{
+		UUID:          m.UUID,
+		vppClient:     m.vppClient,
+		vppConnection: m.vppConnection,
+		vppAPI:        m.vppAPI,
+	}
+	next.UpdateSystem()
+	next.UpdateInterfaces()
+	next.UpdateFilesystems()
+	next.UpdateSensors()
+	next.UpdateCPU()
+	next.UpdateHugepages()
+	next.UpdateProcesses(m.Processes)
+	next.UpdateVPP()
+	next.UpdateNAT(m.NAT)
+	if m.Prober != nil {
+		next.Uplinks = m.Prober.Uplinks()
+		next.Probes = m.Prober.Status()
+	}
+	if m.SpeedTester != nil {
+		next.SpeedTest = m.SpeedTester.Last()
+	}
+	if m.PiHole != nil {
+		if err := next.DNS.UpdateDNS(m.PiHole); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error getting Pi-hole stats")
+		}
+	}
+	if m.ResolverAddr != "" {
+		var err error
+		if next.Resolver, err = resolver.FetchStats(m.ResolverAddr); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error getting resolver stats")
+		}
+	}
+	next.Timestamp = time.Now()
+
 	m.mtx.Lock()
-	m.UpdateSystem()
-	m.UpdateInterfaces()
-	m.UpdateFilesystems()
-	m.DNS.UpdateDNS("127.0.0.1:8993")
+	if !m.Timestamp.IsZero() {
+		computeRates(next.Ifaces, m.Ifaces, next.Timestamp.Sub(m.Timestamp))
+		computeNodeRates(next.VPP.Nodes, m.VPP.Nodes)
+		computeCPUUsage(next.CPUs, next.cpuTimes, m.cpuTimes)
+	}
+	m.store(next)
+	m.mtx.Unlock()
+
+	if m.History != nil {
+		m.History.Record(next)
+	}
+	if m.Pusher != nil {
+		m.Pusher.Enqueue(next)
+	}
+}
+
+func (m *Metric) store(next *Metric) {
+	m.Timestamp = next.Timestamp
+	m.Load = next.Load
+	m.Uptime = next.Uptime
+	m.MemTotal = next.MemTotal
+	m.MemFree = next.MemFree
+	m.MemBuff = next.MemBuff
+	m.Disks = next.Disks
+	m.Ifaces = next.Ifaces
+	m.DNS = next.DNS
+	m.VPP = next.VPP
+	m.NAT = next.NAT
+	m.Uplinks = next.Uplinks
+	m.Probes = next.Probes
+	m.SpeedTest = next.SpeedTest
+	m.Sensors = next.Sensors
+	m.CPUs = next.CPUs
+	m.Hugepages = next.Hugepages
+	m.Processes = next.Processes
+	m.Resolver = next.Resolver
+	m.cpuTimes = next.cpuTimes
 }
 
 const (
@@ -73,10 +194,21 @@ func (m *Metric) Init() {
 	if err != nil {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error connecting to VPP Stats Endpoint")
 	}
+	m.vppAPI = &vppmgr.VPPManager{}
+	if err := m.vppAPI.Init(); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error connecting to VPP API")
+		m.vppAPI = nil
+	}
 }
 
 func (m *Metric) Disconnect() {
+	if m.vppConnection != nil {
+		m.vppConnection.Disconnect()
+	}
 	m.vppClient.Disconnect()
+	if m.vppAPI != nil {
+		m.vppAPI.Close()
+	}
 }
 
 func (m *Metric) UpdateSystem() {
@@ -105,18 +237,6 @@ func (m *Metric) UpdateSystem() {
 	}
 }
 
-func (m *Metric) StringSystem() string {
-	out := ""
-	out += fmt.Sprintf("guan_uptime_sec{uuid=\"%s\"} %f\n", m.UUID, m.Uptime)
-	out += fmt.Sprintf("guan_total_mem_kb{uuid=\"%s\"} %f\n", m.UUID, m.MemTotal)
-	out += fmt.Sprintf("guan_free_mem_kb{uuid=\"%s\"} %f\n", m.UUID, m.MemFree)
-	out += fmt.Sprintf("guan_buff_mem_kb{uuid=\"%s\"} %f\n", m.UUID, m.MemBuff)
-	out += fmt.Sprintf("guan_load_1min{uuid=\"%s\"} %f\n", m.UUID, m.Load[0])
-	out += fmt.Sprintf("guan_load_5min{uuid=\"%s\"} %f\n", m.UUID, m.Load[1])
-	out += fmt.Sprintf("guan_load_15min{uuid=\"%s\"} %f\n", m.UUID, m.Load[2])
-	return out
-}
-
 func (m *Metric) UpdateInterfaces() {
 	m.Ifaces = nil
 	m.UpdateUnixInterfaces()
@@ -139,48 +259,74 @@ func (m *Metric) UpdateUnixInterfaces() {
 			newIface.TxPackets = iface.PacketsSent
 			newIface.TxErrors = iface.Errout
 			newIface.RxErrors = iface.Errin
+			newIface.unixLink()
 			m.Ifaces = append(m.Ifaces, newIface)
 		}
 	}
 }
 
 func (m *Metric) UpdateDPDKInterfaces() {
+	if m.vppConnection == nil {
+		return
+	}
 	stats := new(api.InterfaceStats)
 	if err := m.vppConnection.GetInterfaceStats(stats); err != nil {
 		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting DPDK interface stats")
 	}
+	links := make(map[string]vppmgr.Interface)
+	if m.vppAPI != nil {
+		ifaces, err := m.vppAPI.Interfaces()
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting VPP interface state")
+		}
+		for _, iface := range ifaces {
+			links[iface.Name] = iface
+		}
+	}
 	for _, iface := range stats.Interfaces {
 		var newIface Iface
 		// newIface.Name = fmt.Sprintf("port%d", iface.InterfaceIndex)
 		newIface.Name = iface.InterfaceName
+		newIface.VPP = true
 		newIface.RxBytes = iface.Rx.Bytes
 		newIface.TxBytes = iface.Tx.Bytes
-		newIface.RxDropped = iface.Drops
-		newIface.TxDropped = iface.Drops
 		newIface.RxPackets = iface.Rx.Packets
 		newIface.TxPackets = iface.Tx.Packets
 		newIface.TxErrors = iface.TxErrors
 		newIface.RxErrors = iface.RxErrors
+		// VPP counts as drops the packets received on the interface that the
+		// graph discarded, plus what the NIC could not take (no buffers,
+		// ring full). Packets that failed to go out are only counted as
+		// tx errors.
+		newIface.RxDropped = iface.Drops + iface.RxNoBuf + iface.RxMiss
+		newIface.TxDropped = iface.TxErrors
+		newIface.RxNoBuf = iface.RxNoBuf
+		newIface.RxMiss = iface.RxMiss
+		newIface.Punts = iface.Punts
+		newIface.RxIP4 = iface.IP4
+		newIface.RxIP6 = iface.IP6
+		newIface.RxUnicast = iface.RxUnicast.Packets
+		newIface.RxMulticast = iface.RxMulticast.Packets
+		newIface.RxBroadcast = iface.RxBroadcast.Packets
+		newIface.TxUnicastMiss = iface.TxUnicastMiss.Packets
+		newIface.TxMulticast = iface.TxMulticast.Packets
+		newIface.TxBroadcast = iface.TxBroadcast.Packets
+		if link, ok := links[iface.InterfaceName]; ok {
+			newIface.Speed = link.Speed / 1000
+			newIface.Duplex = link.Duplex
+			switch {
+			case link.LinkUp:
+				newIface.Oper = "up"
+			case link.AdminUp:
+				newIface.Oper = "lowerlayerdown"
+			default:
+				newIface.Oper = "down"
+			}
+		}
 		m.Ifaces = append(m.Ifaces, newIface)
 	}
 }
 
-func (m *Metric) StringInterfaces() string {
-	out := ""
-	for _, iface := range m.Ifaces {
-		out += fmt.Sprintf("guan_rx_bytes{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.RxBytes)
-		out += fmt.Sprintf("guan_tx_bytes{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.TxBytes)
-		out += fmt.Sprintf("guan_rx_drop_bytes{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.RxDropped)
-		out += fmt.Sprintf("guan_tx_drop_bytes{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.TxDropped)
-		out += fmt.Sprintf("guan_rx_pkt{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.RxPackets)
-		out += fmt.Sprintf("guan_tx_pkt{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.TxPackets)
-		out += fmt.Sprintf("guan_rx_error{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.RxErrors)
-		out += fmt.Sprintf("guan_tx_error{uuid=\"%s\",name=\"%s\"\n", m.UUID, iface.Name, iface.TxErrors)
-
-	}
-	return out
-}
-
 func (m *Metric) UpdateFilesystems() {
 	m.Disks = nil
 	partitions, err := disk.Partitions(false)
@@ -203,15 +349,6 @@ func (m *Metric) UpdateFilesystems() {
 	}
 }
 
-func (m *Metric) StringFilesystems() string {
-	out := ""
-	for _, fs := range m.Disks {
-		out += fmt.Sprintf("guan_free_disk_sec{uuid=\"%s\",dev=\"%s\",mount=\"%s\",} %f\n", m.UUID, fs.Device, fs.Mountpoint, fs.Free)
-		out += fmt.Sprintf("guan_size_disk_sec{uuid=\"%s\",dev=\"%s\",mount=\"%s\",} %f\n", m.UUID, fs.Device, fs.Mountpoint, fs.Size)
-	}
-	return out
-}
-
 func (m *Metric) LogMetrics() {
 	defer m.mtx.Unlock()
 	m.mtx.Lock()
@@ -225,10 +362,39 @@ func (m *Metric) LogMetrics() {
 }
 
 func (m *Metric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	m.Update()
+	if strings.HasPrefix(r.URL.Path, "/history") {
+		if m.History == nil {
+			http.Error(w, "history is disabled", http.StatusNotFound)
+			return
+		}
+		m.History.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/speedtest" {
+		m.serveSpeedTest(w, r)
+		return
+	}
+	if r.URL.Path == "/probes" {
+		if m.Prober == nil {
+			http.Error(w, "probes are disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, struct {
+			Uplinks map[string]bool    `json:"uplinks"`
+			Probes  []ping.ProbeStatus `json:"probes"`
+		}{m.Prober.Uplinks(), m.Prober.Status()})
+		return
+	}
 
 	defer m.mtx.Unlock()
 	m.mtx.Lock()
+	if r.URL.Path == "/metrics" {
+		w.Header().Set("Content-Type", promContentType)
+		if err := m.WritePrometheus(w); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error writing prometheus metrics")
+		}
+		return
+	}
 	data, err := json.Marshal(m)
 	if err != nil {
 		log.Println(err)
@@ -237,3 +403,10 @@ func (m *Metric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error encoding response")
+	}
+}
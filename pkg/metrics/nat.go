@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Only the hosts with the most sessions are reported.
+	maxNATHosts = 32
+	// Sessions are only dumped, to break them down by protocol, for the
+	// top hosts and at most every natDetailInterval. The session counts
+	// come from the users dump, aggregated by VPP.
+	natDetailHosts    = 8
+	natDetailInterval = 5 * time.Minute
+)
+
+type NATHost struct {
+	Address        string            `json:"addr"`
+	Sessions       uint32            `json:"sessions"`
+	StaticSessions uint32            `json:"static"`
+	Protocols      map[string]uint32 `json:"protocols,omitempty"`
+	Bytes          uint64            `json:"bytes,omitempty"`
+}
+
+/*
+NATStats describes the NAT44 translation table.
+
+MaxSessions is the size of the session table over all the threads,
+MaxSessionsPerHost the limit of each inside host. Hosts are the top talkers,
+sorted by session count. Protocols and bytes are only known for the first of
+them, as of Detailed.
+*/
+type NATStats struct {
+	Users              int               `json:"users"`
+	Sessions           uint64            `json:"sessions"`
+	StaticSessions     uint64            `json:"static"`
+	MaxSessions        uint64            `json:"max_sessions"`
+	MaxSessionsPerHost uint32            `json:"max_sessions_per_host"`
+	Protocols          map[string]uint64 `json:"protocols"`
+	PortAllocFailures  uint64            `json:"alloc_failures"`
+	SessionLimitDrops  uint64            `json:"limit_drops"`
+	Hosts              []NATHost         `json:"hosts"`
+	Detailed           time.Time         `json:"detailed,omitempty"`
+}
+
+func natProtocol(proto uint16) string {
+	switch proto {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// UpdateNAT dumps the NAT44 users and, now and then, the sessions of the top
+// ones; previous is the last snapshot, whose breakdown is kept meanwhile.
+// It runs after UpdateVPP, since the allocation failures come from the
+// error counters.
+func (m *Metric) UpdateNAT(previous NATStats) {
+	m.NAT = NATStats{}
+	if m.vppAPI == nil {
+		return
+	}
+	config, err := m.vppAPI.NATConfig()
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting NAT config")
+		return
+	}
+	threads := uint64(m.VPP.Workers)
+	if threads == 0 {
+		threads = 1
+	}
+	m.NAT.MaxSessions = uint64(config.MaxTranslationsPerThread) * threads
+	m.NAT.MaxSessionsPerHost = config.MaxTranslationsPerUser
+
+	users, err := m.vppAPI.NATUsers()
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error dumping NAT users")
+	}
+	m.NAT.Users = len(users)
+	for _, user := range users {
+		m.NAT.Sessions += uint64(user.Sessions)
+		m.NAT.StaticSessions += uint64(user.StaticSessions)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Sessions > users[j].Sessions })
+	if len(users) > maxNATHosts {
+		users = users[:maxNATHosts]
+	}
+
+	detail := time.Since(previous.Detailed) >= natDetailInterval
+	known := make(map[string]NATHost, len(previous.Hosts))
+	for _, host := range previous.Hosts {
+		known[host.Address] = host
+	}
+	if detail {
+		m.NAT.Protocols = make(map[string]uint64)
+		m.NAT.Detailed = time.Now()
+	} else {
+		m.NAT.Protocols = previous.Protocols
+		m.NAT.Detailed = previous.Detailed
+	}
+	for i, user := range users {
+		host := NATHost{
+			Address:        user.Address.String(),
+			Sessions:       user.Sessions,
+			StaticSessions: user.StaticSessions,
+		}
+		switch {
+		case detail && i < natDetailHosts:
+			host.Protocols = make(map[string]uint32)
+			sessions, err := m.vppAPI.NATUserSessions(user)
+			if err != nil {
+				log.WithFields(log.Fields{"module": moduleName, "host": host.Address, "error": err.Error()}).Errorln("Error dumping NAT sessions")
+			}
+			for _, session := range sessions {
+				proto := natProtocol(session.Protocol)
+				host.Protocols[proto]++
+				host.Bytes += session.Bytes
+				m.NAT.Protocols[proto]++
+			}
+		case !detail:
+			host.Protocols = known[host.Address].Protocols
+			host.Bytes = known[host.Address].Bytes
+		}
+		m.NAT.Hosts = append(m.NAT.Hosts, host)
+	}
+
+	// The NAT nodes count as errors the packets they could not translate,
+	// e.g. /err/nat44-ed-in2out-slowpath/out of ports.
+	for _, counter := range m.VPP.Errors {
+		name := strings.ToLower(counter.Name)
+		if !strings.Contains(name, "nat44") {
+			continue
+		}
+		switch {
+		case strings.Contains(name, "out of ports"), strings.Contains(name, "out of addresses"):
+			m.NAT.PortAllocFailures += counter.Count
+		case strings.Contains(name, "maximum") && strings.Contains(name, "sessions"):
+			m.NAT.SessionLimitDrops += counter.Count
+		}
+	}
+}
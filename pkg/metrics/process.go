@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// Daemons are the processes whose health is reported. They are found by
+// their PID file in PIDDir, or by name when they do not write one.
+var Daemons = []struct {
+	Name  string
+	Comms []string
+}{
+	{"vpp", []string{"vpp_main", "vpp"}},
+	{"wan-agent", []string{"wan-agent"}},
+	{"wan-connect", []string{"wan-connect"}},
+	{"wan-dhcp", []string{"wan-dhcp"}},
+	{"wan-dns", []string{"wan-dns"}},
+	{"wan-metrics", []string{"wan-metrics"}},
+}
+
+const PIDDir = "/etc/wan-data"
+
+type Process struct {
+	Name    string  `json:"name"`
+	PID     int32   `json:"pid,omitempty"`
+	Running bool    `json:"running"`
+	Uptime  uint64  `json:"upt,omitempty"` // seconds
+	RSS     uint64  `json:"rss,omitempty"` // bytes
+	Threads int32   `json:"threads,omitempty"`
+	CPU     float64 `json:"cpu,omitempty"` // percent, since the previous sample
+
+	// cpuTime is the CPU time used by the process at sampled, in seconds.
+	cpuTime float64
+	sampled time.Time
+}
+
+// found remembers the processes of the daemons that write no PID file, so
+// the whole process table is only walked when one of them restarts.
+var found = make(map[string]int32)
+
+func pidFromFile(name string) (int32, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(PIDDir, name+".pid"))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(pid), true
+}
+
+// UpdateProcesses samples the daemons. The CPU usage is computed against
+// previous, the samples of the last update.
+func (m *Metric) UpdateProcesses(previous []Process) {
+	m.Processes = nil
+	var all []*process.Process
+	for _, daemon := range Daemons {
+		proc := Process{Name: daemon.Name}
+		var p *process.Process
+		if pid, ok := pidFromFile(daemon.Name); ok {
+			// A stale PID file may point to an unrelated process.
+			if candidate, err := process.NewProcess(pid); err == nil && isDaemon(candidate, daemon.Comms) {
+				p = candidate
+			}
+		}
+		if p == nil {
+			if pid, ok := found[daemon.Name]; ok {
+				if candidate, err := process.NewProcess(pid); err == nil && isDaemon(candidate, daemon.Comms) {
+					p = candidate
+				} else {
+					delete(found, daemon.Name)
+				}
+			}
+		}
+		if p == nil {
+			if all == nil {
+				all, _ = process.Processes()
+			}
+			for _, candidate := range all {
+				if isDaemon(candidate, daemon.Comms) {
+					p = candidate
+					found[daemon.Name] = p.Pid
+					break
+				}
+			}
+		}
+		if p != nil {
+			proc.PID = p.Pid
+			proc.Running = true
+			if created, err := p.CreateTime(); err == nil {
+				proc.Uptime = uint64(time.Since(time.Unix(0, created*int64(time.Millisecond))) / time.Second)
+			}
+			if mem, err := p.MemoryInfo(); err == nil {
+				proc.RSS = mem.RSS
+			}
+			proc.Threads, _ = p.NumThreads()
+			if times, err := p.Times(); err == nil {
+				proc.cpuTime = times.User + times.System
+				proc.sampled = time.Now()
+				proc.CPU = cpuPercent(proc, previous)
+			}
+		}
+		m.Processes = append(m.Processes, proc)
+	}
+}
+
+// cpuPercent is the CPU used by proc since its previous sample, zero when
+// there is none or the process restarted in between.
+func cpuPercent(proc Process, previous []Process) float64 {
+	for _, prev := range previous {
+		if prev.Name != proc.Name || prev.PID != proc.PID || prev.sampled.IsZero() {
+			continue
+		}
+		elapsed := proc.sampled.Sub(prev.sampled).Seconds()
+		if elapsed <= 0 || proc.cpuTime < prev.cpuTime {
+			return 0
+		}
+		return 100 * (proc.cpuTime - prev.cpuTime) / elapsed
+	}
+	return 0
+}
+
+// isDaemon tells whether p still runs one of comms.
+func isDaemon(p *process.Process, comms []string) bool {
+	comm, err := p.Name()
+	return err == nil && hasComm(comms, comm)
+}
+
+func hasComm(comms []string, comm string) bool {
+	for _, c := range comms {
+		// The kernel truncates process names to 15 characters.
+		if c == comm || (len(comm) == 15 && strings.HasPrefix(c, comm)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,426 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	promPrefix      = "guan_"
+	promContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	promGauge   = "gauge"
+	promCounter = "counter"
+)
+
+type promSample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+type promFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []promSample
+}
+
+// promWriter gathers metric families, possibly from several routers, and
+// writes them in the Prometheus text exposition format, each family once.
+type promWriter struct {
+	families []*promFamily
+	byName   map[string]*promFamily
+}
+
+func newPromWriter() *promWriter {
+	return &promWriter{byName: make(map[string]*promFamily)}
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (p *promWriter) family(name, kind, help string, samples ...promSample) {
+	if len(samples) == 0 {
+		return
+	}
+	family, ok := p.byName[name]
+	if !ok {
+		family = &promFamily{name: promPrefix + name, kind: kind, help: help}
+		p.byName[name] = family
+		p.families = append(p.families, family)
+	}
+	family.samples = append(family.samples, samples...)
+}
+
+func (p *promWriter) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, family := range p.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			bw.WriteString(family.name)
+			if len(sample.labels) > 0 {
+				bw.WriteString("{")
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						bw.WriteString(",")
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", sample.labels[i], promEscaper.Replace(sample.labels[i+1]))
+				}
+				bw.WriteString("}")
+			}
+			fmt.Fprintf(bw, " %s\n", strconv.FormatFloat(sample.value, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+// WritePrometheus writes the last collected values in the Prometheus text
+// format. Every sample is labelled with the router uuid.
+func (m *Metric) WritePrometheus(w io.Writer) error {
+	return WritePrometheusAll(w, m)
+}
+
+// WritePrometheusAll writes the values of several routers in a single
+// exposition, as the controller does when re-exporting pushed snapshots.
+func WritePrometheusAll(w io.Writer, ms ...*Metric) error {
+	p := newPromWriter()
+	for _, m := range ms {
+		m.writeSystem(p)
+		m.writeHardware(p)
+		m.writeProcesses(p)
+		m.writeInterfaces(p)
+		m.writeFilesystems(p)
+		m.writeDNS(p)
+		m.writeResolver(p)
+		m.writeVPP(p)
+		m.writeNAT(p)
+		m.writeProbes(p)
+		m.writeSpeedTest(p)
+	}
+	return p.writeTo(w)
+}
+
+func (m *Metric) sample(value float64, labels ...string) promSample {
+	return promSample{labels: append([]string{"uuid", m.UUID}, labels...), value: value}
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (m *Metric) writeSystem(p *promWriter) {
+	p.family("uptime_seconds", promGauge, "Time since the router booted.", m.sample(m.Uptime.Seconds()))
+	p.family("memory_total_bytes", promGauge, "Total usable memory.", m.sample(float64(m.MemTotal*kB)))
+	p.family("memory_free_bytes", promGauge, "Free memory.", m.sample(float64(m.MemFree*kB)))
+	p.family("memory_buffers_bytes", promGauge, "Memory used by buffers.", m.sample(float64(m.MemBuff*kB)))
+	if len(m.Load) == 3 {
+		p.family("load1", promGauge, "1 minute load average.", m.sample(m.Load[0]))
+		p.family("load5", promGauge, "5 minutes load average.", m.sample(m.Load[1]))
+		p.family("load15", promGauge, "15 minutes load average.", m.sample(m.Load[2]))
+	}
+}
+
+func (m *Metric) ifaceFamily(p *promWriter, name, kind, help string, value func(Iface) float64) {
+	var samples []promSample
+	for _, iface := range m.Ifaces {
+		samples = append(samples, m.sample(value(iface), "interface", iface.Name))
+	}
+	p.family(name, kind, help, samples...)
+}
+
+// vppIfaceFamily is like ifaceFamily for the counters only VPP interfaces
+// have, so kernel interfaces are left out instead of reported as zero.
+func (m *Metric) vppIfaceFamily(p *promWriter, name, help string, value func(Iface) uint64) {
+	var samples []promSample
+	for _, iface := range m.Ifaces {
+		if !iface.VPP {
+			continue
+		}
+		samples = append(samples, m.sample(float64(value(iface)), "interface", iface.Name))
+	}
+	p.family(name, promCounter, help, samples...)
+}
+
+func (m *Metric) writeInterfaces(p *promWriter) {
+	m.ifaceFamily(p, "interface_rx_bytes_total", promCounter, "Bytes received.", func(i Iface) float64 { return float64(i.RxBytes) })
+	m.ifaceFamily(p, "interface_tx_bytes_total", promCounter, "Bytes sent.", func(i Iface) float64 { return float64(i.TxBytes) })
+	m.ifaceFamily(p, "interface_rx_packets_total", promCounter, "Packets received.", func(i Iface) float64 { return float64(i.RxPackets) })
+	m.ifaceFamily(p, "interface_tx_packets_total", promCounter, "Packets sent.", func(i Iface) float64 { return float64(i.TxPackets) })
+	m.ifaceFamily(p, "interface_rx_errors_total", promCounter, "Receive errors.", func(i Iface) float64 { return float64(i.RxErrors) })
+	m.ifaceFamily(p, "interface_tx_errors_total", promCounter, "Transmit errors.", func(i Iface) float64 { return float64(i.TxErrors) })
+	m.ifaceFamily(p, "interface_rx_dropped_total", promCounter, "Received packets dropped.", func(i Iface) float64 { return float64(i.RxDropped) })
+	m.ifaceFamily(p, "interface_tx_dropped_total", promCounter, "Packets dropped on transmit.", func(i Iface) float64 { return float64(i.TxDropped) })
+	m.vppIfaceFamily(p, "interface_rx_nobuf_total", "Packets dropped by the NIC for lack of buffers.", func(i Iface) uint64 { return i.RxNoBuf })
+	m.vppIfaceFamily(p, "interface_rx_miss_total", "Packets missed by the NIC because its ring was full.", func(i Iface) uint64 { return i.RxMiss })
+	m.vppIfaceFamily(p, "interface_punt_total", "Packets punted to the control plane.", func(i Iface) uint64 { return i.Punts })
+	m.vppIfaceFamily(p, "interface_rx_ip4_packets_total", "IPv4 packets received.", func(i Iface) uint64 { return i.RxIP4 })
+	m.vppIfaceFamily(p, "interface_rx_ip6_packets_total", "IPv6 packets received.", func(i Iface) uint64 { return i.RxIP6 })
+	m.vppIfaceFamily(p, "interface_rx_multicast_packets_total", "Multicast packets received.", func(i Iface) uint64 { return i.RxMulticast })
+	m.vppIfaceFamily(p, "interface_rx_broadcast_packets_total", "Broadcast packets received.", func(i Iface) uint64 { return i.RxBroadcast })
+	m.vppIfaceFamily(p, "interface_tx_multicast_packets_total", "Multicast packets sent.", func(i Iface) uint64 { return i.TxMulticast })
+	m.vppIfaceFamily(p, "interface_tx_broadcast_packets_total", "Broadcast packets sent.", func(i Iface) uint64 { return i.TxBroadcast })
+
+	m.ifaceFamily(p, "interface_rx_bits_per_second", promGauge, "Receive rate over the last collection interval.", func(i Iface) float64 { return i.RxBps })
+	m.ifaceFamily(p, "interface_tx_bits_per_second", promGauge, "Transmit rate over the last collection interval.", func(i Iface) float64 { return i.TxBps })
+	m.ifaceFamily(p, "interface_rx_packets_per_second", promGauge, "Received packets per second over the last collection interval.", func(i Iface) float64 { return i.RxPps })
+	m.ifaceFamily(p, "interface_tx_packets_per_second", promGauge, "Sent packets per second over the last collection interval.", func(i Iface) float64 { return i.TxPps })
+	m.ifaceFamily(p, "interface_rx_errors_per_second", promGauge, "Receive errors per second over the last collection interval.", func(i Iface) float64 { return i.RxErrorRate })
+	m.ifaceFamily(p, "interface_tx_errors_per_second", promGauge, "Transmit errors per second over the last collection interval.", func(i Iface) float64 { return i.TxErrorRate })
+
+	var up, speed, fullDuplex []promSample
+	for _, iface := range m.Ifaces {
+		if iface.Oper != "" {
+			up = append(up, m.sample(boolFloat(iface.Oper == "up"), "interface", iface.Name))
+		}
+		if iface.Speed > 0 {
+			speed = append(speed, m.sample(float64(iface.Speed)*1e6, "interface", iface.Name))
+		}
+		if iface.Duplex != "" {
+			fullDuplex = append(fullDuplex, m.sample(boolFloat(iface.Duplex == "full"), "interface", iface.Name))
+		}
+	}
+	p.family("interface_up", promGauge, "Whether the link is operationally up.", up...)
+	p.family("interface_speed_bits_per_second", promGauge, "Negotiated link speed.", speed...)
+	p.family("interface_full_duplex", promGauge, "Whether the link negotiated full duplex.", fullDuplex...)
+}
+
+func (m *Metric) writeHardware(p *promWriter) {
+	var temps, usage, freq []promSample
+	for _, sensor := range m.Sensors {
+		temps = append(temps, m.sample(sensor.Temp, "sensor", sensor.Name, "type", sensor.Type))
+	}
+	for _, core := range m.CPUs {
+		usage = append(usage, m.sample(core.Usage/100, "cpu", core.Name))
+		if core.Freq > 0 {
+			freq = append(freq, m.sample(core.Freq*1e6, "cpu", core.Name))
+		}
+	}
+	p.family("temperature_celsius", promGauge, "Temperature of the thermal zones and hardware sensors.", temps...)
+	p.family("cpu_usage_ratio", promGauge, "Busy time of each core over the last collection interval.", usage...)
+	p.family("cpu_frequency_hertz", promGauge, "Current frequency of each core.", freq...)
+
+	var total, free, reserved, surplus []promSample
+	for _, pages := range m.Hugepages {
+		size := strconv.FormatUint(pages.Size*kB, 10)
+		total = append(total, m.sample(float64(pages.Total), "size", size))
+		free = append(free, m.sample(float64(pages.Free), "size", size))
+		reserved = append(reserved, m.sample(float64(pages.Reserved), "size", size))
+		surplus = append(surplus, m.sample(float64(pages.Surplus), "size", size))
+	}
+	p.family("hugepages_total", promGauge, "Hugepages in the pool, by page size in bytes.", total...)
+	p.family("hugepages_free", promGauge, "Hugepages not allocated yet.", free...)
+	p.family("hugepages_reserved", promGauge, "Hugepages committed but not allocated yet.", reserved...)
+	p.family("hugepages_surplus", promGauge, "Hugepages allocated over the pool size.", surplus...)
+}
+
+func (m *Metric) writeProcesses(p *promWriter) {
+	var up, uptime, rss, threads []promSample
+	for _, proc := range m.Processes {
+		up = append(up, m.sample(boolFloat(proc.Running), "process", proc.Name))
+		if !proc.Running {
+			continue
+		}
+		uptime = append(uptime, m.sample(float64(proc.Uptime), "process", proc.Name))
+		rss = append(rss, m.sample(float64(proc.RSS), "process", proc.Name))
+		threads = append(threads, m.sample(float64(proc.Threads), "process", proc.Name))
+	}
+	p.family("process_up", promGauge, "Whether the daemon is running.", up...)
+	p.family("process_uptime_seconds", promGauge, "Time since the daemon started.", uptime...)
+	p.family("process_resident_memory_bytes", promGauge, "Resident memory of the daemon.", rss...)
+	p.family("process_threads", promGauge, "Threads of the daemon.", threads...)
+}
+
+func (m *Metric) writeFilesystems(p *promWriter) {
+	var size, free []promSample
+	for _, fs := range m.Disks {
+		size = append(size, m.sample(float64(fs.Size), "device", fs.Device, "mountpoint", fs.Mountpoint))
+		free = append(free, m.sample(float64(fs.Free), "device", fs.Device, "mountpoint", fs.Mountpoint))
+	}
+	p.family("filesystem_size_bytes", promGauge, "Filesystem size.", size...)
+	p.family("filesystem_free_bytes", promGauge, "Filesystem free space.", free...)
+}
+
+func (m *Metric) writeDNS(p *promWriter) {
+	p.family("pihole_domains_blocked", promGauge, "Domains on the Pi-hole blocklists.", m.sample(float64(m.DNS.BlockedDomains)))
+	p.family("pihole_queries_today", promGauge, "DNS queries received today.", m.sample(float64(m.DNS.TotalQueriesToday)))
+	p.family("pihole_blocked_today", promGauge, "DNS queries blocked today.", m.sample(float64(m.DNS.BlockedQueriesToday)))
+	p.family("pihole_forwarded_queries", promGauge, "DNS queries forwarded upstream today.", m.sample(float64(m.DNS.ForwardedQueries)))
+	p.family("pihole_cached_queries", promGauge, "DNS queries answered from cache today.", m.sample(float64(m.DNS.CachedQueries)))
+	p.family("pihole_unique_clients", promGauge, "Distinct clients seen today.", m.sample(float64(m.DNS.UniqueClients)))
+	if m.DNS.Status != "" {
+		p.family("pihole_blocking_enabled", promGauge, "Whether the Pi-hole is blocking.", m.sample(boolFloat(m.DNS.Status == "enabled")))
+	}
+
+	var domains, blocked, clients, types []promSample
+	for _, count := range m.DNS.TopDomains {
+		domains = append(domains, m.sample(float64(count.Count), "domain", count.Name))
+	}
+	for _, count := range m.DNS.TopBlocked {
+		blocked = append(blocked, m.sample(float64(count.Count), "domain", count.Name))
+	}
+	for _, count := range m.DNS.TopClients {
+		clients = append(clients, m.sample(float64(count.Count), "client", count.Name))
+	}
+	for _, name := range sortedKeys(m.DNS.QueryTypes) {
+		types = append(types, m.sample(m.DNS.QueryTypes[name]/100, "type", name))
+	}
+	p.family("pihole_top_domain_queries", promGauge, "Queries today of the most queried domains.", domains...)
+	p.family("pihole_top_blocked_queries", promGauge, "Queries today of the most blocked domains.", blocked...)
+	p.family("pihole_top_client_queries", promGauge, "Queries today of the most active clients.", clients...)
+	p.family("pihole_query_type_ratio", promGauge, "Share of the queries of each type.", types...)
+}
+
+func (m *Metric) writeResolver(p *promWriter) {
+	r := m.Resolver
+	if r == nil {
+		return
+	}
+	p.family("resolver_queries_total", promCounter, "Queries received by the local resolver.", m.sample(float64(r.Queries)))
+	p.family("resolver_local_answers_total", promCounter, "Queries answered from local records.", m.sample(float64(r.Local)))
+	p.family("resolver_cache_hits_total", promCounter, "Queries answered from the cache.", m.sample(float64(r.CacheHits)))
+	p.family("resolver_forwarded_total", promCounter, "Queries answered by an upstream.", m.sample(float64(r.Forwarded)))
+	p.family("resolver_failures_total", promCounter, "Queries no upstream could answer.", m.sample(float64(r.Failures)))
+	p.family("resolver_cache_entries", promGauge, "Answers in the cache.", m.sample(float64(r.CacheSize)))
+
+	var queries, errors, rtt []promSample
+	for _, u := range r.Upstreams {
+		queries = append(queries, m.sample(float64(u.Queries), "upstream", u.Addr))
+		errors = append(errors, m.sample(float64(u.Errors), "upstream", u.Addr))
+		rtt = append(rtt, m.sample(u.RTT/1000, "upstream", u.Addr))
+	}
+	p.family("resolver_upstream_queries_total", promCounter, "Queries forwarded to each upstream.", queries...)
+	p.family("resolver_upstream_errors_total", promCounter, "Queries forwarded to each upstream that failed.", errors...)
+	p.family("resolver_upstream_rtt_seconds", promGauge, "Average response time of each upstream.", rtt...)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Metric) writeVPP(p *promWriter) {
+	if len(m.VPP.Nodes)+len(m.VPP.Buffers)+len(m.VPP.WorkerVectorRates) == 0 {
+		return
+	}
+	p.family("vpp_vector_rate", promGauge, "Vectors processed per main loop.", m.sample(m.VPP.VectorRate))
+	p.family("vpp_input_rate", promGauge, "Input vectors per second.", m.sample(m.VPP.InputRate))
+	p.family("vpp_workers", promGauge, "Number of worker threads.", m.sample(float64(m.VPP.Workers)))
+	var workers []promSample
+	for i, rate := range m.VPP.WorkerVectorRates {
+		workers = append(workers, m.sample(rate, "worker", strconv.Itoa(i)))
+	}
+	p.family("vpp_worker_vector_rate", promGauge, "Vectors processed per loop by each thread.", workers...)
+
+	var calls, vectors, clocks, suspends, vpc, cpv []promSample
+	for _, node := range m.VPP.Nodes {
+		calls = append(calls, m.sample(float64(node.Calls), "node", node.Name))
+		vectors = append(vectors, m.sample(float64(node.Vectors), "node", node.Name))
+		clocks = append(clocks, m.sample(float64(node.Clocks), "node", node.Name))
+		suspends = append(suspends, m.sample(float64(node.Suspends), "node", node.Name))
+		vpc = append(vpc, m.sample(node.VectorsPerCall, "node", node.Name))
+		cpv = append(cpv, m.sample(node.ClocksPerVector, "node", node.Name))
+	}
+	p.family("vpp_node_calls_total", promCounter, "Times the graph node was dispatched.", calls...)
+	p.family("vpp_node_vectors_total", promCounter, "Packets processed by the graph node.", vectors...)
+	p.family("vpp_node_clocks_total", promCounter, "CPU clocks spent in the graph node.", clocks...)
+	p.family("vpp_node_suspends_total", promCounter, "Times the process node was suspended.", suspends...)
+	p.family("vpp_node_vectors_per_call", promGauge, "Packets per dispatch over the last collection interval.", vpc...)
+	p.family("vpp_node_clocks_per_vector", promGauge, "CPU clocks per packet over the last collection interval.", cpv...)
+
+	var errors []promSample
+	for _, counter := range m.VPP.Errors {
+		errors = append(errors, m.sample(float64(counter.Count), "counter", counter.Name))
+	}
+	p.family("vpp_errors_total", promCounter, "VPP error counters.", errors...)
+
+	var cached, used, available []promSample
+	for _, pool := range m.VPP.Buffers {
+		cached = append(cached, m.sample(pool.Cached, "pool", pool.Name))
+		used = append(used, m.sample(pool.Used, "pool", pool.Name))
+		available = append(available, m.sample(pool.Available, "pool", pool.Name))
+	}
+	p.family("vpp_buffers_cached", promGauge, "Buffers cached by the threads.", cached...)
+	p.family("vpp_buffers_used", promGauge, "Buffers in use.", used...)
+	p.family("vpp_buffers_available", promGauge, "Buffers available.", available...)
+}
+
+func (m *Metric) writeNAT(p *promWriter) {
+	if m.NAT.MaxSessions == 0 {
+		return
+	}
+	p.family("nat44_users", promGauge, "Inside hosts with NAT sessions.", m.sample(float64(m.NAT.Users)))
+	p.family("nat44_sessions", promGauge, "NAT sessions.", m.sample(float64(m.NAT.Sessions)))
+	p.family("nat44_static_sessions", promGauge, "NAT sessions created by static mappings.", m.sample(float64(m.NAT.StaticSessions)))
+	p.family("nat44_max_sessions", promGauge, "Size of the NAT session table.", m.sample(float64(m.NAT.MaxSessions)))
+	p.family("nat44_max_sessions_per_host", promGauge, "NAT sessions allowed to each inside host.", m.sample(float64(m.NAT.MaxSessionsPerHost)))
+	p.family("nat44_alloc_failures_total", promCounter, "Translations that failed for lack of outside ports or addresses.", m.sample(float64(m.NAT.PortAllocFailures)))
+	p.family("nat44_session_limit_drops_total", promCounter, "Packets dropped because a session limit was reached.", m.sample(float64(m.NAT.SessionLimitDrops)))
+
+	var protocols []promSample
+	for proto, sessions := range m.NAT.Protocols {
+		protocols = append(protocols, m.sample(float64(sessions), "protocol", proto))
+	}
+	sort.Slice(protocols, func(i, j int) bool { return protocols[i].labels[3] < protocols[j].labels[3] })
+	p.family("nat44_protocol_sessions", promGauge, "NAT sessions of the top hosts by protocol.", protocols...)
+
+	var hosts []promSample
+	for _, host := range m.NAT.Hosts {
+		hosts = append(hosts, m.sample(float64(host.Sessions), "host", host.Address))
+	}
+	p.family("nat44_host_sessions", promGauge, "NAT sessions of each inside host.", hosts...)
+}
+
+func (m *Metric) writeProbes(p *promWriter) {
+	var uplinks []promSample
+	for name, healthy := range m.Uplinks {
+		uplinks = append(uplinks, m.sample(boolFloat(healthy), "uplink", name))
+	}
+	sort.Slice(uplinks, func(i, j int) bool { return uplinks[i].labels[3] < uplinks[j].labels[3] })
+	p.family("uplink_up", promGauge, "Whether at least one probe of the uplink is healthy.", uplinks...)
+
+	var up, sent, loss, jitter, rtt []promSample
+	for _, probe := range m.Probes {
+		labels := []string{"uplink", probe.Uplink, "type", probe.Type, "target", probe.Target}
+		up = append(up, m.sample(boolFloat(probe.Healthy), labels...))
+		for _, stats := range probe.Windows {
+			windowed := append(append([]string(nil), labels...), "window", stats.Window)
+			sent = append(sent, m.sample(float64(stats.Sent), windowed...))
+			loss = append(loss, m.sample(stats.Loss/100, windowed...))
+			jitter = append(jitter, m.sample(stats.Jitter/1000, windowed...))
+			if stats.Sent == stats.Lost {
+				continue
+			}
+			for _, q := range []struct {
+				quantile string
+				value    float64
+			}{{"0.5", stats.P50}, {"0.9", stats.P90}, {"0.99", stats.P99}} {
+				rtt = append(rtt, m.sample(q.value/1000, append(append([]string(nil), windowed...), "quantile", q.quantile)...))
+			}
+		}
+	}
+	p.family("probe_up", promGauge, "Whether the loss and latency of the probe are within its limits.", up...)
+	p.family("probe_sent", promGauge, "Probes sent in the window.", sent...)
+	p.family("probe_loss_ratio", promGauge, "Ratio of probes lost in the window.", loss...)
+	p.family("probe_jitter_seconds", promGauge, "Mean RTT difference between consecutive probes in the window.", jitter...)
+	p.family("probe_rtt_seconds", promGauge, "Round trip time quantiles in the window.", rtt...)
+}
+
+func (m *Metric) writeSpeedTest(p *promWriter) {
+	if m.SpeedTest == nil || m.SpeedTest.Error != "" {
+		return
+	}
+	p.family("speedtest_download_bits_per_second", promGauge, "Download throughput of the last speed test.", m.sample(m.SpeedTest.DownloadBps))
+	p.family("speedtest_upload_bits_per_second", promGauge, "Upload throughput of the last speed test.", m.sample(m.SpeedTest.UploadBps))
+	p.family("speedtest_timestamp_seconds", promGauge, "When the last speed test ran.", m.sample(float64(m.SpeedTest.Time.Unix())))
+}
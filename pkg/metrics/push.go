@@ -0,0 +1,273 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PushPath is where the controller ingests the snapshots pushed by routers.
+const PushPath = "/api/v1/metrics"
+
+// Pusher sends batches of snapshots to the controller through the
+// wan-connect socket. Snapshots that could not be delivered are kept, up to
+// MaxBufferedBytes, in memory and in SpoolPath, and are replayed oldest
+// first. The spool is only written when a push fails, and emptied once
+// everything was delivered.
+type Pusher struct {
+	Socket           string
+	SpoolPath        string
+	BatchSize        int
+	MaxBufferedBytes int
+	mtx              sync.Mutex        // protects incoming
+	incoming         []json.RawMessage // snapshots enqueued since the last flush
+	flushMtx         sync.Mutex        // protects queue
+	queue            []json.RawMessage
+	spooled          int  // snapshots at the head of queue also in the spool
+	stale            bool // the spool holds snapshots no longer in queue
+	client           *http.Client
+}
+
+func NewPusher(socket, spoolPath string) *Pusher {
+	p := &Pusher{
+		Socket:           socket,
+		SpoolPath:        spoolPath,
+		BatchSize:        60,
+		MaxBufferedBytes: 8 * kB * kB,
+	}
+	p.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", p.Socket)
+			},
+		},
+	}
+	if err := p.loadSpool(); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error reading metrics spool")
+	}
+	return p
+}
+
+func (p *Pusher) loadSpool() error {
+	if p.SpoolPath == "" {
+		return nil
+	}
+	f, err := os.Open(p.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*kB), 16*kB*kB)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if json.Valid(line) {
+			p.queue = append(p.queue, line)
+		}
+	}
+	p.spooled = len(p.queue)
+	p.trim()
+	return scanner.Err()
+}
+
+func encodeSpool(snapshots []json.RawMessage) []byte {
+	var buffer bytes.Buffer
+	for _, snapshot := range snapshots {
+		buffer.Write(snapshot)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// appendSpool adds the snapshots of the queue not spooled yet, one per
+// line, to the spool.
+func (p *Pusher) appendSpool() error {
+	snapshots := p.queue[p.spooled:]
+	if len(snapshots) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(p.SpoolPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(encodeSpool(snapshots))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		p.spooled = len(p.queue)
+	}
+	return err
+}
+
+// saveSpool writes the pending snapshots, replacing the previous spool
+// atomically.
+func (p *Pusher) saveSpool() error {
+	tmp := p.SpoolPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, encodeSpool(p.queue), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.SpoolPath); err != nil {
+		return err
+	}
+	p.spooled = len(p.queue)
+	p.stale = false
+	return nil
+}
+
+// syncSpool makes the spool hold the snapshots left after a flush: it is
+// emptied once every snapshot was delivered, and otherwise only the new
+// ones are appended, unless some spooled ones were delivered or dropped
+// meanwhile and it has to be rewritten.
+func (p *Pusher) syncSpool() error {
+	if p.SpoolPath == "" {
+		return nil
+	}
+	if len(p.queue) == 0 {
+		if p.spooled == 0 && !p.stale {
+			return nil
+		}
+		if err := os.Truncate(p.SpoolPath, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		p.spooled = 0
+		p.stale = false
+		return nil
+	}
+	if p.stale {
+		return p.saveSpool()
+	}
+	return p.appendSpool()
+}
+
+// drop removes the n oldest snapshots of the queue.
+func (p *Pusher) drop(n int) {
+	p.queue = p.queue[n:]
+	if p.spooled > 0 {
+		p.stale = true
+		p.spooled -= n
+		if p.spooled < 0 {
+			p.spooled = 0
+		}
+	}
+}
+
+// limit returns how many of the oldest snapshots must be dropped to keep
+// the others under MaxBufferedBytes.
+func (p *Pusher) limit(snapshots []json.RawMessage) int {
+	size := 0
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		size += len(snapshots[i])
+		if size > p.MaxBufferedBytes {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (p *Pusher) trim() {
+	if dropped := p.limit(p.queue); dropped > 0 {
+		p.drop(dropped)
+		log.WithFields(log.Fields{"module": moduleName}).Warnf("Metrics buffer full, dropped %d snapshots", dropped)
+	}
+}
+
+// Pending returns how many snapshots are waiting to be delivered.
+func (p *Pusher) Pending() int {
+	p.flushMtx.Lock()
+	pending := len(p.queue)
+	p.flushMtx.Unlock()
+	p.mtx.Lock()
+	pending += len(p.incoming)
+	p.mtx.Unlock()
+	return pending
+}
+
+// Enqueue adds a snapshot to the next batch.
+func (p *Pusher) Enqueue(m *Metric) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error encoding snapshot")
+		return
+	}
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	p.incoming = append(p.incoming, data)
+	if dropped := p.limit(p.incoming); dropped > 0 {
+		p.incoming = p.incoming[dropped:]
+	}
+}
+
+func (p *Pusher) send(batch []json.RawMessage) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post("http://controller"+PushPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("controller answered %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// Flush sends every pending snapshot in batches of BatchSize. It stops at
+// the first failure and spools what is left.
+func (p *Pusher) Flush() error {
+	defer p.flushMtx.Unlock()
+	p.flushMtx.Lock()
+	p.mtx.Lock()
+	incoming := p.incoming
+	p.incoming = nil
+	p.mtx.Unlock()
+	p.queue = append(p.queue, incoming...)
+	p.trim()
+
+	var err error
+	for len(p.queue) > 0 {
+		n := p.BatchSize
+		if n > len(p.queue) {
+			n = len(p.queue)
+		}
+		if err = p.send(p.queue[:n]); err != nil {
+			break
+		}
+		p.drop(n)
+	}
+	if spoolErr := p.syncSpool(); spoolErr != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": spoolErr.Error()}).Errorln("Error writing metrics spool")
+	}
+	return err
+}
+
+// Run flushes the pending snapshots every interval until stop is closed.
+func (p *Pusher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := p.Flush(); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnf("Unable to push metrics, %d snapshots pending", p.Pending())
+		}
+	}
+}
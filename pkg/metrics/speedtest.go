@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/maesoser/wan-controller/pkg/speedtest"
+	log "github.com/sirupsen/logrus"
+)
+
+// RecordSpeedTest stores a speed test result in the history when it
+// finishes. Snapshots carry the last result until the next test.
+func (m *Metric) RecordSpeedTest(result speedtest.Result) {
+	if m.History == nil || result.Error != "" {
+		return
+	}
+	for series, value := range map[string]float64{
+		"speedtest.download_bps": result.DownloadBps,
+		"speedtest.upload_bps":   result.UploadBps,
+	} {
+		if err := m.History.Add(series, result.Time, value); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "series": series, "error": err.Error()}).Errorln("Error writing history")
+		}
+	}
+}
+
+/*
+serveSpeedTest returns the last result, or runs a test and waits for it:
+
+	GET  /speedtest
+	POST /speedtest
+*/
+func (m *Metric) serveSpeedTest(w http.ResponseWriter, r *http.Request) {
+	if m.SpeedTester == nil {
+		http.Error(w, "speed tests are disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, m.SpeedTester.Last())
+	case "POST":
+		result, err := m.SpeedTester.Trigger(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"sort"
+
+	"git.fd.io/govpp.git/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// VPPNode holds the runtime counters of a graph node. VectorsPerCall and
+// ClocksPerVector are computed over the last collection interval once a
+// previous snapshot exists, and over the node lifetime before that.
+type VPPNode struct {
+	Name            string  `json:"name"`
+	Calls           uint64  `json:"calls"`
+	Vectors         uint64  `json:"vectors"`
+	Clocks          uint64  `json:"clocks"`
+	Suspends        uint64  `json:"suspends"`
+	VectorsPerCall  float64 `json:"vpc"`
+	ClocksPerVector float64 `json:"cpv"`
+}
+
+type VPPError struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type VPPBufferPool struct {
+	Name      string  `json:"name"`
+	Cached    float64 `json:"cached"`
+	Used      float64 `json:"used"`
+	Available float64 `json:"available"`
+}
+
+type VPPStats struct {
+	VectorRate        float64         `json:"vector_rate"`
+	InputRate         float64         `json:"input_rate"`
+	Workers           int             `json:"workers"`
+	WorkerVectorRates []float64       `json:"worker_vector_rates"`
+	Nodes             []VPPNode       `json:"nodes"`
+	Errors            []VPPError      `json:"errors"`
+	Buffers           []VPPBufferPool `json:"buffers"`
+}
+
+func (m *Metric) UpdateVPP() {
+	m.VPP = VPPStats{}
+	if m.vppConnection == nil {
+		return
+	}
+	m.updateVPPSystem()
+	m.updateVPPNodes()
+	m.updateVPPErrors()
+	m.updateVPPBuffers()
+}
+
+func (m *Metric) updateVPPSystem() {
+	stats := new(api.SystemStats)
+	if err := m.vppConnection.GetSystemStats(stats); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting VPP system stats")
+		return
+	}
+	m.VPP.VectorRate = float64(stats.VectorRate)
+	m.VPP.InputRate = float64(stats.InputRate)
+	m.VPP.Workers = int(stats.NumWorkerThreads)
+	for _, rate := range stats.VectorRatePerWorker {
+		m.VPP.WorkerVectorRates = append(m.VPP.WorkerVectorRates, float64(rate))
+	}
+}
+
+// updateVPPNodes keeps only the nodes that have been called at least once,
+// most of the graph is idle on a router.
+func (m *Metric) updateVPPNodes() {
+	stats := new(api.NodeStats)
+	if err := m.vppConnection.GetNodeStats(stats); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting VPP node stats")
+		return
+	}
+	for _, node := range stats.Nodes {
+		if node.Calls == 0 {
+			continue
+		}
+		m.VPP.Nodes = append(m.VPP.Nodes, VPPNode{
+			Name:     node.NodeName,
+			Calls:    node.Calls,
+			Vectors:  node.Vectors,
+			Clocks:   node.Clocks,
+			Suspends: node.Suspends,
+		})
+	}
+	sort.Slice(m.VPP.Nodes, func(i, j int) bool { return m.VPP.Nodes[i].Name < m.VPP.Nodes[j].Name })
+	computeNodeRates(m.VPP.Nodes, nil)
+}
+
+// updateVPPErrors keeps only the counters that are not zero.
+func (m *Metric) updateVPPErrors() {
+	stats := new(api.ErrorStats)
+	if err := m.vppConnection.GetErrorStats(stats); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting VPP error counters")
+		return
+	}
+	for _, counter := range stats.Errors {
+		if counter.Value == 0 {
+			continue
+		}
+		m.VPP.Errors = append(m.VPP.Errors, VPPError{Name: counter.CounterName, Count: counter.Value})
+	}
+	sort.Slice(m.VPP.Errors, func(i, j int) bool { return m.VPP.Errors[i].Name < m.VPP.Errors[j].Name })
+}
+
+func (m *Metric) updateVPPBuffers() {
+	stats := new(api.BufferStats)
+	if err := m.vppConnection.GetBufferStats(stats); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error getting VPP buffer stats")
+		return
+	}
+	for name, pool := range stats.Buffer {
+		m.VPP.Buffers = append(m.VPP.Buffers, VPPBufferPool{
+			Name:      name,
+			Cached:    pool.Cached,
+			Used:      pool.Used,
+			Available: pool.Available,
+		})
+	}
+	sort.Slice(m.VPP.Buffers, func(i, j int) bool { return m.VPP.Buffers[i].Name < m.VPP.Buffers[j].Name })
+}
+
+// computeNodeRates fills the per-call and per-vector averages of cur, over
+// the interval since prev when the node was already there.
+func computeNodeRates(cur, prev []VPPNode) {
+	previous := make(map[string]VPPNode, len(prev))
+	for _, node := range prev {
+		previous[node.Name] = node
+	}
+	for i := range cur {
+		node := &cur[i]
+		calls, vectors, clocks := node.Calls, node.Vectors, node.Clocks
+		if p, ok := previous[node.Name]; ok {
+			if node.Calls == p.Calls {
+				// Idle since the last collection.
+				node.VectorsPerCall, node.ClocksPerVector = 0, 0
+				continue
+			}
+			calls = counterDelta(node.Calls, p.Calls)
+			vectors = counterDelta(node.Vectors, p.Vectors)
+			clocks = counterDelta(node.Clocks, p.Clocks)
+		}
+		if calls > 0 {
+			node.VectorsPerCall = float64(vectors) / float64(calls)
+		}
+		if vectors > 0 {
+			node.ClocksPerVector = float64(clocks) / float64(vectors)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Package pihole talks to the admin API of a Pi-hole v5 (/admin/api.php) to
+read its statistics and manage blocking, domain lists and adlists.
+*/
+package pihole
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultAddr = "127.0.0.1:8993"
+
+// Lists managed through the API.
+const (
+	Allow      = "white"
+	Deny       = "black"
+	RegexAllow = "regex_white"
+	RegexDeny  = "regex_black"
+	Adlist     = "adlist"
+)
+
+// ErrUnauthorized is returned when the token is missing or wrong, the API
+// then answers an empty array.
+var ErrUnauthorized = errors.New("pihole: unauthorized, check the api token")
+
+type GravityStatus struct {
+	FileExist  bool        `json:"file_exists"`
+	AbsoluteTS uint64      `json:"absolute"`
+	RelativeTS interface{} `json:"relative"`
+}
+
+type Summary struct {
+	BlockedDomains      uint64        `json:"domains_being_blocked"`
+	TotalQueriesToday   uint64        `json:"dns_queries_today"`
+	BlockedQueriesToday uint64        `json:"ads_blocked_today"`
+	BlockedPcntToday    float64       `json:"ads_percentage_today"`
+	UniqueDomains       uint64        `json:"unique_domains"`
+	ForwardedQueries    uint64        `json:"queries_forwarded"`
+	CachedQueries       uint64        `json:"queries_cached"`
+	ClientsEverSeen     uint64        `json:"clients_ever_seen"`
+	UniqueClients       uint64        `json:"clients_unique"`
+	TotalQueries        uint64        `json:"dns_queries_all_types"`
+	NODATAReplies       uint64        `json:"reply_NODATA"`
+	NXDOMAINReplies     uint64        `json:"reply_NXDOMAIN"`
+	CNAMEReplies        uint64        `json:"reply_CNAME"`
+	IPReplies           uint64        `json:"reply_IP"`
+	PrivacyLevel        uint64        `json:"privacy_level"`
+	Status              string        `json:"status"`
+	GravityStatus       GravityStatus `json:"gravity_last_updated"`
+}
+
+// Count is the number of queries of a domain or client.
+type Count struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type Client struct {
+	Addr  string
+	Token string
+	http  *http.Client
+}
+
+func NewClient(addr, token string) *Client {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	return &Client{
+		Addr:  addr,
+		Token: token,
+		http: &http.Client{
+			Timeout: time.Second * 5,
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					Timeout: 5 * time.Second,
+				}).Dial,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+		},
+	}
+}
+
+// call sends a request to api.php and decodes the answer into v. Only the
+// summary can be read without the token.
+func (c *Client) call(params url.Values, auth bool, v interface{}) error {
+	if auth {
+		if c.Token == "" {
+			return ErrUnauthorized
+		}
+		params.Set("auth", c.Token)
+	}
+	response, err := c.http.Get("http://" + c.Addr + "/admin/api.php?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("pihole: %s", response.Status)
+	}
+	if strings.TrimSpace(string(body)) == "[]" {
+		return ErrUnauthorized
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *Client) Summary() (Summary, error) {
+	var summary Summary
+	err := c.call(url.Values{"summaryRaw": {""}}, false, &summary)
+	return summary, err
+}
+
+func (c *Client) Enable() error {
+	return c.call(url.Values{"enable": {""}}, true, nil)
+}
+
+// Disable stops blocking for d, or until Enable when d is zero.
+func (c *Client) Disable(d time.Duration) error {
+	seconds := ""
+	if d > 0 {
+		seconds = strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	}
+	return c.call(url.Values{"disable": {seconds}}, true, nil)
+}
+
+type listEntry struct {
+	Domain  string `json:"domain,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// List returns the entries of one of the lists, the addresses for Adlist.
+func (c *Client) List(list string) ([]string, error) {
+	var reply struct {
+		Data []listEntry `json:"data"`
+	}
+	if err := c.call(url.Values{"list": {list}}, true, &reply); err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, entry := range reply.Data {
+		if entry.Address != "" {
+			entries = append(entries, entry.Address)
+		} else {
+			entries = append(entries, entry.Domain)
+		}
+	}
+	return entries, nil
+}
+
+type listReply struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+func (c *Client) editList(list, op, entry string) error {
+	var reply listReply
+	if err := c.call(url.Values{"list": {list}, op: {entry}}, true, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("pihole: %s %s: %s", list, entry, reply.Message)
+	}
+	return nil
+}
+
+func (c *Client) Add(list, entry string) error {
+	return c.editList(list, "add", entry)
+}
+
+func (c *Client) Remove(list, entry string) error {
+	return c.editList(list, "sub", entry)
+}
+
+// SyncList adds and removes entries so that list holds exactly want.
+func (c *Client) SyncList(list string, want []string) error {
+	have, err := c.List(list)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(want))
+	for _, entry := range want {
+		wanted[entry] = true
+	}
+	for _, entry := range have {
+		if wanted[entry] {
+			delete(wanted, entry)
+			continue
+		}
+		if err := c.Remove(list, entry); err != nil {
+			return err
+		}
+	}
+	for _, entry := range want {
+		if !wanted[entry] {
+			continue
+		}
+		delete(wanted, entry)
+		if err := c.Add(list, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PHP encodes empty associative arrays as [], so the maps of the API come
+// as either an object or an empty array.
+type counts map[string]uint64
+
+func (c *counts) UnmarshalJSON(data []byte) error {
+	if isEmptyArray(data) {
+		*c = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]uint64)(c))
+}
+
+type percents map[string]float64
+
+func (p *percents) UnmarshalJSON(data []byte) error {
+	if isEmptyArray(data) {
+		*p = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]float64)(p))
+}
+
+func isEmptyArray(data []byte) bool {
+	return strings.Join(strings.Fields(string(data)), "") == "[]"
+}
+
+func sortCounts(counts map[string]uint64) []Count {
+	list := make([]Count, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, Count{Name: name, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// TopDomains returns the n most queried and the n most blocked domains of
+// the day.
+func (c *Client) TopDomains(n int) ([]Count, []Count, error) {
+	var reply struct {
+		Queries counts `json:"top_queries"`
+		Ads     counts `json:"top_ads"`
+	}
+	if err := c.call(url.Values{"topItems": {strconv.Itoa(n)}}, true, &reply); err != nil {
+		return nil, nil, err
+	}
+	return sortCounts(reply.Queries), sortCounts(reply.Ads), nil
+}
+
+// TopClients returns the n clients that sent more queries today, named
+// "hostname|address" when they resolve.
+func (c *Client) TopClients(n int) ([]Count, error) {
+	var reply struct {
+		Sources counts `json:"top_sources"`
+	}
+	if err := c.call(url.Values{"getQuerySources": {strconv.Itoa(n)}}, true, &reply); err != nil {
+		return nil, err
+	}
+	return sortCounts(reply.Sources), nil
+}
+
+// QueryTypes returns the share of every query type, in percent.
+func (c *Client) QueryTypes() (map[string]float64, error) {
+	var reply struct {
+		Types percents `json:"querytypes"`
+	}
+	if err := c.call(url.Values{"getQueryTypes": {""}}, true, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Types, nil
+}
@@ -0,0 +1,152 @@
+package pihole
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, token string) (*StandIn, *Client) {
+	standIn := NewStandIn("secret")
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+	return standIn, NewClient(strings.TrimPrefix(server.URL, "http://"), token)
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, client := newTestClient(t, "wrong")
+	if _, err := client.Summary(); err != nil {
+		t.Fatalf("summary needs no token: %v", err)
+	}
+	if err := client.Enable(); err != ErrUnauthorized {
+		t.Fatalf("got %v, want %v", err, ErrUnauthorized)
+	}
+	client.Token = ""
+	if _, err := client.List(Deny); err != ErrUnauthorized {
+		t.Fatalf("got %v, want %v", err, ErrUnauthorized)
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	_, client := newTestClient(t, "secret")
+	tests := []struct {
+		name   string
+		apply  func() error
+		status string
+	}{
+		{"disable", func() error { return client.Disable(0) }, "disabled"},
+		{"enable", client.Enable, "enabled"},
+		{"disable for a while", func() error { return client.Disable(time.Minute) }, "disabled"},
+	}
+	for _, tt := range tests {
+		if err := tt.apply(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		summary, err := client.Summary()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if summary.Status != tt.status {
+			t.Errorf("%s: got status %q, want %q", tt.name, summary.Status, tt.status)
+		}
+	}
+}
+
+func TestSyncList(t *testing.T) {
+	_, client := newTestClient(t, "secret")
+	steps := [][]string{
+		{"ads.example.com", "tracker.example.com"},
+		{"tracker.example.com", "more.example.com"},
+		nil,
+	}
+	for _, want := range steps {
+		if err := client.SyncList(Deny, want); err != nil {
+			t.Fatal(err)
+		}
+		have, err := client.List(Deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameEntries(have, want) {
+			t.Errorf("got %v, want %v", have, want)
+		}
+	}
+	if err := client.Add(Deny, "a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Add(Deny, "a.example.com"); err == nil {
+		t.Error("adding a duplicate did not fail")
+	}
+	if err := client.Remove(Deny, "b.example.com"); err == nil {
+		t.Error("removing a missing entry did not fail")
+	}
+}
+
+func sameEntries(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, entry := range a {
+		seen[entry] = true
+	}
+	for _, entry := range b {
+		if !seen[entry] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStatistics(t *testing.T) {
+	standIn, client := newTestClient(t, "secret")
+
+	// Empty maps come as [].
+	queries, ads, err := client.TopDomains(10)
+	if err != nil || len(queries) != 0 || len(ads) != 0 {
+		t.Fatalf("got %v %v %v, want no domains", queries, ads, err)
+	}
+	clients, err := client.TopClients(10)
+	if err != nil || len(clients) != 0 {
+		t.Fatalf("got %v %v, want no clients", clients, err)
+	}
+	types, err := client.QueryTypes()
+	if err != nil || len(types) != 0 {
+		t.Fatalf("got %v %v, want no types", types, err)
+	}
+
+	standIn.Queries["a.example.com"] = 5
+	standIn.Queries["b.example.com"] = 9
+	standIn.Queries["c.example.com"] = 1
+	standIn.Ads["ads.example.com"] = 3
+	standIn.Sources["host|192.168.2.10"] = 7
+	standIn.Types["A (IPv4)"] = 75
+	standIn.Types["AAAA (IPv6)"] = 25
+
+	queries, ads, err = client.TopDomains(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Count{{"b.example.com", 9}, {"a.example.com", 5}}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("got queries %v, want %v", queries, want)
+	}
+	if want := []Count{{"ads.example.com", 3}}; !reflect.DeepEqual(ads, want) {
+		t.Errorf("got ads %v, want %v", ads, want)
+	}
+	clients, err = client.TopClients(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Count{{"host|192.168.2.10", 7}}; !reflect.DeepEqual(clients, want) {
+		t.Errorf("got clients %v, want %v", clients, want)
+	}
+	types, err = client.QueryTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"A (IPv4)": 75, "AAAA (IPv6)": 25}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got types %v, want %v", types, want)
+	}
+}
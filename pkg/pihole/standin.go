@@ -0,0 +1,164 @@
+package pihole
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+StandIn serves the subset of the Pi-hole API used by Client from memory, so
+that the agent and the metrics can be run and tested without a Pi-hole.
+
+Statistics are whatever is set in Summary, Queries, Ads, Sources and Types,
+blocking and the lists are kept as the API would.
+*/
+type StandIn struct {
+	Token   string
+	Summary Summary
+	Queries map[string]uint64
+	Ads     map[string]uint64
+	Sources map[string]uint64
+	Types   map[string]float64
+
+	mtx           sync.Mutex
+	disabled      bool
+	disabledUntil time.Time
+	lists         map[string][]string
+}
+
+func NewStandIn(token string) *StandIn {
+	return &StandIn{
+		Token:   token,
+		Queries: make(map[string]uint64),
+		Ads:     make(map[string]uint64),
+		Sources: make(map[string]uint64),
+		Types:   make(map[string]float64),
+		lists:   make(map[string][]string),
+	}
+}
+
+func (s *StandIn) status() string {
+	if s.disabled && (s.disabledUntil.IsZero() || time.Now().Before(s.disabledUntil)) {
+		return "disabled"
+	}
+	s.disabled = false
+	return "enabled"
+}
+
+// top returns the n largest counts, as the API does empty ones are an
+// array.
+func top(counts map[string]uint64, param string) interface{} {
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		n = 10
+	}
+	result := make(map[string]uint64)
+	for _, count := range sortCounts(counts) {
+		if len(result) == n {
+			break
+		}
+		result[count.Name] = count.Count
+	}
+	if len(result) == 0 {
+		return []string{}
+	}
+	return result
+}
+
+func (s *StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/api.php" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	if _, ok := q["summaryRaw"]; ok {
+		summary := s.Summary
+		summary.Status = s.status()
+		summary.BlockedDomains += uint64(len(s.lists[Deny]))
+		writeJSON(w, summary)
+		return
+	}
+	if s.Token == "" || q.Get("auth") != s.Token {
+		w.Write([]byte("[]"))
+		return
+	}
+	switch {
+	case q["enable"] != nil:
+		s.disabled = false
+		writeJSON(w, map[string]string{"status": s.status()})
+	case q["disable"] != nil:
+		s.disabled = true
+		s.disabledUntil = time.Time{}
+		if seconds, err := strconv.Atoi(q.Get("disable")); err == nil && seconds > 0 {
+			s.disabledUntil = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		writeJSON(w, map[string]string{"status": s.status()})
+	case q["topItems"] != nil:
+		writeJSON(w, map[string]interface{}{
+			"top_queries": top(s.Queries, q.Get("topItems")),
+			"top_ads":     top(s.Ads, q.Get("topItems")),
+		})
+	case q["getQuerySources"] != nil:
+		writeJSON(w, map[string]interface{}{"top_sources": top(s.Sources, q.Get("getQuerySources"))})
+	case q["getQueryTypes"] != nil:
+		var types interface{} = s.Types
+		if len(s.Types) == 0 {
+			types = []string{}
+		}
+		writeJSON(w, map[string]interface{}{"querytypes": types})
+	case q["list"] != nil:
+		s.serveList(w, q.Get("list"), q.Get("add"), q.Get("sub"))
+	default:
+		w.Write([]byte("[]"))
+	}
+}
+
+func (s *StandIn) serveList(w http.ResponseWriter, list, add, sub string) {
+	switch list {
+	case Allow, Deny, RegexAllow, RegexDeny, Adlist:
+	default:
+		writeJSON(w, listReply{Message: "Invalid list type"})
+		return
+	}
+	entries := s.lists[list]
+	switch {
+	case add != "":
+		for _, entry := range entries {
+			if entry == add {
+				writeJSON(w, listReply{Message: "Not adding " + add + " as it is already on the list"})
+				return
+			}
+		}
+		s.lists[list] = append(entries, add)
+		writeJSON(w, listReply{Success: true, Message: "Added " + add})
+	case sub != "":
+		for i, entry := range entries {
+			if entry == sub {
+				s.lists[list] = append(entries[:i:i], entries[i+1:]...)
+				writeJSON(w, listReply{Success: true, Message: "Removed " + sub})
+				return
+			}
+		}
+		writeJSON(w, listReply{Message: sub + " is not on the list"})
+	default:
+		data := make([]listEntry, 0, len(entries))
+		for _, entry := range entries {
+			if list == Adlist {
+				data = append(data, listEntry{Address: entry})
+			} else {
+				data = append(data, listEntry{Domain: entry})
+			}
+		}
+		writeJSON(w, map[string][]listEntry{"data": data})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,107 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const protocolICMP = 1
+
+// checkICMP sends an echo request and waits for its reply. The socket is raw,
+// so replies to other probes are read too and skipped.
+func (p *Probe) checkICMP(ctx context.Context) (time.Duration, error) {
+	addr, err := net.ResolveIPAddr("ip4", p.Config.Target)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	p.seq = (p.seq + 1) & 0xffff
+	request := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: []byte("wan-probe")},
+	}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(data, addr); err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		reply, err := icmp.ParseMessage(protocolICMP, buffer[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.ID != p.id || echo.Seq != p.seq || peer.String() != addr.String() {
+			continue
+		}
+		return rtt, nil
+	}
+}
+
+// checkTCP measures the time to establish a connection.
+func (p *Probe) checkTCP(ctx context.Context) (time.Duration, error) {
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", p.Config.Target)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// checkHTTP measures the time until the response headers arrive, connection
+// included. Server errors count as failures.
+func (p *Probe) checkHTTP(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, p.Config.Target, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("server answered %s", resp.Status)
+	}
+	return rtt, nil
+}
+
+// checkDNS measures how long the resolver takes to resolve the query.
+func (p *Probe) checkDNS(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	addrs, err := p.resolver.LookupHost(ctx, p.Config.Query)
+	if err != nil {
+		return 0, err
+	}
+	if len(addrs) == 0 {
+		return 0, fmt.Errorf("no addresses for %s", p.Config.Query)
+	}
+	return time.Since(start), nil
+}
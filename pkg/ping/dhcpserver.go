@@ -1,5 +0,0 @@
-package ping
-
-func ping() {
-
-}
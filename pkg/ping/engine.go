@@ -0,0 +1,128 @@
+package ping
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine runs the probes of every uplink and tracks their health. An uplink
+// is down when all its probes are unhealthy and up again as soon as one
+// recovers.
+type Engine struct {
+	evalMtx sync.Mutex // serializes evaluate, so transitions are logged in order
+	mtx     sync.Mutex
+	probes  []*Probe
+	healthy map[string]bool
+}
+
+func NewEngine() *Engine {
+	return &Engine{healthy: make(map[string]bool)}
+}
+
+// AddUplink creates the probes of an uplink, DefaultProbes if it has none.
+// Uplinks start healthy.
+func (e *Engine) AddUplink(uplink config.Uplink) error {
+	name := uplink.Name
+	if name == "" {
+		name = "uplink"
+	}
+	probes := uplink.Probes
+	if len(probes) == 0 {
+		probes = DefaultProbes
+	}
+	var created []*Probe
+	for _, c := range probes {
+		p, err := newProbe(e, name, c)
+		if err != nil {
+			return err
+		}
+		created = append(created, p)
+	}
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	e.probes = append(e.probes, created...)
+	e.healthy[name] = true
+	return nil
+}
+
+// Run starts the probes and waits until stop is closed.
+func (e *Engine) Run(stop <-chan struct{}) {
+	e.mtx.Lock()
+	probes := append([]*Probe(nil), e.probes...)
+	e.mtx.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p *Probe) {
+			defer wg.Done()
+			p.run(stop)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (e *Engine) Healthy(uplink string) bool {
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	return e.healthy[uplink]
+}
+
+// Uplinks returns the health of every uplink.
+func (e *Engine) Uplinks() map[string]bool {
+	defer e.mtx.Unlock()
+	e.mtx.Lock()
+	uplinks := make(map[string]bool, len(e.healthy))
+	for name, healthy := range e.healthy {
+		uplinks[name] = healthy
+	}
+	return uplinks
+}
+
+func (e *Engine) Status() []ProbeStatus {
+	e.mtx.Lock()
+	probes := append([]*Probe(nil), e.probes...)
+	e.mtx.Unlock()
+	var status []ProbeStatus
+	for _, p := range probes {
+		status = append(status, p.Status())
+	}
+	sort.SliceStable(status, func(i, j int) bool { return status[i].Uplink < status[j].Uplink })
+	return status
+}
+
+func (e *Engine) evaluate(uplink string) {
+	defer e.evalMtx.Unlock()
+	e.evalMtx.Lock()
+	e.mtx.Lock()
+	var probes []*Probe
+	for _, p := range e.probes {
+		if p.Uplink == uplink {
+			probes = append(probes, p)
+		}
+	}
+	e.mtx.Unlock()
+
+	healthy := false
+	for _, p := range probes {
+		if p.Status().Healthy {
+			healthy = true
+			break
+		}
+	}
+
+	e.mtx.Lock()
+	changed := e.healthy[uplink] != healthy
+	e.healthy[uplink] = healthy
+	e.mtx.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		log.WithFields(log.Fields{"module": moduleName, "uplink": uplink}).Infoln("Uplink is healthy again")
+	} else {
+		log.WithFields(log.Fields{"module": moduleName, "uplink": uplink}).Warnln("Uplink is unhealthy, every probe is failing")
+	}
+}
@@ -0,0 +1,188 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "ping-mgr"
+
+	defaultInterval = 5 * time.Second
+	defaultTimeout  = 2 * time.Second
+	defaultMaxLoss  = 20
+	defaultQuery    = "example.com"
+)
+
+// DefaultProbes are used for uplinks without probes in their config.
+var DefaultProbes = []config.Probe{
+	{Type: "icmp", Target: "1.1.1.1"},
+	{Type: "icmp", Target: "8.8.8.8"},
+	{Type: "dns", Target: "1.1.1.1:53", Query: defaultQuery},
+}
+
+// Probe checks periodically a target and keeps the samples of the longest
+// window.
+type Probe struct {
+	Uplink   string
+	Config   config.Probe
+	interval time.Duration
+	timeout  time.Duration
+	check    func(ctx context.Context) (time.Duration, error)
+	engine   *Engine
+
+	id, seq  int
+	client   *http.Client
+	resolver *net.Resolver
+
+	mtx       sync.Mutex
+	samples   []Sample
+	lastError string
+}
+
+type ProbeStatus struct {
+	Uplink    string    `json:"uplink"`
+	Type      string    `json:"type"`
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	LastProbe time.Time `json:"last"`
+	LastRTT   float64   `json:"last_rtt"`
+	LastError string    `json:"last_error,omitempty"`
+	Windows   []Stats   `json:"windows"`
+}
+
+func newProbe(engine *Engine, uplink string, c config.Probe) (*Probe, error) {
+	if c.Target == "" {
+		return nil, fmt.Errorf("%s probe without target", c.Type)
+	}
+	p := &Probe{
+		Uplink:   uplink,
+		Config:   c,
+		interval: time.Duration(c.Interval) * time.Second,
+		timeout:  time.Duration(c.Timeout) * time.Millisecond,
+		engine:   engine,
+	}
+	if p.interval <= 0 {
+		p.interval = defaultInterval
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+	if p.Config.MaxLoss <= 0 {
+		p.Config.MaxLoss = defaultMaxLoss
+	}
+	switch c.Type {
+	case "icmp":
+		p.id = rand.Intn(0xffff)
+		p.check = p.checkICMP
+	case "tcp":
+		if _, _, err := net.SplitHostPort(c.Target); err != nil {
+			return nil, fmt.Errorf("invalid tcp target %q: %v", c.Target, err)
+		}
+		p.check = p.checkTCP
+	case "http":
+		p.client = &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		p.check = p.checkHTTP
+	case "dns":
+		server := c.Target
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if p.Config.Query == "" {
+			p.Config.Query = defaultQuery
+		}
+		p.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		p.check = p.checkDNS
+	default:
+		return nil, fmt.Errorf("unknown probe type %q", c.Type)
+	}
+	return p, nil
+}
+
+func (p *Probe) run(stop <-chan struct{}) {
+	// Spread the probes so they do not all fire at once.
+	time.Sleep(time.Duration(rand.Int63n(int64(p.interval))))
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probe()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Probe) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	rtt, err := p.check(ctx)
+	cancel()
+
+	now := time.Now()
+	p.mtx.Lock()
+	p.samples = append(p.samples, Sample{Time: now, RTT: rtt, OK: err == nil})
+	oldest := now.Add(-Windows[len(Windows)-1])
+	for len(p.samples) > 0 && p.samples[0].Time.Before(oldest) {
+		p.samples = p.samples[1:]
+	}
+	p.lastError = ""
+	if err != nil {
+		p.lastError = err.Error()
+		log.WithFields(log.Fields{"module": moduleName, "uplink": p.Uplink, "target": p.Config.Target, "error": err.Error()}).Debugf("%s probe failed", p.Config.Type)
+	}
+	p.mtx.Unlock()
+	p.engine.evaluate(p.Uplink)
+}
+
+// healthy tells whether the loss and median RTT over the shortest window are
+// within the limits. A probe without samples yet is healthy.
+func (p *Probe) healthy(stats Stats) bool {
+	if stats.Sent == 0 {
+		return true
+	}
+	if stats.Loss > p.Config.MaxLoss {
+		return false
+	}
+	return p.Config.MaxRTT <= 0 || stats.P50 <= float64(p.Config.MaxRTT)
+}
+
+func (p *Probe) Status() ProbeStatus {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	status := ProbeStatus{
+		Uplink:    p.Uplink,
+		Type:      p.Config.Type,
+		Target:    p.Config.Target,
+		LastError: p.lastError,
+	}
+	if n := len(p.samples); n > 0 {
+		status.LastProbe = p.samples[n-1].Time
+		status.LastRTT = ms(p.samples[n-1].RTT)
+	}
+	now := time.Now()
+	for _, window := range Windows {
+		status.Windows = append(status.Windows, computeStats(p.samples, window, now))
+	}
+	status.Healthy = p.healthy(status.Windows[0])
+	return status
+}
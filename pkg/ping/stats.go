@@ -0,0 +1,108 @@
+package ping
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Windows are the sliding windows the statistics are computed over.
+var Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+type Sample struct {
+	Time time.Time
+	RTT  time.Duration
+	OK   bool
+}
+
+// Stats summarizes the samples of a window. Times are in milliseconds and
+// Loss is a percentage. Jitter is the mean difference between the RTTs of
+// consecutive successful probes.
+type Stats struct {
+	Window string  `json:"window"`
+	Sent   int     `json:"sent"`
+	Lost   int     `json:"lost"`
+	Loss   float64 `json:"loss"`
+	Min    float64 `json:"min"`
+	Avg    float64 `json:"avg"`
+	Max    float64 `json:"max"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	Jitter float64 `json:"jitter"`
+}
+
+// windowName returns 1m for a minute instead of 1m0s.
+func windowName(window time.Duration) string {
+	name := window.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// computeStats summarizes the samples taken after now-window. samples are
+// in chronological order.
+func computeStats(samples []Sample, window time.Duration, now time.Time) Stats {
+	stats := Stats{Window: windowName(window)}
+	var rtts []float64
+	var last float64
+	var jitter float64
+	var diffs int
+	for _, sample := range samples {
+		if sample.Time.Before(now.Add(-window)) {
+			continue
+		}
+		stats.Sent++
+		if !sample.OK {
+			stats.Lost++
+			continue
+		}
+		rtt := ms(sample.RTT)
+		if len(rtts) > 0 {
+			jitter += math.Abs(rtt - last)
+			diffs++
+		}
+		last = rtt
+		rtts = append(rtts, rtt)
+	}
+	if stats.Sent == 0 {
+		return stats
+	}
+	stats.Loss = 100 * float64(stats.Lost) / float64(stats.Sent)
+	if len(rtts) == 0 {
+		return stats
+	}
+	if diffs > 0 {
+		stats.Jitter = jitter / float64(diffs)
+	}
+	var sum float64
+	for _, rtt := range rtts {
+		sum += rtt
+	}
+	stats.Avg = sum / float64(len(rtts))
+	sort.Float64s(rtts)
+	stats.Min = rtts[0]
+	stats.Max = rtts[len(rtts)-1]
+	stats.P50 = percentile(rtts, 50)
+	stats.P90 = percentile(rtts, 90)
+	stats.P99 = percentile(rtts, 99)
+	return stats
+}
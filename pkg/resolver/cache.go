@@ -0,0 +1,154 @@
+package resolver
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultCacheSize = 4096
+	// Negative answers without an SOA, and every answer at most, are kept
+	// for these.
+	negativeTTL = 60
+	maxTTL      = 86400
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache keeps the answers to the last Size questions until their TTL runs
+// out, evicting the least recently used first.
+type Cache struct {
+	Size    int
+	mtx     sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+func NewCache(size int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &Cache{
+		Size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func keyOf(q dns.Question) cacheKey {
+	return cacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+}
+
+// ttl is the time an answer may be cached: the lowest TTL of its records,
+// or the SOA minimum for negative answers.
+func ttl(msg *dns.Msg) uint32 {
+	min := uint32(maxTTL)
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if t < min {
+				min = t
+			}
+			found = true
+		}
+	}
+	if !found {
+		return negativeTTL
+	}
+	return min
+}
+
+// Put stores an answer. Only successful and NXDOMAIN answers are cached.
+func (c *Cache) Put(msg *dns.Msg) {
+	if len(msg.Question) != 1 || msg.Truncated {
+		return
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+	t := ttl(msg)
+	if t == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     keyOf(msg.Question[0]),
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(t) * time.Second),
+	}
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Get returns a copy of the cached answer to q with its TTLs decreased by
+// the time it has been cached.
+func (c *Cache) Get(q dns.Question) (*dns.Msg, bool) {
+	key := keyOf(q)
+	now := time.Now()
+	c.mtx.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mtx.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if now.After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.mtx.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	msg := entry.msg.Copy()
+	c.mtx.Unlock()
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return msg, true
+}
+
+func (c *Cache) Len() int {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	return c.lru.Len()
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answer(name string, rcode int, records ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Response = true
+	msg.Rcode = rcode
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+		if _, ok := rr.(*dns.SOA); ok {
+			msg.Ns = append(msg.Ns, rr)
+		} else {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		want uint32
+	}{
+		{"lowest record", answer("a.example.com", dns.RcodeSuccess, "a.example.com. 300 IN A 192.0.2.1", "a.example.com. 60 IN A 192.0.2.2"), 60},
+		{"capped", answer("a.example.com", dns.RcodeSuccess, "a.example.com. 604800 IN A 192.0.2.1"), maxTTL},
+		{"no records", answer("a.example.com", dns.RcodeNameError), negativeTTL},
+		{"soa minimum", answer("a.example.com", dns.RcodeNameError, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 30"), 30},
+		{"soa ttl", answer("a.example.com", dns.RcodeNameError, "example.com. 20 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300"), 20},
+	}
+	for _, tt := range tests {
+		if got := ttl(tt.msg); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCachePut(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		cached bool
+	}{
+		{"answer", answer("a.example.com", dns.RcodeSuccess, "a.example.com. 300 IN A 192.0.2.1"), true},
+		{"nxdomain", answer("a.example.com", dns.RcodeNameError), true},
+		{"servfail", answer("a.example.com", dns.RcodeServerFailure), false},
+		{"refused", answer("a.example.com", dns.RcodeRefused), false},
+		{"zero ttl", answer("a.example.com", dns.RcodeSuccess, "a.example.com. 0 IN A 192.0.2.1"), false},
+		{"truncated", func() *dns.Msg {
+			msg := answer("a.example.com", dns.RcodeSuccess, "a.example.com. 300 IN A 192.0.2.1")
+			msg.Truncated = true
+			return msg
+		}(), false},
+	}
+	for _, tt := range tests {
+		cache := NewCache(0)
+		cache.Put(tt.msg)
+		_, ok := cache.Get(dns.Question{Name: "A.Example.COM.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if ok != tt.cached {
+			t.Errorf("%s: cached %v, want %v", tt.name, ok, tt.cached)
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := NewCache(0)
+	msg := answer("a.example.com", dns.RcodeSuccess, "a.example.com. 300 IN A 192.0.2.1")
+	cache.Put(msg)
+	entry := cache.entries[keyOf(msg.Question[0])].Value.(*cacheEntry)
+
+	entry.stored = entry.stored.Add(-100 * time.Second)
+	reply, ok := cache.Get(msg.Question[0])
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	if got := reply.Answer[0].Header().Ttl; got != 200 {
+		t.Errorf("got TTL %d, want 200", got)
+	}
+	// The stored answer is not changed by Get.
+	if got := entry.msg.Answer[0].Header().Ttl; got != 300 {
+		t.Errorf("stored TTL changed to %d", got)
+	}
+
+	entry.expires = time.Now().Add(-time.Second)
+	if _, ok := cache.Get(msg.Question[0]); ok {
+		t.Error("expired answer returned")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expired answer kept, %d entries", cache.Len())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := NewCache(2)
+	a := answer("a.example.com", dns.RcodeSuccess, "a.example.com. 300 IN A 192.0.2.1")
+	b := answer("b.example.com", dns.RcodeSuccess, "b.example.com. 300 IN A 192.0.2.2")
+	c := answer("c.example.com", dns.RcodeSuccess, "c.example.com. 300 IN A 192.0.2.3")
+	cache.Put(a)
+	cache.Put(b)
+	// a is used, so b is the least recently used when c comes.
+	cache.Get(a.Question[0])
+	cache.Put(c)
+	if cache.Len() != 2 {
+		t.Fatalf("got %d entries, want 2", cache.Len())
+	}
+	for _, tt := range []struct {
+		msg    *dns.Msg
+		cached bool
+	}{{a, true}, {b, false}, {c, true}} {
+		if _, ok := cache.Get(tt.msg.Question[0]); ok != tt.cached {
+			t.Errorf("%s: cached %v, want %v", tt.msg.Question[0].Name, ok, tt.cached)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Package resolver is a caching DNS forwarder, used by wan-dns on routers
+without Pi-hole. Queries are answered from local records first, then from
+the cache, and forwarded in order to the upstreams, plain or over TLS.
+*/
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "dns-resolver"
+
+	DefaultStatsAddr = "127.0.0.1:9630"
+	StatsPath        = "/stats"
+)
+
+type Stats struct {
+	Queries   uint64          `json:"queries"`
+	Local     uint64          `json:"local"`
+	CacheHits uint64          `json:"cache_hits"`
+	Forwarded uint64          `json:"forwarded"`
+	Failures  uint64          `json:"failures"`
+	CacheSize int             `json:"cache_size"`
+	Upstreams []UpstreamStats `json:"upstreams"`
+}
+
+type Resolver struct {
+	Upstreams []*Upstream
+	Cache     *Cache
+
+	mtx     sync.Mutex
+	records map[string][]dns.RR // by lowercase fqdn
+	stats   Stats
+}
+
+func New(upstreams []string, cacheSize int) (*Resolver, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+	r := &Resolver{
+		Cache:   NewCache(cacheSize),
+		records: make(map[string][]dns.RR),
+	}
+	for _, s := range upstreams {
+		u, err := ParseUpstream(s)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", s, err)
+		}
+		r.Upstreams = append(r.Upstreams, u)
+	}
+	return r, nil
+}
+
+// AddRecord adds a local record, e.g. ("nas.lan", "A", "192.168.2.10", 300).
+// The name may be a wildcard like *.lan. Local names are answered with
+// their records only, never forwarded.
+func (r *Resolver) AddRecord(name, rrtype, value string, ttl int) error {
+	if ttl <= 0 {
+		ttl = 300
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, strings.ToUpper(rrtype), value))
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		return fmt.Errorf("empty record for %s", name)
+	}
+	defer r.mtx.Unlock()
+	r.mtx.Lock()
+	key := strings.ToLower(rr.Header().Name)
+	r.records[key] = append(r.records[key], rr)
+	return nil
+}
+
+// local returns the records of name, the wildcard ones included, and
+// whether the name is local at all.
+func (r *Resolver) local(q dns.Question) ([]dns.RR, bool) {
+	name := strings.ToLower(q.Name)
+	defer r.mtx.Unlock()
+	r.mtx.Lock()
+	rrs, ok := r.records[name]
+	if !ok {
+		labels := dns.SplitDomainName(name)
+		for i := 1; i < len(labels) && !ok; i++ {
+			rrs, ok = r.records["*."+dns.Fqdn(strings.Join(labels[i:], "."))]
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	var answer []dns.RR
+	for _, rr := range rrs {
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			answer = append(answer, rr)
+		}
+	}
+	return answer, true
+}
+
+func (r *Resolver) count(counter *uint64) {
+	r.mtx.Lock()
+	*counter++
+	r.mtx.Unlock()
+}
+
+func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	r.count(&r.stats.Queries)
+	reply := r.resolve(req)
+	if err := w.WriteMsg(reply); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Debugln("Error writing reply")
+	}
+}
+
+func (r *Resolver) resolve(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		reply := new(dns.Msg)
+		return reply.SetRcode(req, dns.RcodeFormatError)
+	}
+	q := req.Question[0]
+	if answer, ok := r.local(q); ok {
+		r.count(&r.stats.Local)
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Authoritative = true
+		reply.Answer = answer
+		return reply
+	}
+	if cached, ok := r.Cache.Get(q); ok {
+		r.count(&r.stats.CacheHits)
+		cached.Id = req.Id
+		cached.Question = req.Question
+		return cached
+	}
+	for _, upstream := range r.Upstreams {
+		reply, err := upstream.Exchange(req)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "upstream": upstream.Addr, "error": err.Error()}).Debugln("Error forwarding query")
+			continue
+		}
+		if reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused {
+			continue
+		}
+		r.count(&r.stats.Forwarded)
+		r.Cache.Put(reply)
+		return reply
+	}
+	r.count(&r.stats.Failures)
+	reply := new(dns.Msg)
+	return reply.SetRcode(req, dns.RcodeServerFailure)
+}
+
+func (r *Resolver) Stats() Stats {
+	r.mtx.Lock()
+	stats := r.stats
+	r.mtx.Unlock()
+	stats.CacheSize = r.Cache.Len()
+	stats.Upstreams = nil
+	for _, upstream := range r.Upstreams {
+		stats.Upstreams = append(stats.Upstreams, upstream.Stats())
+	}
+	return stats
+}
+
+// ListenAndServe answers on addr over UDP and TCP.
+func (r *Resolver) ListenAndServe(addr string) error {
+	errs := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: addr, Net: network, Handler: r}
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	log.WithFields(log.Fields{"module": moduleName}).Infof("Resolving at %s", addr)
+	return <-errs
+}
+
+// ServeHTTP serves the stats as JSON at StatsPath.
+func (r *Resolver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != StatsPath {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Stats())
+}
+
+// FetchStats reads the stats served by a Resolver at addr.
+func FetchStats(addr string) (*Stats, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{Timeout: 5 * time.Second}).Dial,
+		},
+	}
+	response, err := client.Get("http://" + addr + StatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver stats: %s", response.Status)
+	}
+	stats := &Stats{}
+	return stats, json.NewDecoder(response.Body).Decode(stats)
+}
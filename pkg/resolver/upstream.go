@@ -0,0 +1,114 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const upstreamTimeout = 3 * time.Second
+
+// Upstream is a server queries are forwarded to, over plain DNS or over
+// TLS (RFC 7858).
+type Upstream struct {
+	Addr       string
+	ServerName string
+	TLS        bool
+	udp        *dns.Client
+	tcp        *dns.Client
+
+	mtx     sync.Mutex
+	queries uint64
+	errors  uint64
+	rtt     time.Duration // total, of the successful queries
+}
+
+type UpstreamStats struct {
+	Addr    string  `json:"addr"`
+	TLS     bool    `json:"tls,omitempty"`
+	Queries uint64  `json:"queries"`
+	Errors  uint64  `json:"errors"`
+	RTT     float64 `json:"rtt"` // average, in ms
+}
+
+/*
+ParseUpstream reads an upstream server as:
+
+	8.8.8.8                         plain DNS, port 53
+	[2001:4860:4860::8888]:53       plain DNS
+	tls://1.1.1.1                   DNS over TLS, port 853
+	tls://1.1.1.1#cloudflare-dns.com   checking the certificate name
+	tls://dns.google:853
+*/
+func ParseUpstream(s string) (*Upstream, error) {
+	u := &Upstream{}
+	port := "53"
+	if strings.HasPrefix(s, "tls://") {
+		s = strings.TrimPrefix(s, "tls://")
+		u.TLS = true
+		port = "853"
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s, u.ServerName = s[:i], s[i+1:]
+	}
+	if s == "" {
+		return nil, errors.New("empty upstream address")
+	}
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		host, p = strings.Trim(s, "[]"), port
+	}
+	if u.TLS && u.ServerName == "" {
+		u.ServerName = host
+	}
+	u.Addr = net.JoinHostPort(host, p)
+	if u.TLS {
+		u.tcp = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   upstreamTimeout,
+			TLSConfig: &tls.Config{ServerName: u.ServerName, MinVersion: tls.VersionTLS12},
+		}
+	} else {
+		u.udp = &dns.Client{Net: "udp", Timeout: upstreamTimeout}
+		u.tcp = &dns.Client{Net: "tcp", Timeout: upstreamTimeout}
+	}
+	return u, nil
+}
+
+// Exchange forwards a query, retrying over TCP when the UDP answer is
+// truncated.
+func (u *Upstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	var reply *dns.Msg
+	var rtt time.Duration
+	var err error
+	if u.udp != nil {
+		reply, rtt, err = u.udp.Exchange(req, u.Addr)
+	}
+	if u.udp == nil || (err == nil && reply.Truncated) {
+		reply, rtt, err = u.tcp.Exchange(req, u.Addr)
+	}
+	u.mtx.Lock()
+	u.queries++
+	if err != nil {
+		u.errors++
+	} else {
+		u.rtt += rtt
+	}
+	u.mtx.Unlock()
+	return reply, err
+}
+
+func (u *Upstream) Stats() UpstreamStats {
+	defer u.mtx.Unlock()
+	u.mtx.Lock()
+	stats := UpstreamStats{Addr: u.Addr, TLS: u.TLS, Queries: u.queries, Errors: u.errors}
+	if ok := u.queries - u.errors; ok > 0 {
+		stats.RTT = float64(u.rtt) / float64(ok) / float64(time.Millisecond)
+	}
+	return stats
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"io"
 	"net"
 )
 
@@ -25,6 +26,38 @@ func ListRoutes() {
 	}
 }
 
+// WriteRoutes writes the IPv4 routing table to w, one route per line like
+// ip route does.
+func WriteRoutes(w io.Writer) error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		dst := "default"
+		if route.Dst != nil {
+			dst = route.Dst.String()
+		}
+		line := dst
+		if route.Gw != nil {
+			line += " via " + route.Gw.String()
+		}
+		if iface, err := net.InterfaceByIndex(route.LinkIndex); err == nil {
+			line += " dev " + iface.Name
+		}
+		if route.Src != nil {
+			line += " src " + route.Src.String()
+		}
+		if route.Priority != 0 {
+			line += fmt.Sprintf(" metric %d", route.Priority)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func AddDefaultRoute(gw net.IP) error {
 	defaultRoute := netlink.Route{
 		Dst: nil,
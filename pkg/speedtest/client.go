@@ -0,0 +1,228 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Result struct {
+	Time          time.Time `json:"ts"`
+	Server        string    `json:"server"`
+	Streams       int       `json:"streams"`
+	Duration      float64   `json:"duration"` // seconds, per direction
+	DownloadBps   float64   `json:"download_bps"`
+	UploadBps     float64   `json:"upload_bps"`
+	DownloadBytes int64     `json:"download_bytes"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	Error         string    `json:"error,omitempty"`
+}
+
+/*
+Client measures the throughput to a server running Handler, with Streams
+parallel TCP connections in each direction. Every direction runs for
+Duration, the bytes moved during the first Warmup are not counted so TCP
+slow start does not lower the result. Dial, when set, opens the connections
+instead of dialing Server, e.g. through the wan-connect socket.
+*/
+type Client struct {
+	Server   string
+	Streams  int
+	Duration time.Duration
+	Warmup   time.Duration
+	Dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func NewClient(server string, streams int, duration time.Duration) *Client {
+	if streams <= 0 {
+		streams = 4
+	}
+	if duration <= 0 {
+		duration = 10 * time.Second
+	}
+	return &Client{
+		Server:   strings.TrimSuffix(server, "/"),
+		Streams:  streams,
+		Duration: duration,
+		Warmup:   duration / 5,
+	}
+}
+
+// httpClient returns a client without keep-alives, so every stream opens
+// its own connection.
+func (c *Client) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:              http.ProxyFromEnvironment,
+			DialContext:        c.Dial,
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+	}
+}
+
+// meter counts the bytes moved after the warm-up.
+type meter struct {
+	counted int64
+	start   time.Time
+	warmup  time.Time
+}
+
+func newMeter(warmup time.Duration) *meter {
+	now := time.Now()
+	return &meter{start: now, warmup: now.Add(warmup)}
+}
+
+func (m *meter) add(n int) {
+	if time.Now().After(m.warmup) {
+		atomic.AddInt64(&m.counted, int64(n))
+	}
+}
+
+// bps returns the throughput measured until end, or now if it is earlier.
+func (m *meter) bps(end time.Time) (float64, int64) {
+	counted := atomic.LoadInt64(&m.counted)
+	if now := time.Now(); now.Before(end) {
+		end = now
+	}
+	elapsed := end.Sub(m.warmup).Seconds()
+	if elapsed <= 0 {
+		return 0, counted
+	}
+	return 8 * float64(counted) / elapsed, counted
+}
+
+// parallel runs stream Streams times concurrently and returns the first
+// error, if no stream succeeded at all.
+func (c *Client) parallel(stream func() error) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, c.Streams)
+	for i := 0; i < c.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- stream()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var first error
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if failed == c.Streams {
+		return first
+	}
+	return nil
+}
+
+func (c *Client) Download(ctx context.Context) (float64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+	client := c.httpClient()
+	m := newMeter(c.Warmup)
+	err := c.parallel(func() error {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/speedtest/download?bytes=%d", c.Server, MaxDownload), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("server answered %s", resp.Status)
+		}
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := resp.Body.Read(buffer)
+			m.add(n)
+			if err != nil {
+				if ctx.Err() != nil || err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	})
+	bps, n := m.bps(m.start.Add(c.Duration))
+	return bps, n, err
+}
+
+// uploadBody produces data until its deadline.
+type uploadBody struct {
+	deadline time.Time
+	meter    *meter
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if time.Now().After(b.deadline) {
+		return 0, io.EOF
+	}
+	n := copy(p, chunk)
+	b.meter.add(n)
+	return n, nil
+}
+
+func (c *Client) Upload(ctx context.Context) (float64, int64, error) {
+	// The body ends at the deadline, the timeout only covers a stalled
+	// server.
+	ctx, cancel := context.WithTimeout(ctx, 2*c.Duration)
+	defer cancel()
+	client := c.httpClient()
+	m := newMeter(c.Warmup)
+	deadline := m.start.Add(c.Duration)
+	err := c.parallel(func() error {
+		req, err := http.NewRequest("POST", c.Server+"/speedtest/upload", &uploadBody{deadline: deadline, meter: m})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("server answered %s", resp.Status)
+		}
+		return nil
+	})
+	bps, n := m.bps(deadline)
+	return bps, n, err
+}
+
+// Run measures the download and then the upload throughput.
+func (c *Client) Run(ctx context.Context) Result {
+	result := Result{
+		Time:     time.Now(),
+		Server:   c.Server,
+		Streams:  c.Streams,
+		Duration: c.Duration.Seconds(),
+	}
+	var errs []string
+	var err error
+	if result.DownloadBps, result.DownloadBytes, err = c.Download(ctx); err != nil {
+		errs = append(errs, "download: "+err.Error())
+	}
+	if result.UploadBps, result.UploadBytes, err = c.Upload(ctx); err != nil {
+		errs = append(errs, "upload: "+err.Error())
+	}
+	result.Error = strings.Join(errs, ", ")
+	return result
+}
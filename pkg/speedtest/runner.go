@@ -0,0 +1,83 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrRunning = errors.New("a speed test is already running")
+
+// Runner runs the tests of a Client every Interval, or on demand, one at a
+// time. OnResult is called with every result.
+type Runner struct {
+	Client   *Client
+	Interval time.Duration
+	OnResult func(Result)
+	mtx      sync.Mutex
+	running  bool
+	last     *Result
+}
+
+func NewRunner(client *Client, interval time.Duration) *Runner {
+	return &Runner{Client: client, Interval: interval}
+}
+
+// Trigger runs a test now and waits for its result.
+func (r *Runner) Trigger(ctx context.Context) (Result, error) {
+	r.mtx.Lock()
+	if r.running {
+		r.mtx.Unlock()
+		return Result{}, ErrRunning
+	}
+	r.running = true
+	r.mtx.Unlock()
+
+	log.WithFields(log.Fields{"module": moduleName, "server": r.Client.Server}).Infoln("Running speed test")
+	result := r.Client.Run(ctx)
+	fields := log.Fields{"module": moduleName, "download_bps": result.DownloadBps, "upload_bps": result.UploadBps}
+	if result.Error != "" {
+		fields["error"] = result.Error
+	}
+	log.WithFields(fields).Infoln("Speed test finished")
+
+	r.mtx.Lock()
+	r.running = false
+	r.last = &result
+	onResult := r.OnResult
+	r.mtx.Unlock()
+	if onResult != nil {
+		onResult(result)
+	}
+	return result, nil
+}
+
+// Last returns the result of the last test, nil if none ran yet.
+func (r *Runner) Last() *Result {
+	defer r.mtx.Unlock()
+	r.mtx.Lock()
+	return r.last
+}
+
+// Run runs a test every Interval until stop is closed. A zero Interval
+// leaves only the tests triggered on demand.
+func (r *Runner) Run(stop <-chan struct{}) {
+	if r.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if _, err := r.Trigger(context.Background()); err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Skipping scheduled speed test")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package speedtest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "speedtest"
+
+	// MaxDownload is the most a single stream can move, either way.
+	// Clients stop when their test is over, usually before reaching it.
+	MaxDownload = 256 << 20
+	chunkSize   = 1 << 20
+
+	// Limits of the server: streams at once, over all the clients and for
+	// each one, and bytes a client can move every usageWindow.
+	maxStreams       = 32
+	maxClientStreams = 8
+	maxClientBytes   = 4 << 30
+	usageWindow      = time.Hour
+)
+
+// chunk is random so that compression on the path does not inflate the
+// measured throughput.
+var chunk = func() []byte {
+	b := make([]byte, chunkSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+/*
+Handler is the server side of the tests:
+
+	GET  .../speedtest/download?bytes=N
+	POST .../speedtest/upload
+
+Authorize tells who a request comes from, tests are refused to anyone else.
+Every client is limited in streams and in bytes.
+*/
+type Handler struct {
+	Authorize func(r *http.Request) (string, bool)
+	mtx       sync.Mutex
+	streams   int
+	clients   map[string]*usage
+}
+
+type usage struct {
+	streams int
+	since   time.Time
+	bytes   int64
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ok := "", h.Authorize != nil
+	if ok {
+		client, ok = h.Authorize(r)
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var serve func(http.ResponseWriter, *http.Request) int64
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/download"):
+		serve = serveDownload
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/upload"):
+		serve = serveUpload
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err := h.acquire(client); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "client": client, "error": err.Error()}).Warnln("Speed test refused")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	h.release(client, serve(w, r))
+}
+
+// acquire starts a stream of client, if it is within its limits.
+func (h *Handler) acquire(client string) error {
+	defer h.mtx.Unlock()
+	h.mtx.Lock()
+	if h.clients == nil {
+		h.clients = make(map[string]*usage)
+	}
+	u, ok := h.clients[client]
+	if !ok {
+		u = &usage{since: time.Now()}
+		h.clients[client] = u
+	}
+	if time.Since(u.since) > usageWindow {
+		u.since, u.bytes = time.Now(), 0
+	}
+	switch {
+	case h.streams >= maxStreams:
+		return fmt.Errorf("too many tests running")
+	case u.streams >= maxClientStreams:
+		return fmt.Errorf("too many streams, at most %d", maxClientStreams)
+	case u.bytes >= maxClientBytes:
+		return fmt.Errorf("test budget used up, try again later")
+	}
+	h.streams++
+	u.streams++
+	return nil
+}
+
+func (h *Handler) release(client string, n int64) {
+	defer h.mtx.Unlock()
+	h.mtx.Lock()
+	h.streams--
+	u := h.clients[client]
+	u.streams--
+	u.bytes += n
+	// Clients that did not test for a while are forgotten.
+	for name, u := range h.clients {
+		if u.streams == 0 && time.Since(u.since) > usageWindow {
+			delete(h.clients, name)
+		}
+	}
+}
+
+func serveDownload(w http.ResponseWriter, r *http.Request) int64 {
+	size := int64(MaxDownload)
+	if value := r.URL.Query().Get("bytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid bytes", http.StatusBadRequest)
+			return 0
+		}
+		if n < size {
+			size = n
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	var written int64
+	for written < size {
+		n := int64(len(chunk))
+		if n > size-written {
+			n = size - written
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			// The client is done.
+			break
+		}
+		written += n
+	}
+	return written
+}
+
+func serveUpload(w http.ResponseWriter, r *http.Request) int64 {
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r.Body, MaxDownload))
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Debugln("Upload interrupted")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"bytes": n})
+	return n
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minBackoff  = time.Second
+	maxBackoff  = time.Minute
+	openTimeout = 10 * time.Second
+)
+
+var ErrNoSession = errors.New("no session to the controller")
+
+type Status struct {
+	Connected  bool      `json:"connected"`
+	Remote     string    `json:"remote,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+	Streams    int       `json:"streams"`
+	Reconnects uint64    `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+/*
+Client keeps a session to the controller open, dialing again with an
+exponential backoff whenever it drops. Dial returns the authenticated
+connection the session runs on.
+
+Streams opened by the controller are routed by Mux.
+*/
+type Client struct {
+	Dial func() (net.Conn, error)
+	Mux  *Mux
+
+	mtx     sync.Mutex
+	session *yamux.Session
+	ready   chan struct{} // closed while there is a session
+	kick    chan struct{}
+	status  Status
+}
+
+func NewClient(dial func() (net.Conn, error)) *Client {
+	return &Client{Dial: dial, Mux: NewMux(), ready: make(chan struct{}), kick: make(chan struct{}, 1)}
+}
+
+// Run keeps the session up until stop is closed.
+func (c *Client) Run(stop <-chan struct{}) {
+	backoff := minBackoff
+	for {
+		session, err := c.connect()
+		if err != nil {
+			c.mtx.Lock()
+			c.status.LastError = err.Error()
+			c.mtx.Unlock()
+			// Up to 50% jitter so routers do not reconnect in lockstep
+			// after a controller restart.
+			wait := backoff + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnf("Error connecting to the controller, retrying in %v", wait.Truncate(time.Millisecond))
+			select {
+			case <-time.After(wait):
+			case <-c.kick:
+				backoff = minBackoff
+				continue
+			case <-stop:
+				return
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		go c.Mux.Serve(session)
+		select {
+		case <-session.CloseChan():
+			log.WithFields(log.Fields{"module": moduleName}).Warnln("Session to the controller closed")
+		case <-stop:
+			session.Close()
+			c.drop(session)
+			return
+		}
+		c.drop(session)
+	}
+}
+
+func (c *Client) connect() (*yamux.Session, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	if !c.status.Since.IsZero() {
+		c.status.Reconnects++
+	}
+	c.session = session
+	c.status.Connected = true
+	c.status.Remote = conn.RemoteAddr().String()
+	c.status.Since = time.Now()
+	c.status.LastError = ""
+	close(c.ready)
+	log.WithFields(log.Fields{"module": moduleName, "remote": c.status.Remote}).Infoln("Session to the controller established")
+	return session, nil
+}
+
+func (c *Client) drop(session *yamux.Session) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	if c.session != session {
+		return
+	}
+	c.session = nil
+	c.status.Connected = false
+	c.ready = make(chan struct{})
+}
+
+// Open starts a stream to service on the controller, waiting for the
+// session for a while when it is down.
+func (c *Client) Open(service string) (net.Conn, error) {
+	deadline := time.After(openTimeout)
+	for {
+		c.mtx.Lock()
+		session, ready := c.session, c.ready
+		c.mtx.Unlock()
+		if session != nil {
+			stream, err := session.Open()
+			if err == nil {
+				if err = WriteService(stream, service); err == nil {
+					return stream, nil
+				}
+				stream.Close()
+			}
+			if !session.IsClosed() {
+				return nil, err
+			}
+			// The session just dropped, wait for the next one.
+			c.drop(session)
+			continue
+		}
+		select {
+		case <-ready:
+		case <-deadline:
+			return nil, ErrNoSession
+		}
+	}
+}
+
+// Reconnect closes the session, if any, and dials again right away, e.g.
+// when the configuration has changed.
+func (c *Client) Reconnect() {
+	c.mtx.Lock()
+	session := c.session
+	c.mtx.Unlock()
+	if session != nil {
+		session.Close()
+		return
+	}
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) Status() Status {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	status := c.status
+	if c.session != nil {
+		status.Streams = c.session.NumStreams()
+	}
+	return status
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// ServiceIPFIX carries the IPFIX messages a router exports to its
+// controller, as datagrams.
+const ServiceIPFIX = "ipfix"
+
+const maxDatagram = 65535
+
+var errDatagramSize = errors.New("datagram too large")
+
+// WriteDatagram sends msg on stream, prefixed with its length, so that
+// datagrams keep their boundaries.
+func WriteDatagram(stream net.Conn, msg []byte) error {
+	if len(msg) > maxDatagram {
+		return errDatagramSize
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := stream.Write(frame)
+	return err
+}
+
+// ReadDatagram reads the next datagram of stream into buf, which must hold
+// maxDatagram bytes to be safe, and returns it.
+func ReadDatagram(stream net.Conn, buf []byte) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > len(buf) {
+		return nil, errDatagramSize
+	}
+	if _, err := io.ReadFull(stream, buf[:size]); err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
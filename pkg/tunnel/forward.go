@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Services a router offers to the controller over its session, each one is
+// forwarded to a local daemon.
+const (
+	ServiceAgent   = "agent"
+	ServiceMetrics = "metrics"
+	ServiceDHCP    = "dhcp"
+)
+
+const forwardDialTimeout = 5 * time.Second
+
+// Forward returns a handler that pipes the streams it gets to a new TCP
+// connection to addr.
+func Forward(addr string) func(net.Conn) {
+	return func(stream net.Conn) {
+		defer stream.Close()
+		local, err := net.DialTimeout("tcp", addr, forwardDialTimeout)
+		if err != nil {
+			log.WithFields(log.Fields{"module": moduleName, "addr": addr, "error": err.Error()}).Warnln("Error forwarding stream")
+			return
+		}
+		defer local.Close()
+		Pipe(stream, local)
+	}
+}
+
+// Pipe copies a to b and b to a until both directions are done. The write
+// side of each end is closed as soon as its direction is done, so that half
+// closed connections keep working.
+func Pipe(a, b net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go pipe(a, b, wg)
+	go pipe(b, a, wg)
+	wg.Wait()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func pipe(from, to net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if _, err := io.Copy(to, from); err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Debugln("Error from copy")
+	}
+	// A yamux stream has no CloseWrite, closing it only sends its FIN and
+	// it can still be read.
+	if c, ok := to.(closeWriter); ok {
+		c.CloseWrite()
+	} else {
+		to.Close()
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Package tunnel multiplexes the traffic between a router and its controller
+over a single TLS connection, with yamux.
+
+Every stream starts with the name of the service it is meant for, so each
+end routes the streams it accepts to the right handler.
+*/
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	moduleName = "tunnel"
+
+	// Protocol is negotiated with ALPN by the connections that carry a
+	// session instead of plain HTTPS.
+	Protocol = "guan-tunnel/1"
+
+	// ServiceAPI is the controller API, the service the router streams go
+	// to by default.
+	ServiceAPI = "api"
+
+	headerTimeout = 10 * time.Second
+)
+
+var ErrUnknownService = errors.New("unknown service")
+
+// WriteService sends the header of a new stream.
+func WriteService(stream net.Conn, service string) error {
+	if len(service) == 0 || len(service) > 255 {
+		return errors.New("invalid service name")
+	}
+	_, err := stream.Write(append([]byte{byte(len(service))}, service...))
+	return err
+}
+
+// ReadService reads the header of an accepted stream.
+func ReadService(stream net.Conn) (string, error) {
+	stream.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+	var length [1]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return "", err
+	}
+	name := make([]byte, length[0])
+	if _, err := io.ReadFull(stream, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// yamuxLog sends the yamux messages, mostly stream resets, to the debug
+// level.
+var yamuxLog = log.WithFields(log.Fields{"module": moduleName}).WriterLevel(log.DebugLevel)
+
+func yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = true
+	config.KeepAliveInterval = 30 * time.Second
+	config.ConnectionWriteTimeout = 30 * time.Second
+	config.LogOutput = yamuxLog
+	return config
+}
+
+// Mux routes the streams accepted from a session to the handler of their
+// service.
+type Mux struct {
+	mtx      sync.Mutex
+	handlers map[string]func(net.Conn)
+	servers  []*http.Server
+}
+
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]func(net.Conn))}
+}
+
+// Handle makes handler own the streams of service, it must close them.
+func (m *Mux) Handle(service string, handler func(net.Conn)) {
+	defer m.mtx.Unlock()
+	m.mtx.Lock()
+	m.handlers[service] = handler
+}
+
+// HandleHTTP serves HTTP on the streams of service, until Close.
+func (m *Mux) HandleHTTP(service string, handler http.Handler) {
+	listener := newStreamListener()
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	m.mtx.Lock()
+	m.servers = append(m.servers, server)
+	m.mtx.Unlock()
+	m.Handle(service, listener.push)
+}
+
+// Close stops the HTTP servers of the mux, closing their listeners and the
+// streams they were serving. It is meant to be called once the session is
+// over.
+func (m *Mux) Close() error {
+	defer m.mtx.Unlock()
+	m.mtx.Lock()
+	for _, server := range m.servers {
+		server.Close()
+	}
+	m.servers = nil
+	return nil
+}
+
+// Serve dispatches the streams of session until it is closed.
+func (m *Mux) Serve(session *yamux.Session) error {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return err
+		}
+		go m.dispatch(stream)
+	}
+}
+
+func (m *Mux) dispatch(stream net.Conn) {
+	service, err := ReadService(stream)
+	if err != nil {
+		log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Warnln("Error reading stream header")
+		stream.Close()
+		return
+	}
+	m.mtx.Lock()
+	handler, ok := m.handlers[service]
+	m.mtx.Unlock()
+	if !ok {
+		log.WithFields(log.Fields{"module": moduleName, "service": service}).Warnln("Stream for an unknown service")
+		stream.Close()
+		return
+	}
+	handler(stream)
+}
+
+// streamListener hands the streams of a service to an http.Server.
+type streamListener struct {
+	streams chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newStreamListener() *streamListener {
+	return &streamListener{streams: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *streamListener) push(stream net.Conn) {
+	select {
+	case l.streams <- stream:
+	case <-l.done:
+		stream.Close()
+	}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return streamAddr{}
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "yamux" }
+func (streamAddr) String() string  { return "yamux" }
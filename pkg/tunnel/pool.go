@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pool orders.
+const (
+	ByPriority = "priority"
+	ByLatency  = "latency"
+)
+
+const (
+	minRetry = 5 * time.Second
+	maxRetry = 5 * time.Minute
+	// Sessions that drop sooner than this count as a failure of the
+	// controller, so that a flapping one is not tried first forever.
+	minSession = 30 * time.Second
+	rttWeight  = 0.3
+	// A controller of higher priority than the active one has to pass
+	// this many probes in a row before the session fails back to it.
+	failBackProbes = 2
+)
+
+type ControllerStatus struct {
+	Addr      string    `json:"addr"`
+	Priority  int       `json:"priority"`
+	Active    bool      `json:"active"`
+	Healthy   bool      `json:"healthy"`
+	RTT       float64   `json:"rtt"` // ms, smoothed, of the TCP handshake
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+
+	retryAt time.Time
+	passed  int // probes passed in a row
+}
+
+/*
+Pool keeps track of the health of the controllers of a router and decides
+which one to connect to: the healthy ones first, in priority order, the
+order they are listed in, or by latency. Controllers that fail are left
+aside for a while, longer the more they fail.
+
+In priority order, once a controller listed before the active one passes
+failBackProbes probes in a row, FailBack is called so that the session moves
+back to it.
+*/
+type Pool struct {
+	FailBack func()
+
+	mtx         sync.Mutex
+	order       string
+	controllers []*ControllerStatus
+}
+
+func NewPool() *Pool {
+	return &Pool{order: ByPriority}
+}
+
+// Set updates the controllers and the order, the health of the controllers
+// that were already known is kept.
+func (p *Pool) Set(addrs []string, order string) {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	if order != ByLatency {
+		order = ByPriority
+	}
+	p.order = order
+	known := make(map[string]*ControllerStatus)
+	for _, c := range p.controllers {
+		known[c.Addr] = c
+	}
+	p.controllers = nil
+	for i, addr := range addrs {
+		c, ok := known[addr]
+		if !ok {
+			c = &ControllerStatus{Addr: addr}
+		}
+		c.Priority = i
+		p.controllers = append(p.controllers, c)
+	}
+}
+
+func (p *Pool) find(addr string) *ControllerStatus {
+	for _, c := range p.controllers {
+		if c.Addr == addr {
+			return c
+		}
+	}
+	return nil
+}
+
+// Candidates returns every controller, in the order they should be tried.
+func (p *Pool) Candidates() []string {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	now := time.Now()
+	controllers := make([]*ControllerStatus, len(p.controllers))
+	copy(controllers, p.controllers)
+	sort.SliceStable(controllers, func(i, j int) bool {
+		a, b := controllers[i], controllers[j]
+		aReady, bReady := !now.Before(a.retryAt), !now.Before(b.retryAt)
+		if aReady != bReady {
+			return aReady
+		}
+		if !aReady {
+			return a.retryAt.Before(b.retryAt)
+		}
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		if p.order == ByLatency && a.RTT != b.RTT {
+			// Controllers not measured yet go last.
+			if a.RTT == 0 || b.RTT == 0 {
+				return b.RTT == 0
+			}
+			return a.RTT < b.RTT
+		}
+		return a.Priority < b.Priority
+	})
+	addrs := make([]string, len(controllers))
+	for i, c := range controllers {
+		addrs[i] = c.Addr
+	}
+	return addrs
+}
+
+// Dial tries the candidates in order until dial connects to one. The
+// connection it returns lets the pool know when the session on it ends.
+func (p *Pool) Dial(dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	candidates := p.Candidates()
+	if len(candidates) == 0 {
+		return nil, errors.New("no controller configured")
+	}
+	var errs []string
+	for _, addr := range candidates {
+		conn, err := dial(addr)
+		if err != nil {
+			p.failed(addr, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		p.connected(addr)
+		return &poolConn{Conn: conn, pool: p, addr: addr, since: time.Now()}, nil
+	}
+	return nil, fmt.Errorf("no controller reachable: %s", strings.Join(errs, "; "))
+}
+
+func (p *Pool) failed(addr string, err error) {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	c := p.find(addr)
+	if c == nil {
+		return
+	}
+	c.Active = false
+	c.Healthy = false
+	c.passed = 0
+	c.Failures++
+	c.LastError = err.Error()
+	c.LastCheck = time.Now()
+	retry := minRetry << uint(c.Failures-1)
+	if retry > maxRetry || retry <= 0 {
+		retry = maxRetry
+	}
+	c.retryAt = c.LastCheck.Add(retry)
+	log.WithFields(log.Fields{"module": moduleName, "controller": addr, "error": c.LastError}).Warnf("Controller failed, left aside for %v", retry)
+}
+
+func (p *Pool) connected(addr string) {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	for _, c := range p.controllers {
+		c.Active = c.Addr == addr
+		if c.Active {
+			c.Healthy = true
+			c.Failures = 0
+			c.LastError = ""
+			c.LastCheck = time.Now()
+			c.retryAt = time.Time{}
+		}
+	}
+}
+
+// disconnected is called when the session on addr ends. The controller is
+// no longer taken as healthy, so that the next session goes to another one
+// if there is any, until a probe says otherwise.
+func (p *Pool) disconnected(addr string, since time.Time) {
+	if time.Since(since) < minSession {
+		p.failed(addr, errors.New("session dropped"))
+		return
+	}
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	if c := p.find(addr); c != nil {
+		c.Active = false
+		c.Healthy = false
+	}
+}
+
+// Probe measures, every interval until stop is closed, how long it takes to
+// connect to each controller, and updates their health with it.
+func (p *Pool) Probe(interval, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.probe(timeout)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) probe(timeout time.Duration) {
+	p.mtx.Lock()
+	addrs := make([]string, len(p.controllers))
+	for i, c := range p.controllers {
+		addrs[i] = c.Addr
+	}
+	p.mtx.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			rtt := float64(time.Since(start)) / float64(time.Millisecond)
+			if err == nil {
+				conn.Close()
+			}
+			defer p.mtx.Unlock()
+			p.mtx.Lock()
+			c := p.find(addr)
+			if c == nil {
+				return
+			}
+			c.LastCheck = time.Now()
+			if err != nil {
+				c.Healthy = false
+				c.LastError = err.Error()
+				c.passed = 0
+				return
+			}
+			c.passed++
+			if c.RTT == 0 {
+				c.RTT = rtt
+			} else {
+				c.RTT = (1-rttWeight)*c.RTT + rttWeight*rtt
+			}
+			c.Healthy = true
+		}(addr)
+	}
+	wg.Wait()
+
+	if addr, ok := p.preferred(); ok && p.FailBack != nil {
+		log.WithFields(log.Fields{"module": moduleName, "controller": addr}).Infoln("Failing back to a controller of higher priority")
+		p.FailBack()
+	}
+}
+
+// preferred returns the controller of highest priority that is ready and
+// healthy, when it is not the active one but one listed before it.
+func (p *Pool) preferred() (string, bool) {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	if p.order != ByPriority {
+		return "", false
+	}
+	now := time.Now()
+	for _, c := range p.controllers {
+		if c.Active {
+			return "", false
+		}
+		if c.Healthy && c.passed >= failBackProbes && !now.Before(c.retryAt) {
+			return c.Addr, p.active() != nil
+		}
+	}
+	return "", false
+}
+
+func (p *Pool) active() *ControllerStatus {
+	for _, c := range p.controllers {
+		if c.Active {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *Pool) Status() []ControllerStatus {
+	defer p.mtx.Unlock()
+	p.mtx.Lock()
+	status := make([]ControllerStatus, len(p.controllers))
+	for i, c := range p.controllers {
+		status[i] = *c
+	}
+	return status
+}
+
+type poolConn struct {
+	net.Conn
+	pool  *Pool
+	addr  string
+	since time.Time
+	once  sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.pool.disconnected(c.addr, c.since) })
+	return c.Conn.Close()
+}
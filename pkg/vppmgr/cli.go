@@ -0,0 +1,24 @@
+package vppmgr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/maesoser/wan-controller/binapi/vpe"
+)
+
+// CLI runs a debug CLI command, like vppctl does, and returns its output.
+func (v *VPPManager) CLI(cmd string) (string, error) {
+	if v.VPPChann == nil {
+		return "", errors.New("no channel with VPP")
+	}
+	req := &vpe.CliInband{Cmd: cmd}
+	reply := &vpe.CliInbandReply{}
+	if err := v.VPPChann.SendRequest(req).ReceiveReply(reply); err != nil {
+		return "", err
+	}
+	if reply.Retval != 0 {
+		return reply.Reply, fmt.Errorf("%q failed with %d", cmd, reply.Retval)
+	}
+	return reply.Reply, nil
+}
@@ -0,0 +1,34 @@
+package vppmgr
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/maesoser/wan-controller/binapi/dns"
+)
+
+// AddDNSServer adds an upstream name server to the VPP dns plugin.
+func (v *VPPManager) AddDNSServer(server net.IP) error {
+	req := &dns.DNSNameServerAddDel{IsAdd: 1, ServerAddress: make([]byte, 16)}
+	if ip4 := server.To4(); ip4 != nil {
+		copy(req.ServerAddress, ip4)
+	} else if ip6 := server.To16(); ip6 != nil {
+		req.IsIP6 = 1
+		copy(req.ServerAddress, ip6)
+	} else {
+		return fmt.Errorf("invalid name server %v", server)
+	}
+	reply := &dns.DNSNameServerAddDelReply{}
+	return v.VPPChann.SendRequest(req).ReceiveReply(reply)
+}
+
+// EnableDNS makes VPP answer DNS queries on its addresses, resolving them
+// through the name servers added before.
+func (v *VPPManager) EnableDNS(enable bool) error {
+	req := &dns.DNSEnableDisable{}
+	if enable {
+		req.Enable = 1
+	}
+	reply := &dns.DNSEnableDisableReply{}
+	return v.VPPChann.SendRequest(req).ReceiveReply(reply)
+}
@@ -0,0 +1,92 @@
+package vppmgr
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/maesoser/wan-controller/binapi/flowprobe"
+	"github.com/maesoser/wan-controller/binapi/interfaces"
+	"github.com/maesoser/wan-controller/binapi/ipfix_export"
+)
+
+func ipfixAddress(ip net.IP) (ipfix_export.Address, error) {
+	var addr ipfix_export.IP4Address
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ipfix_export.Address{}, fmt.Errorf("%v is not an IPv4 address", ip)
+	}
+	copy(addr[:], ip4)
+	return ipfix_export.Address{Af: ipfix_export.ADDRESS_IP4, Un: ipfix_export.AddressUnionIP4(addr)}, nil
+}
+
+// SetIPFIXExporter makes VPP send its IPFIX records from source to the
+// collector, resending the templates every templateInterval seconds.
+func (v *VPPManager) SetIPFIXExporter(collector net.IP, port uint16, source net.IP, templateInterval uint32) error {
+	collectorAddr, err := ipfixAddress(collector)
+	if err != nil {
+		return err
+	}
+	sourceAddr, err := ipfixAddress(source)
+	if err != nil {
+		return err
+	}
+	req := &ipfix_export.SetIpfixExporter{
+		CollectorAddress: collectorAddr,
+		CollectorPort:    port,
+		SrcAddress:       sourceAddr,
+		VrfID:            0,
+		PathMtu:          1450,
+		TemplateInterval: templateInterval,
+		UDPChecksum:      true,
+	}
+	reply := &ipfix_export.SetIpfixExporterReply{}
+	return v.VPPChann.SendRequest(req).ReceiveReply(reply)
+}
+
+// SetFlowprobeParams selects the fields of the records (a combination of
+// the FLOWPROBE_RECORD_FLAG_* flags) and the active and passive timeouts in
+// seconds.
+func (v *VPPManager) SetFlowprobeParams(record flowprobe.FlowprobeRecordFlags, active, passive uint32) error {
+	req := &flowprobe.FlowprobeParams{
+		RecordFlags:  record,
+		ActiveTimer:  active,
+		PassiveTimer: passive,
+	}
+	reply := &flowprobe.FlowprobeParamsReply{}
+	return v.VPPChann.SendRequest(req).ReceiveReply(reply)
+}
+
+// AddFlowprobe records the flows received (rx), sent (tx) or both by an
+// interface with the ip4, ip6 or l2 template.
+func (v *VPPManager) AddFlowprobe(ifindex interfaces.InterfaceIndex, template, direction string) error {
+	var which flowprobe.FlowprobeWhichFlags
+	switch template {
+	case "", "ip4":
+		which = flowprobe.FLOWPROBE_WHICH_FLAG_IP4
+	case "ip6":
+		which = flowprobe.FLOWPROBE_WHICH_FLAG_IP6
+	case "l2":
+		which = flowprobe.FLOWPROBE_WHICH_FLAG_L2
+	default:
+		return fmt.Errorf("unknown flowprobe template %q", template)
+	}
+	var dir flowprobe.FlowprobeDirection
+	switch direction {
+	case "", "rx":
+		dir = flowprobe.FLOWPROBE_DIRECTION_RX
+	case "tx":
+		dir = flowprobe.FLOWPROBE_DIRECTION_TX
+	case "both":
+		dir = flowprobe.FLOWPROBE_DIRECTION_BOTH
+	default:
+		return fmt.Errorf("unknown flowprobe direction %q", direction)
+	}
+	req := &flowprobe.FlowprobeInterfaceAddDel{
+		IsAdd:     true,
+		Which:     which,
+		Direction: dir,
+		SwIfIndex: flowprobe.InterfaceIndex(ifindex),
+	}
+	reply := &flowprobe.FlowprobeInterfaceAddDelReply{}
+	return v.VPPChann.SendRequest(req).ReceiveReply(reply)
+}
@@ -0,0 +1,110 @@
+package vppmgr
+
+import (
+	"net"
+
+	"github.com/maesoser/wan-controller/binapi/nat"
+)
+
+type NATConfig struct {
+	EndpointDependent        bool
+	MaxTranslationsPerUser   uint32
+	MaxTranslationsPerThread uint32
+	MaxUsersPerThread        uint32
+}
+
+type NATUser struct {
+	Address        net.IP
+	VrfID          uint32
+	Sessions       uint32
+	StaticSessions uint32
+}
+
+type NATSession struct {
+	Protocol    uint16 // IP protocol number
+	InsideAddr  net.IP
+	InsidePort  uint16
+	OutsideAddr net.IP
+	OutsidePort uint16
+	RemoteAddr  net.IP
+	RemotePort  uint16
+	Bytes       uint64
+	Packets     uint64
+}
+
+func natToIP(addr nat.IP4Address) net.IP {
+	return net.IPv4(addr[0], addr[1], addr[2], addr[3])
+}
+
+func ipToNAT(ip net.IP) nat.IP4Address {
+	var addr nat.IP4Address
+	copy(addr[:], ip.To4())
+	return addr
+}
+
+func (v *VPPManager) NATConfig() (NATConfig, error) {
+	reply := &nat.NatShowConfig2Reply{}
+	if err := v.VPPChann.SendRequest(&nat.NatShowConfig2{}).ReceiveReply(reply); err != nil {
+		return NATConfig{}, err
+	}
+	return NATConfig{
+		EndpointDependent:        reply.EndpointDependent,
+		MaxTranslationsPerUser:   reply.MaxTranslationsPerUser,
+		MaxTranslationsPerThread: reply.MaxTranslationsPerThread,
+		MaxUsersPerThread:        reply.MaxUsersPerThread,
+	}, nil
+}
+
+// NATUsers returns the inside hosts that have NAT44 sessions.
+func (v *VPPManager) NATUsers() ([]NATUser, error) {
+	var users []NATUser
+	reqCtx := v.VPPChann.SendMultiRequest(&nat.Nat44UserDump{})
+	for {
+		msg := &nat.Nat44UserDetails{}
+		stop, err := reqCtx.ReceiveReply(msg)
+		if stop {
+			break
+		}
+		if err != nil {
+			return users, err
+		}
+		users = append(users, NATUser{
+			Address:        natToIP(msg.IPAddress),
+			VrfID:          msg.VrfID,
+			Sessions:       msg.Nsessions,
+			StaticSessions: msg.Nstaticsessions,
+		})
+	}
+	return users, nil
+}
+
+func (v *VPPManager) NATUserSessions(user NATUser) ([]NATSession, error) {
+	var sessions []NATSession
+	req := &nat.Nat44UserSessionDump{
+		IPAddress: ipToNAT(user.Address),
+		VrfID:     user.VrfID,
+	}
+	reqCtx := v.VPPChann.SendMultiRequest(req)
+	for {
+		msg := &nat.Nat44UserSessionDetails{}
+		stop, err := reqCtx.ReceiveReply(msg)
+		if stop {
+			break
+		}
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, NATSession{
+			Protocol:    msg.Protocol,
+			InsideAddr:  natToIP(msg.InsideIPAddress),
+			InsidePort:  msg.InsidePort,
+			OutsideAddr: natToIP(msg.OutsideIPAddress),
+			OutsidePort: msg.OutsidePort,
+			RemoteAddr:  natToIP(msg.ExtHostAddress),
+			RemotePort:  msg.ExtHostPort,
+			Bytes:       msg.TotalBytes,
+			Packets:     uint64(msg.TotalPkts),
+		})
+	}
+	return sessions, nil
+}
@@ -266,3 +266,45 @@ func (v *VPPManager) vppVersion() {
 	}
 	log.WithFields(log.Fields{"module": "wan-agent"}).Infof("Connected to VPP Daemon ver %q", reply.Version)
 }
+
+type Interface struct {
+	Index   interfaces.InterfaceIndex
+	Name    string
+	AdminUp bool
+	LinkUp  bool
+	Speed   uint64 // kbps
+	Duplex  string
+	MTU     uint16
+}
+
+// Interfaces returns the state of every VPP interface.
+func (v *VPPManager) Interfaces() ([]Interface, error) {
+	var ifaces []Interface
+	reqCtx := v.VPPChann.SendMultiRequest(&interfaces.SwInterfaceDump{})
+	for {
+		msg := &interfaces.SwInterfaceDetails{}
+		stop, err := reqCtx.ReceiveReply(msg)
+		if stop {
+			break
+		}
+		if err != nil {
+			return ifaces, err
+		}
+		iface := Interface{
+			Index:   msg.SwIfIndex,
+			Name:    strings.TrimRight(string(msg.InterfaceName[:]), "\x00"),
+			AdminUp: msg.Flags&interfaces.IF_STATUS_API_FLAG_ADMIN_UP != 0,
+			LinkUp:  msg.Flags&interfaces.IF_STATUS_API_FLAG_LINK_UP != 0,
+			Speed:   uint64(msg.LinkSpeed),
+			MTU:     msg.LinkMtu,
+		}
+		switch msg.LinkDuplex {
+		case 1:
+			iface.Duplex = "half"
+		case 2:
+			iface.Duplex = "full"
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
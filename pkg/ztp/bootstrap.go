@@ -0,0 +1,158 @@
+/*
+Package ztp provisions routers with no configuration from removable media.
+
+A pendrive holds a bootstrap file, signed by the operator with an Ed25519
+key whose public half is part of the router image. It names the router,
+its controllers and the CA they are signed by, carries the token the
+router enrolls with and the network it reaches the controllers through.
+Bootstraps always expire.
+*/
+package ztp
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+)
+
+// BootstrapFile is the name of the bootstrap file on the media.
+const BootstrapFile = "bootstrap.json"
+
+type Bootstrap struct {
+	UUID        string   `json:"uuid"`
+	Name        string   `json:"name,omitempty"`
+	Token       string   `json:"token"`
+	Controllers []string `json:"controllers"`
+	CA          string   `json:"ca"` // PEM
+	// Network and DNSs are applied before enrolling, so that the router
+	// can reach the controllers.
+	Network config.Network `json:"network"`
+	DNSs    []string       `json:"dns,omitempty"`
+	Expires time.Time      `json:"expires"`
+}
+
+// SignedBootstrap is the bootstrap file: the JSON of a Bootstrap, as it was
+// signed, and its signature.
+type SignedBootstrap struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+func Sign(b Bootstrap, key ed25519.PrivateKey) (*SignedBootstrap, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedBootstrap{Payload: payload, Signature: ed25519.Sign(key, payload)}, nil
+}
+
+// Verify checks the signature and returns the bootstrap, if it is valid.
+func (s *SignedBootstrap) Verify(key ed25519.PublicKey) (*Bootstrap, error) {
+	if !ed25519.Verify(key, s.Payload, s.Signature) {
+		return nil, errors.New("invalid bootstrap signature")
+	}
+	b := &Bootstrap{}
+	if err := json.Unmarshal(s.Payload, b); err != nil {
+		return nil, err
+	}
+	return b, b.Validate()
+}
+
+func (b *Bootstrap) Validate() error {
+	if b.UUID == "" {
+		return errors.New("bootstrap without uuid")
+	}
+	if b.Token == "" {
+		return errors.New("bootstrap without enrollment token")
+	}
+	if len(b.Controllers) == 0 {
+		return errors.New("bootstrap without controllers")
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(b.CA)) {
+		return errors.New("bootstrap without a valid CA")
+	}
+	if b.Network.Uplink.Name == "" {
+		return errors.New("bootstrap without uplink")
+	}
+	if net.ParseIP(b.Network.Gateway).To4() == nil {
+		return errors.New("bootstrap without a valid gateway")
+	}
+	if b.Expires.IsZero() {
+		return errors.New("bootstrap without expiry")
+	}
+	if time.Now().After(b.Expires) {
+		return fmt.Errorf("bootstrap expired at %v", b.Expires)
+	}
+	return nil
+}
+
+// ReadBootstrap reads and verifies a bootstrap file. The file itself is
+// returned as well, to be copied.
+func ReadBootstrap(path string, key ed25519.PublicKey) (*Bootstrap, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signed SignedBootstrap
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, nil, err
+	}
+	b, err := signed.Verify(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, data, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key in PEM.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return public, nil
+}
+
+// LoadPrivateKey reads an Ed25519 private key in PKCS #8 PEM.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return private, nil
+}
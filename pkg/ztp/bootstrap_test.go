@@ -0,0 +1,138 @@
+package ztp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/maesoser/wan-controller/pkg/config"
+)
+
+func testCA(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testBootstrap(ca string) Bootstrap {
+	return Bootstrap{
+		UUID:        "e0c5a9f2-0001",
+		Token:       "token",
+		Controllers: []string{"192.168.0.76:6633"},
+		CA:          ca,
+		Network: config.Network{
+			Gateway: "192.168.2.1",
+			Uplink:  config.Uplink{Name: "port1", DHCP: true},
+		},
+		Expires: time.Now().Add(time.Hour),
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ca := testCA(t)
+	tests := []struct {
+		name   string
+		change func(*Bootstrap)
+		valid  bool
+	}{
+		{"valid", func(b *Bootstrap) {}, true},
+		{"no uuid", func(b *Bootstrap) { b.UUID = "" }, false},
+		{"no token", func(b *Bootstrap) { b.Token = "" }, false},
+		{"no controllers", func(b *Bootstrap) { b.Controllers = nil }, false},
+		{"no CA", func(b *Bootstrap) { b.CA = "" }, false},
+		{"invalid CA", func(b *Bootstrap) { b.CA = "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n" }, false},
+		{"no uplink", func(b *Bootstrap) { b.Network.Uplink.Name = "" }, false},
+		{"no gateway", func(b *Bootstrap) { b.Network.Gateway = "" }, false},
+		{"IPv6 gateway", func(b *Bootstrap) { b.Network.Gateway = "fd00::1" }, false},
+		{"no expiry", func(b *Bootstrap) { b.Expires = time.Time{} }, false},
+		{"expired", func(b *Bootstrap) { b.Expires = time.Now().Add(-time.Second) }, false},
+	}
+	for _, tt := range tests {
+		b := testBootstrap(ca)
+		tt.change(&b)
+		if err := b.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testBootstrap(testCA(t))
+	signed, err := Sign(b, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := signed.Verify(public)
+	if err != nil {
+		t.Fatalf("valid bootstrap rejected: %v", err)
+	}
+	if verified.UUID != b.UUID || verified.Network.Uplink.Name != b.Network.Uplink.Name {
+		t.Errorf("got %+v, want %+v", verified, b)
+	}
+
+	tamper := func(change func(*SignedBootstrap)) *SignedBootstrap {
+		s := &SignedBootstrap{
+			Payload:   append([]byte(nil), signed.Payload...),
+			Signature: append([]byte(nil), signed.Signature...),
+		}
+		change(s)
+		return s
+	}
+	expired := b
+	expired.Expires = time.Now().Add(-time.Minute)
+	expiredSigned := &SignedBootstrap{}
+	expiredSigned.Payload, _ = json.Marshal(expired)
+	expiredSigned.Signature = ed25519.Sign(private, expiredSigned.Payload)
+
+	tests := []struct {
+		name   string
+		signed *SignedBootstrap
+		key    ed25519.PublicKey
+	}{
+		{"other key", signed, otherPublic},
+		{"signed by another key", tamper(func(s *SignedBootstrap) { s.Signature = ed25519.Sign(otherPrivate, s.Payload) }), public},
+		{"payload changed", tamper(func(s *SignedBootstrap) { s.Payload[len(s.Payload)-2] ^= 1 }), public},
+		{"signature changed", tamper(func(s *SignedBootstrap) { s.Signature[0] ^= 1 }), public},
+		{"no signature", tamper(func(s *SignedBootstrap) { s.Signature = nil }), public},
+		{"expired", expiredSigned, public},
+	}
+	for _, tt := range tests {
+		if _, err := tt.signed.Verify(tt.key); err == nil {
+			t.Errorf("%s: bootstrap accepted", tt.name)
+		}
+	}
+
+	if _, err := Sign(expired, private); err == nil {
+		t.Error("expired bootstrap signed")
+	}
+}
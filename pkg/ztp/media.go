@@ -0,0 +1,167 @@
+package ztp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	moduleName = "ztp"
+	sysBlock   = "/sys/class/block"
+)
+
+// filesystems are tried in order when mounting media.
+var filesystems = []string{"vfat", "exfat", "ext4", "ext3", "ext2", "iso9660"}
+
+// Uevent is a kernel device event.
+type Uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevName   string
+	DevType   string
+}
+
+func parseUevent(data []byte) Uevent {
+	var e Uevent
+	for _, field := range bytes.Split(data, []byte{0}) {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ACTION":
+			e.Action = kv[1]
+		case "DEVPATH":
+			e.DevPath = kv[1]
+		case "SUBSYSTEM":
+			e.Subsystem = kv[1]
+		case "DEVNAME":
+			e.DevName = kv[1]
+		case "DEVTYPE":
+			e.DevType = kv[1]
+		}
+	}
+	return e
+}
+
+// Removable tells whether the block device dev, like sdb1, is removable
+// media, or is on one. Many pendrives say they are not removable, being on
+// USB is enough.
+func Removable(dev string) bool {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysBlock, dev))
+	if err != nil {
+		return false
+	}
+	if strings.Contains(path, "/usb") {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(path, "partition")); err == nil {
+		path = filepath.Dir(path)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, "removable"))
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+/*
+WatchMedia sends the removable block devices, disks and partitions, that
+are plugged in until stop is closed, the ones already there first. It
+listens to the kernel uevents, no udev is needed.
+*/
+func WatchMedia(stop <-chan struct{}) (<-chan string, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Wake up every second to see whether to stop.
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	devices := make(chan string)
+	go func() {
+		defer close(devices)
+		defer unix.Close(fd)
+		send := func(dev string) bool {
+			select {
+			case devices <- dev:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+		present, _ := ioutil.ReadDir(sysBlock)
+		for _, info := range present {
+			if Removable(info.Name()) && !send(info.Name()) {
+				return
+			}
+		}
+		buf := make([]byte, 16384)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n, from, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"module": moduleName, "error": err.Error()}).Errorln("Error reading uevents")
+				return
+			}
+			// Only the kernel sends from port 0, anyone else could fake
+			// a device.
+			if sender, ok := from.(*unix.SockaddrNetlink); !ok || sender.Pid != 0 {
+				continue
+			}
+			e := parseUevent(buf[:n])
+			if e.Action != "add" || e.Subsystem != "block" || e.DevName == "" {
+				continue
+			}
+			dev := filepath.Base(e.DevName)
+			if !Removable(dev) {
+				continue
+			}
+			log.WithFields(log.Fields{"module": moduleName, "device": dev, "type": e.DevType}).Infoln("Removable media plugged in")
+			if !send(dev) {
+				return
+			}
+		}
+	}()
+	return devices, nil
+}
+
+// Mount mounts the block device dev read only at dir. It returns the
+// function that unmounts it.
+func Mount(dev, dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	flags := uintptr(unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	var err error
+	for _, fstype := range filesystems {
+		if err = unix.Mount(filepath.Join("/dev", dev), dir, fstype, flags, ""); err == nil {
+			return func() {
+				if err := unix.Unmount(dir, 0); err != nil {
+					log.WithFields(log.Fields{"module": moduleName, "device": dev, "error": err.Error()}).Warnln("Error unmounting media")
+				}
+			}, nil
+		}
+	}
+	return nil, err
+}